@@ -0,0 +1,85 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "net"
+)
+
+// A2S_INFO, the Steam server query that Valheim answers on its query port
+var (
+    a2sPrefix      = []byte{0xff, 0xff, 0xff, 0xff}
+    a2sInfoRequest = append(append([]byte{}, a2sPrefix...), []byte("TSource Engine Query\x00")...)
+)
+
+// Response headers
+const (
+    a2sChallenge = byte('A')
+    a2sInfo      = byte('I')
+)
+
+// queryA2SPlayers asks the server at addr for its info and returns the
+// number of players on it
+func queryA2SPlayers(ctx context.Context, addr string) (int, error) {
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, "udp", addr)
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+
+    // Servers may first answer with a challenge, which the request is
+    // repeated with
+    request := a2sInfoRequest
+    response := make([]byte, 1400)
+    for attempt := 0; attempt < 2; attempt++ {
+        if _, err := conn.Write(request); err != nil {
+            return 0, fmt.Errorf("failed to send A2S_INFO: %v", err)
+        }
+        n, err := conn.Read(response)
+        if err != nil {
+            return 0, fmt.Errorf("failed to read A2S_INFO: %v", err)
+        }
+        if n < 5 || !bytes.Equal(response[:4], a2sPrefix) {
+            return 0, fmt.Errorf("malformed A2S_INFO response")
+        }
+
+        switch response[4] {
+        case a2sChallenge:
+            if n < 9 {
+                return 0, fmt.Errorf("malformed A2S challenge")
+            }
+            request = append(append([]byte{}, a2sInfoRequest...), response[5:9]...)
+        case a2sInfo:
+            return parseA2SPlayers(response[5:n])
+        default:
+            return 0, fmt.Errorf("unexpected A2S response type %q", response[4])
+        }
+    }
+    return 0, fmt.Errorf("server kept answering A2S_INFO with a challenge")
+}
+
+// parseA2SPlayers skips the protocol version, the name, map, folder and
+// game strings and the app ID to reach the player count
+func parseA2SPlayers(info []byte) (int, error) {
+    pos := 1
+    for i := 0; i < 4; i++ {
+        end := -1
+        if pos < len(info) {
+            end = bytes.IndexByte(info[pos:], 0)
+        }
+        if end < 0 {
+            return 0, fmt.Errorf("truncated A2S_INFO response")
+        }
+        pos += end + 1
+    }
+    pos += 2
+    if pos >= len(info) {
+        return 0, fmt.Errorf("truncated A2S_INFO response")
+    }
+    return int(info[pos]), nil
+}
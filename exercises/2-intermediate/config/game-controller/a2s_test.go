@@ -0,0 +1,144 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "net"
+    "testing"
+    "time"
+)
+
+// a2sInfoPayload is an A2S_INFO answer, as a Valheim server sends it, after
+// the 0xFFFFFFFF 'I' header
+func a2sInfoPayload(players byte) []byte {
+    var b bytes.Buffer
+    b.WriteByte(0x11)                     // protocol
+    b.WriteString("Valheim Server\x00")   // name
+    b.WriteString("Meadows\x00")          // map
+    b.WriteString("valheim\x00")          // folder
+    b.WriteString("Valheim\x00")          // game
+    b.Write([]byte{0x00, 0x00})           // app ID
+    b.Write([]byte{players, 10, 0})       // players, max players, bots
+    b.Write([]byte{'d', 'l', 0, 1})       // server type, environment, visibility, VAC
+    b.WriteString("0.217.46\x00")         // version
+    return b.Bytes()
+}
+
+func TestParseA2SPlayers(t *testing.T) {
+    full := a2sInfoPayload(3)
+    // The player count follows the app ID
+    countAt := bytes.Index(full, []byte("Valheim\x00")) + len("Valheim\x00") + 2
+
+    tests := []struct {
+        name    string
+        info    []byte
+        want    int
+        wantErr bool
+    }{
+        {name: "players online", info: full, want: 3},
+        {name: "empty server", info: a2sInfoPayload(0), want: 0},
+        {name: "empty", info: nil, wantErr: true},
+        {name: "protocol only", info: full[:1], wantErr: true},
+        {name: "cut off in the strings", info: full[:20], wantErr: true},
+        {name: "cut off in the app ID", info: full[:countAt-1], wantErr: true},
+        {name: "cut off before the player count", info: full[:countAt], wantErr: true},
+        {name: "ends at the player count", info: full[:countAt+1], want: 3},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := parseA2SPlayers(tt.info)
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("got %d, want error", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if got != tt.want {
+                t.Errorf("got %d players, want %d", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestQueryA2SPlayers(t *testing.T) {
+    challenge := []byte{0x5a, 0x3c, 0x11, 0x07}
+    tests := []struct {
+        name string
+        // answer returns the server's reply to the n-th request
+        answer  func(n int, request []byte) []byte
+        want    int
+        wantErr bool
+    }{
+        {
+            name: "answers right away",
+            answer: func(n int, request []byte) []byte {
+                return append([]byte{0xff, 0xff, 0xff, 0xff, 'I'}, a2sInfoPayload(5)...)
+            },
+            want: 5,
+        },
+        {
+            name: "answers a repeated request with the challenge",
+            answer: func(n int, request []byte) []byte {
+                if !bytes.HasSuffix(request, challenge) {
+                    return append([]byte{0xff, 0xff, 0xff, 0xff, 'A'}, challenge...)
+                }
+                return append([]byte{0xff, 0xff, 0xff, 0xff, 'I'}, a2sInfoPayload(2)...)
+            },
+            want: 2,
+        },
+        {
+            name: "keeps challenging",
+            answer: func(n int, request []byte) []byte {
+                return append([]byte{0xff, 0xff, 0xff, 0xff, 'A'}, challenge...)
+            },
+            wantErr: true,
+        },
+        {
+            name: "malformed header",
+            answer: func(n int, request []byte) []byte {
+                return []byte{0xfe, 0xff, 0xff, 0xff, 'I', 0x11}
+            },
+            wantErr: true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server, err := net.ListenPacket("udp", "127.0.0.1:0")
+            if err != nil {
+                t.Fatalf("failed to listen: %v", err)
+            }
+            defer server.Close()
+            go func() {
+                buf := make([]byte, 1400)
+                for n := 0; ; n++ {
+                    size, addr, err := server.ReadFrom(buf)
+                    if err != nil {
+                        return
+                    }
+                    server.WriteTo(tt.answer(n, buf[:size]), addr)
+                }
+            }()
+
+            ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+            defer cancel()
+            got, err := queryA2SPlayers(ctx, server.LocalAddr().String())
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("got %d, want error", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if got != tt.want {
+                t.Errorf("got %d players, want %d", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+    "fmt"
+
+    batchv1 "k8s.io/api/batch/v1"
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BackupSpec archives the world volume on a schedule, keeping the newest
+// Retention archives. Backups outlive the Game on purpose: they are what a
+// deleted world is restored from.
+type BackupSpec struct {
+    Schedule  string       `json:"schedule"`
+    Retention int32        `json:"retention,omitempty"`
+    Target    BackupTarget `json:"target"`
+}
+
+// BackupTarget is where archives are kept: a PVC, or an S3-compatible
+// object store such as a local MinIO. Exactly one is set.
+type BackupTarget struct {
+    PVC         *PVCTarget         `json:"pvc,omitempty"`
+    ObjectStore *ObjectStoreTarget `json:"objectStore,omitempty"`
+}
+
+type PVCTarget struct {
+    ClaimName string `json:"claimName"`
+}
+
+// ObjectStoreTarget reads its credentials from the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY keys of SecretName
+type ObjectStoreTarget struct {
+    Endpoint   string `json:"endpoint"`
+    Bucket     string `json:"bucket"`
+    SecretName string `json:"secretName"`
+}
+
+// RestoreSpec seeds the world volume of a new Game from a backup in the
+// backup target, taken from this Game or, with Game set, from another one
+type RestoreSpec struct {
+    Backup string `json:"backup"`
+    Game   string `json:"game,omitempty"`
+}
+
+// Backups are stored as <target>/<game>/<timestamp>.tar.gz, where the
+// timestamp, e.g. 20261016-120000, is the backup's name
+const (
+    backupImage      = "busybox:1.36"
+    objectStoreImage = "amazon/aws-cli:2.15.0"
+    defaultRetention = int32(7)
+)
+
+// Mount paths in backup and restore pods
+const (
+    worldPath   = "/world"
+    archivePath = "/archive"
+    targetPath  = "/backups"
+)
+
+func backupCronJobName(game *Game) string {
+    return game.Name + "-backup"
+}
+
+// worldClaimName is the PVC the StatefulSet created for the server's world
+func worldClaimName(game *Game) string {
+    return fmt.Sprintf("%s-%s-0", worldVolume, game.Name)
+}
+
+// createBackupCronJob archives the world while the server keeps running.
+// The world volume is ReadWriteOnce, so the backup pod is scheduled onto
+// the node running the server and mounts it read-only.
+//
+// Backups are crash-consistent only. The server isn't told to flush and
+// hold its saves (e.g. Minecraft's save-all and save-off over RCON) while
+// the archive is written, so an archive holds what the server last wrote,
+// possibly a file caught mid-write, and a restore is like starting the
+// server after a crash.
+func createBackupCronJob(game *Game) *batchv1.CronJob {
+    backup := game.Spec.Backup
+    retention := backup.Retention
+    if retention == 0 {
+        retention = defaultRetention
+    }
+    dir := backupDir(game.Spec.Backup.Target, game.Name)
+
+    archive := fmt.Sprintf(`set -e
+name=$(date -u +%%Y%%m%%d-%%H%%M%%S)
+mkdir -p %[1]s
+tar czf %[1]s/$name.tar.gz -C %[2]s .
+echo "Backed up world to $name"`, dir, worldPath)
+    prune := fmt.Sprintf(`ls -1 %[1]s | sort -r | tail -n +%[2]d | while read old; do rm -f "%[1]s/$old"; echo "Pruned $old"; done`, dir, retention+1)
+
+    volumes := []corev1.Volume{
+        {
+            Name: worldVolume,
+            VolumeSource: corev1.VolumeSource{
+                PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+                    ClaimName: worldClaimName(game),
+                    ReadOnly: true,
+                },
+            },
+        },
+    }
+    worldMount := corev1.VolumeMount{Name: worldVolume, MountPath: worldPath, ReadOnly: true}
+
+    var initContainers, containers []corev1.Container
+    if pvc := backup.Target.PVC; pvc != nil {
+        volumes = append(volumes, corev1.Volume{
+            Name: "target",
+            VolumeSource: corev1.VolumeSource{
+                PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.ClaimName},
+            },
+        })
+        containers = append(containers, corev1.Container{
+            Name: "backup",
+            Image: backupImage,
+            Command: []string{"sh", "-c", archive + "\n" + prune},
+            VolumeMounts: []corev1.VolumeMount{
+                worldMount,
+                {Name: "target", MountPath: targetPath},
+            },
+        })
+    } else {
+        // The archive is built next to the world and uploaded from there
+        store := backup.Target.ObjectStore
+        volumes = append(volumes, corev1.Volume{
+            Name: "archive",
+            VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+        })
+        initContainers = append(initContainers, corev1.Container{
+            Name: "archive",
+            Image: backupImage,
+            Command: []string{"sh", "-c", archive},
+            VolumeMounts: []corev1.VolumeMount{
+                worldMount,
+                {Name: "archive", MountPath: archivePath},
+            },
+        })
+        prefix := fmt.Sprintf("s3://%s/%s/", store.Bucket, game.Name)
+        upload := fmt.Sprintf(`set -e
+for file in %[1]s/*.tar.gz; do aws s3 cp "$file" %[2]s --endpoint-url "$S3_ENDPOINT"; done
+aws s3 ls %[2]s --endpoint-url "$S3_ENDPOINT" | awk '{print $4}' | sort -r | tail -n +%[3]d | while read old; do aws s3 rm "%[2]s$old" --endpoint-url "$S3_ENDPOINT"; done`,
+            dir, prefix, retention+1)
+        containers = append(containers, objectStoreContainer("upload", store, upload))
+    }
+
+    successfulJobs := int32(3)
+    failedJobs := int32(3)
+    deadline := int64(600)
+    return &batchv1.CronJob{
+        TypeMeta: metav1.TypeMeta{APIVersion: "batch/v1", Kind: "CronJob"},
+        ObjectMeta: metav1.ObjectMeta{
+            Name: backupCronJobName(game),
+            Namespace: game.Namespace,
+            Labels: childLabels(game),
+            OwnerReferences: []metav1.OwnerReference{
+                ownerReference(game),
+            },
+        },
+        Spec: batchv1.CronJobSpec{
+            Schedule: backup.Schedule,
+            ConcurrencyPolicy: batchv1.ForbidConcurrent,
+            StartingDeadlineSeconds: &deadline,
+            SuccessfulJobsHistoryLimit: &successfulJobs,
+            FailedJobsHistoryLimit: &failedJobs,
+            JobTemplate: batchv1.JobTemplateSpec{
+                Spec: batchv1.JobSpec{
+                    Template: corev1.PodTemplateSpec{
+                        ObjectMeta: metav1.ObjectMeta{
+                            Labels: map[string]string{
+                                gameLabel: game.Name,
+                            },
+                        },
+                        Spec: corev1.PodSpec{
+                            RestartPolicy: corev1.RestartPolicyOnFailure,
+                            Affinity: &corev1.Affinity{
+                                PodAffinity: &corev1.PodAffinity{
+                                    RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
+                                        {
+                                            LabelSelector: &metav1.LabelSelector{
+                                                MatchLabels: map[string]string{
+                                                    "game": game.Name,
+                                                },
+                                            },
+                                            TopologyKey: "kubernetes.io/hostname",
+                                        },
+                                    },
+                                },
+                            },
+                            InitContainers: initContainers,
+                            Containers: containers,
+                            Volumes: volumes,
+                        },
+                    },
+                },
+            },
+        },
+    }
+}
+
+// backupDir is where the backup pod writes a Game's archives: the target
+// PVC, or the scratch volume an upload is made from
+func backupDir(target BackupTarget, gameName string) string {
+    if target.PVC != nil {
+        return fmt.Sprintf("%s/%s", targetPath, gameName)
+    }
+    return archivePath
+}
+
+// restoreContainers seed the world volume from the backup named by
+// restoreFrom before the server first starts. A volume that already holds a
+// world is left alone, so only a new Game is restored.
+func restoreContainers(game *Game) ([]corev1.Container, []corev1.Volume) {
+    restore := game.Spec.RestoreFrom
+    source := restore.Game
+    if source == "" {
+        source = game.Name
+    }
+
+    worldMount := corev1.VolumeMount{Name: worldVolume, MountPath: worldPath}
+
+    target := game.Spec.Backup.Target
+    if pvc := target.PVC; pvc != nil {
+        archive := fmt.Sprintf("%s/%s/%s.tar.gz", targetPath, source, restore.Backup)
+        return []corev1.Container{
+                {
+                    Name: "restore",
+                    Image: backupImage,
+                    Command: []string{"sh", "-c", restoreScript(archive, source+"/"+restore.Backup)},
+                    VolumeMounts: []corev1.VolumeMount{
+                        worldMount,
+                        {Name: "backups", MountPath: targetPath, ReadOnly: true},
+                    },
+                },
+            }, []corev1.Volume{
+                {
+                    Name: "backups",
+                    VolumeSource: corev1.VolumeSource{
+                        PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+                            ClaimName: pvc.ClaimName,
+                            ReadOnly: true,
+                        },
+                    },
+                },
+            }
+    }
+
+    // The archive is downloaded first, unless the world is already there
+    store := target.ObjectStore
+    archive := fmt.Sprintf("%s/%s.tar.gz", archivePath, restore.Backup)
+    download := fmt.Sprintf(`set -e
+if [ -e %[1]s/.restored ]; then exit 0; fi
+aws s3 cp s3://%[2]s/%[3]s/%[4]s.tar.gz %[5]s --endpoint-url "$S3_ENDPOINT"`,
+        worldPath, store.Bucket, source, restore.Backup, archive)
+    fetch := objectStoreContainer("fetch-backup", store, download)
+    fetch.VolumeMounts = append(fetch.VolumeMounts, worldMount)
+    return []corev1.Container{
+            fetch,
+            {
+                Name: "restore",
+                Image: backupImage,
+                Command: []string{"sh", "-c", restoreScript(archive, source+"/"+restore.Backup)},
+                VolumeMounts: []corev1.VolumeMount{
+                    worldMount,
+                    {Name: "archive", MountPath: archivePath, ReadOnly: true},
+                },
+            },
+        }, []corev1.Volume{
+            {
+                Name: "archive",
+                VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+            },
+        }
+}
+
+// restoreScript extracts archive into an empty world volume. A marker file
+// tells a finished restore from a world the server has written since, and
+// an interrupted one is started again.
+func restoreScript(archive, backup string) string {
+    return fmt.Sprintf(`set -e
+if [ -e %[1]s/.restored ]; then exit 0; fi
+if [ ! -e %[1]s/.restoring ] && [ -n "$(ls -A %[1]s | grep -v '^lost+found$')" ]; then
+  echo "World volume is not empty, not restoring"; exit 0
+fi
+touch %[1]s/.restoring
+find %[1]s -mindepth 1 -maxdepth 1 ! -name lost+found ! -name .restoring -exec rm -rf {} +
+tar xzf %[2]s -C %[1]s
+mv %[1]s/.restoring %[1]s/.restored
+echo "Restored world from %[3]s"`, worldPath, archive, backup)
+}
+
+// objectStoreContainer runs script with the AWS CLI pointed at the store
+func objectStoreContainer(name string, store *ObjectStoreTarget, script string) corev1.Container {
+    return corev1.Container{
+        Name: name,
+        Image: objectStoreImage,
+        Command: []string{"sh", "-c", script},
+        Env: []corev1.EnvVar{
+            {
+                Name: "S3_ENDPOINT",
+                Value: store.Endpoint,
+            },
+        },
+        EnvFrom: []corev1.EnvFromSource{
+            {
+                SecretRef: &corev1.SecretEnvSource{
+                    LocalObjectReference: corev1.LocalObjectReference{Name: store.SecretName},
+                },
+            },
+        },
+        VolumeMounts: []corev1.VolumeMount{
+            {Name: "archive", MountPath: archivePath},
+        },
+    }
+}
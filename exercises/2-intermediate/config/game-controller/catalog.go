@@ -0,0 +1,240 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/util/intstr"
+    "sigs.k8s.io/yaml"
+)
+
+// The game catalog describes how to run each game the Game CRD accepts. It
+// is read from the catalog.yaml key of a ConfigMap (05-2-game-catalog.yaml),
+// so supporting a new image or tag scheme doesn't need a new controller.
+const catalogKey = "catalog.yaml"
+
+// Catalog maps a Game's gameName to how its server is run
+type Catalog struct {
+    Games map[string]*CatalogEntry `json:"games"`
+}
+
+type CatalogEntry struct {
+    // Image is the repository, without a tag
+    Image string `json:"image"`
+    // TagFormat builds the tag from gameVersion, without a leading "v", in
+    // place of {version}, e.g. "vanilla-{version}". Without a format the
+    // version can only be passed through Env.Version.
+    TagFormat string `json:"tagFormat,omitempty"`
+    // DefaultTag is used when the Game has no gameVersion; "latest" if unset
+    DefaultTag string `json:"defaultTag,omitempty"`
+    Ports []CatalogPort `json:"ports"`
+    Env EnvMapping `json:"env,omitempty"`
+    ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+    // Resources are the container's requests and limits
+    Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+    Storage StorageDefaults `json:"storage"`
+    // PlayerQuery says how to count the players on a server; servers of a
+    // game without one are restarted without waiting for them to empty
+    PlayerQuery *PlayerQuery `json:"playerQuery,omitempty"`
+}
+
+// CatalogPort is a port the server listens on. It is Offset above the
+// Game's port, unless Port fixes it.
+type CatalogPort struct {
+    Name     string          `json:"name"`
+    Offset   int32           `json:"offset,omitempty"`
+    Port     int32           `json:"port,omitempty"`
+    Protocol corev1.Protocol `json:"protocol,omitempty"`
+    // Internal ports, like RCON, are left off the Service
+    Internal bool            `json:"internal,omitempty"`
+}
+
+// EnvMapping names the environment variables a game's image reads the Game
+// settings from. Settings without a variable are not passed.
+type EnvMapping struct {
+    Players    string `json:"players,omitempty"`
+    ServerName string `json:"serverName,omitempty"`
+    Mode       string `json:"mode,omitempty"`
+    Difficulty string `json:"difficulty,omitempty"`
+    Version    string `json:"version,omitempty"`
+    Port       string `json:"port,omitempty"`
+    // Static variables are set as given
+    Static     map[string]string `json:"static,omitempty"`
+}
+
+// StorageDefaults sizes the world volume and says where the game keeps it
+type StorageDefaults struct {
+    Size      string `json:"size"`
+    MountPath string `json:"mountPath"`
+}
+
+// PlayerQuery picks the registered prober for a game and the catalog port
+// it talks to. RCON needs a password: the controller generates one per Game
+// and hands it to the server through PasswordEnv or the file at
+// PasswordFile.
+type PlayerQuery struct {
+    Protocol     string `json:"protocol"`
+    Port         string `json:"port"`
+    PasswordEnv  string `json:"passwordEnv,omitempty"`
+    PasswordFile string `json:"passwordFile,omitempty"`
+}
+
+// ParseCatalog reads a catalog and checks that every entry is usable
+func ParseCatalog(data string) (*Catalog, error) {
+    catalog := &Catalog{}
+    if err := yaml.UnmarshalStrict([]byte(data), catalog); err != nil {
+        return nil, fmt.Errorf("invalid game catalog: %v", err)
+    }
+    for name, entry := range catalog.Games {
+        if err := entry.validate(); err != nil {
+            return nil, fmt.Errorf("invalid game catalog entry %s: %v", name, err)
+        }
+    }
+    return catalog, nil
+}
+
+func (e *CatalogEntry) validate() error {
+    if e.Image == "" {
+        return fmt.Errorf("image is required")
+    }
+    names := make(map[string]bool, len(e.Ports))
+    exposed := false
+    for _, port := range e.Ports {
+        exposed = exposed || !port.Internal
+        if port.Name == "" || names[port.Name] {
+            return fmt.Errorf("ports need distinct names")
+        }
+        names[port.Name] = true
+        switch port.Protocol {
+        case "", corev1.ProtocolTCP, corev1.ProtocolUDP:
+        default:
+            return fmt.Errorf("port %s: unsupported protocol %s", port.Name, port.Protocol)
+        }
+    }
+    if !exposed {
+        return fmt.Errorf("at least one port must be exposed")
+    }
+    if e.Storage.Size == "" || e.Storage.MountPath == "" {
+        return fmt.Errorf("storage needs a size and a mountPath")
+    }
+    if query := e.PlayerQuery; query != nil {
+        if query.Protocol == "" {
+            return fmt.Errorf("playerQuery needs a protocol")
+        }
+        if !names[query.Port] {
+            return fmt.Errorf("playerQuery port %q is not one of the ports", query.Port)
+        }
+    }
+    return nil
+}
+
+// needsPassword tells whether the controller hands the server an RCON password
+func (e *CatalogEntry) needsPassword() bool {
+    return e.PlayerQuery != nil && (e.PlayerQuery.PasswordEnv != "" || e.PlayerQuery.PasswordFile != "")
+}
+
+// queryPort returns the port the Game's server answers player queries on
+func (e *CatalogEntry) queryPort(game *Game) int32 {
+    for _, port := range e.Ports {
+        if port.Name == e.PlayerQuery.Port {
+            return port.portNumber(game)
+        }
+    }
+    return 0
+}
+
+// Lookup returns the entry for a game
+func (c *Catalog) Lookup(gameName string) (*CatalogEntry, error) {
+    entry, ok := c.Games[gameName]
+    if !ok {
+        return nil, fmt.Errorf("game %s is not in the catalog", gameName)
+    }
+    return entry, nil
+}
+
+// image returns the image running the Game's gameVersion
+func (e *CatalogEntry) image(game *Game) string {
+    tag := e.DefaultTag
+    if tag == "" {
+        tag = "latest"
+    }
+    if game.Spec.GameVersion != "" && e.TagFormat != "" {
+        tag = strings.ReplaceAll(e.TagFormat, "{version}", strings.TrimPrefix(game.Spec.GameVersion, "v"))
+    }
+    return fmt.Sprintf("%s:%s", e.Image, tag)
+}
+
+// env passes the Game's settings to the server
+func (e *CatalogEntry) env(game *Game) []corev1.EnvVar {
+    var env []corev1.EnvVar
+    set := func(name, value string) {
+        if name != "" && value != "" {
+            env = append(env, corev1.EnvVar{Name: name, Value: value})
+        }
+    }
+    set(e.Env.Players, strconv.Itoa(int(game.Spec.Players)))
+    set(e.Env.ServerName, game.Spec.ServerName)
+    set(e.Env.Mode, game.Spec.Mode)
+    set(e.Env.Difficulty, game.Spec.Difficulty)
+    set(e.Env.Version, strings.TrimPrefix(game.Spec.GameVersion, "v"))
+    set(e.Env.Port, strconv.Itoa(int(game.Spec.Port)))
+    for _, name := range sortedKeys(e.Env.Static) {
+        set(name, e.Env.Static[name])
+    }
+    return env
+}
+
+// portNumber returns where a catalog port listens for the Game
+func (p CatalogPort) portNumber(game *Game) int32 {
+    if p.Port != 0 {
+        return p.Port
+    }
+    return game.Spec.Port + p.Offset
+}
+
+func (p CatalogPort) protocol() corev1.Protocol {
+    if p.Protocol == "" {
+        return corev1.ProtocolTCP
+    }
+    return p.Protocol
+}
+
+func (e *CatalogEntry) containerPorts(game *Game) []corev1.ContainerPort {
+    ports := make([]corev1.ContainerPort, 0, len(e.Ports))
+    for _, port := range e.Ports {
+        ports = append(ports, corev1.ContainerPort{
+            Name:          port.Name,
+            ContainerPort: port.portNumber(game),
+            Protocol:      port.protocol(),
+        })
+    }
+    return ports
+}
+
+func (e *CatalogEntry) servicePorts(game *Game) []corev1.ServicePort {
+    var ports []corev1.ServicePort
+    for _, port := range e.Ports {
+        if port.Internal {
+            continue
+        }
+        ports = append(ports, corev1.ServicePort{
+            Name:       port.Name,
+            Port:       port.portNumber(game),
+            Protocol:   port.protocol(),
+            TargetPort: intstr.FromString(port.Name),
+        })
+    }
+    return ports
+}
+
+func sortedKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for key := range m {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "time"
+
+    appsv1 "k8s.io/api/apps/v1"
+    batchv1 "k8s.io/api/batch/v1"
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/errors"
+    apimeta "k8s.io/apimachinery/pkg/api/meta"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/fields"
+    "k8s.io/apimachinery/pkg/labels"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/types"
+    "k8s.io/apimachinery/pkg/util/wait"
+    "k8s.io/client-go/dynamic"
+    "k8s.io/client-go/dynamic/dynamicinformer"
+    "k8s.io/client-go/informers"
+    "k8s.io/client-go/kubernetes"
+    appslisters "k8s.io/client-go/listers/apps/v1"
+    batchlisters "k8s.io/client-go/listers/batch/v1"
+    corelisters "k8s.io/client-go/listers/core/v1"
+    "k8s.io/client-go/tools/cache"
+    "k8s.io/client-go/util/workqueue"
+)
+
+// Labels on every object the controller generates. The child informers
+// only watch objects carrying managedByLabel; gameLabel names the Game a
+// child belongs to.
+const (
+    managedByLabel = "app.kubernetes.io/managed-by"
+    managedBy      = "game-controller"
+    gameLabel      = "gaming.example.com/game"
+)
+
+// fieldManager owns the fields the controller sets through server-side apply
+const fieldManager = "game-controller"
+
+// Controller reconciles each Game into a StatefulSet running the server, a
+// NodePort Service exposing it and, with backups set up, a CronJob
+// archiving its world. Restarts for a changed spec wait for the server's
+// players to leave; see drain.go.
+type Controller struct {
+    kubeClient         kubernetes.Interface
+    gameClient         dynamic.NamespaceableResourceInterface
+    gameLister         cache.GenericLister
+    gamesSynced        cache.InformerSynced
+    statefulSetLister  appslisters.StatefulSetLister
+    statefulSetsSynced cache.InformerSynced
+    serviceLister      corelisters.ServiceLister
+    servicesSynced     cache.InformerSynced
+    cronJobLister      batchlisters.CronJobLister
+    cronJobsSynced     cache.InformerSynced
+    secretLister       corelisters.SecretLister
+    secretsSynced      cache.InformerSynced
+    catalogLister      corelisters.ConfigMapLister
+    catalogSynced      cache.InformerSynced
+    catalogNamespace   string
+    catalogName        string
+    probers            *ProberRegistry
+    workqueue          workqueue.RateLimitingInterface
+}
+
+// NewKubeInformerFactory returns an informer factory restricted to the
+// objects the controller generated
+func NewKubeInformerFactory(kubeClient kubernetes.Interface) informers.SharedInformerFactory {
+    return informers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30,
+        informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+            options.LabelSelector = managedByLabel + "=" + managedBy
+        }))
+}
+
+// NewCatalogInformerFactory returns an informer factory watching only the
+// game catalog ConfigMap
+func NewCatalogInformerFactory(kubeClient kubernetes.Interface, namespace, name string) informers.SharedInformerFactory {
+    return informers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30,
+        informers.WithNamespace(namespace),
+        informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+            options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+        }))
+}
+
+func NewController(kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, informerFactory dynamicinformer.DynamicSharedInformerFactory, kubeInformerFactory, catalogInformerFactory informers.SharedInformerFactory, catalogNamespace, catalogName string) *Controller {
+    gameInformer := informerFactory.ForResource(gameGVR)
+    statefulSetInformer := kubeInformerFactory.Apps().V1().StatefulSets()
+    serviceInformer := kubeInformerFactory.Core().V1().Services()
+    cronJobInformer := kubeInformerFactory.Batch().V1().CronJobs()
+    secretInformer := kubeInformerFactory.Core().V1().Secrets()
+    catalogInformer := catalogInformerFactory.Core().V1().ConfigMaps()
+
+    controller := &Controller{
+        kubeClient:         kubeClient,
+        gameClient:         dynamicClient.Resource(gameGVR),
+        gameLister:         gameInformer.Lister(),
+        gamesSynced:        gameInformer.Informer().HasSynced,
+        statefulSetLister:  statefulSetInformer.Lister(),
+        statefulSetsSynced: statefulSetInformer.Informer().HasSynced,
+        serviceLister:      serviceInformer.Lister(),
+        servicesSynced:     serviceInformer.Informer().HasSynced,
+        cronJobLister:      cronJobInformer.Lister(),
+        cronJobsSynced:     cronJobInformer.Informer().HasSynced,
+        secretLister:       secretInformer.Lister(),
+        secretsSynced:      secretInformer.Informer().HasSynced,
+        catalogLister:      catalogInformer.Lister(),
+        catalogSynced:      catalogInformer.Informer().HasSynced,
+        catalogNamespace:   catalogNamespace,
+        catalogName:        catalogName,
+        probers:            NewProberRegistry(),
+        workqueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Games"),
+    }
+
+    gameInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.enqueueGame,
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            // Skip the controller's own status writes. Resyncs repeat the
+            // same version and keep the player count fresh; labels carry a
+            // Game's allocation.
+            oldGame, newGame := oldObj.(metav1.Object), newObj.(metav1.Object)
+            if oldGame.GetGeneration() == newGame.GetGeneration() && oldGame.GetResourceVersion() != newGame.GetResourceVersion() &&
+                labels.Equals(oldGame.GetLabels(), newGame.GetLabels()) {
+                return
+            }
+            controller.enqueueGame(newObj)
+        },
+        DeleteFunc: controller.enqueueGame,
+    })
+
+    // Changes to a child reconcile its Game, which puts the child back the
+    // way it should be
+    childHandler := cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.enqueueParent,
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            controller.enqueueParent(newObj)
+        },
+        DeleteFunc: controller.enqueueParent,
+    }
+    statefulSetInformer.Informer().AddEventHandler(childHandler)
+    serviceInformer.Informer().AddEventHandler(childHandler)
+    cronJobInformer.Informer().AddEventHandler(childHandler)
+    secretInformer.Informer().AddEventHandler(childHandler)
+
+    // A catalog change may change how any Game is run
+    catalogInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.enqueueAllGames,
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            controller.enqueueAllGames(newObj)
+        },
+        DeleteFunc: controller.enqueueAllGames,
+    })
+
+    return controller
+}
+
+func (c *Controller) enqueueGame(obj interface{}) {
+    key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+    if err != nil {
+        log.Printf("Error computing key for game: %v", err)
+        return
+    }
+    c.workqueue.Add(key)
+}
+
+// enqueueParent enqueues the Game controlling a generated object
+func (c *Controller) enqueueParent(obj interface{}) {
+    if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+        obj = tombstone.Obj
+    }
+    child, ok := obj.(metav1.Object)
+    if !ok {
+        return
+    }
+    owner := metav1.GetControllerOf(child)
+    if owner == nil || owner.Kind != "Game" {
+        return
+    }
+    c.workqueue.Add(child.GetNamespace() + "/" + owner.Name)
+}
+
+func (c *Controller) enqueueAllGames(interface{}) {
+    objs, err := c.gameLister.List(labels.Everything())
+    if err != nil {
+        log.Printf("Error listing games: %v", err)
+        return
+    }
+    for _, obj := range objs {
+        c.enqueueGame(obj)
+    }
+}
+
+// loadCatalog parses the catalog ConfigMap as it is now
+func (c *Controller) loadCatalog() (*Catalog, error) {
+    configMap, err := c.catalogLister.ConfigMaps(c.catalogNamespace).Get(c.catalogName)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get game catalog %s/%s: %v", c.catalogNamespace, c.catalogName, err)
+    }
+    return ParseCatalog(configMap.Data[catalogKey])
+}
+
+func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
+    defer c.workqueue.ShutDown()
+
+    log.Print("Starting Game controller")
+
+    log.Print("Waiting for informer caches to sync")
+    if ok := cache.WaitForCacheSync(stopCh, c.gamesSynced, c.statefulSetsSynced, c.servicesSynced, c.cronJobsSynced, c.secretsSynced, c.catalogSynced); !ok {
+        return fmt.Errorf("failed to wait for caches to sync")
+    }
+
+    for i := 0; i < threadiness; i++ {
+        go wait.Until(c.runWorker, time.Second, stopCh)
+    }
+
+    <-stopCh
+    return nil
+}
+
+func (c *Controller) runWorker() {
+    for c.processNextWorkItem() {
+    }
+}
+
+func (c *Controller) processNextWorkItem() bool {
+    obj, shutdown := c.workqueue.Get()
+    if shutdown {
+        return false
+    }
+
+    defer c.workqueue.Done(obj)
+
+    key, ok := obj.(string)
+    if !ok {
+        c.workqueue.Forget(obj)
+        return true
+    }
+
+    if err := c.syncGame(key); err != nil {
+        log.Printf("Error syncing game %s: %v", key, err)
+        c.workqueue.AddRateLimited(key)
+        return true
+    }
+
+    c.workqueue.Forget(obj)
+    return true
+}
+
+func (c *Controller) syncGame(key string) error {
+    namespace, name, err := cache.SplitMetaNamespaceKey(key)
+    if err != nil {
+        log.Printf("Invalid game key %s: %v", key, err)
+        return nil
+    }
+
+    obj, err := c.gameLister.ByNamespace(namespace).Get(name)
+    if errors.IsNotFound(err) {
+        log.Printf("Game %s no longer exists", key)
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to get game %s: %v", key, err)
+    }
+
+    game, err := gameFromObject(obj)
+    if err != nil {
+        // A malformed object will not parse any better on retry
+        log.Printf("Error decoding game %s: %v", key, err)
+        return nil
+    }
+
+    // Games the catalog can't run wait for it to change, which enqueues
+    // every Game again
+    catalog, err := c.loadCatalog()
+    if err != nil {
+        log.Printf("Game %s is waiting for the catalog: %v", key, err)
+        return nil
+    }
+    entry, err := catalog.Lookup(game.Spec.GameName)
+    if err != nil {
+        log.Printf("Game %s cannot be run: %v", key, err)
+        return nil
+    }
+
+    statefulSet, err := createGameStatefulSet(game, entry)
+    if err != nil {
+        log.Printf("Game %s cannot be run: %v", key, err)
+        return nil
+    }
+
+    ctx := context.TODO()
+    password := ""
+    if entry.needsPassword() {
+        if password, err = c.rconPassword(ctx, game); err != nil {
+            return err
+        }
+    }
+
+    existing, err := c.statefulSetLister.StatefulSets(namespace).Get(name)
+    switch {
+    case err == nil:
+        // Volume claim templates can't change once the StatefulSet exists;
+        // the world volume keeps the size it was created with
+        statefulSet.Spec.VolumeClaimTemplates = existing.DeepCopy().Spec.VolumeClaimTemplates
+        for i := range statefulSet.Spec.VolumeClaimTemplates {
+            statefulSet.Spec.VolumeClaimTemplates[i].TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"}
+        }
+    case errors.IsNotFound(err):
+        existing = nil
+        if err := c.deleteLegacyDeployment(game); err != nil {
+            return err
+        }
+    default:
+        return err
+    }
+
+    pod := c.serverPod(ctx, game)
+    observation := c.observePlayers(ctx, game, entry, pod, password)
+    partition, status := drain(ctx, game, existing, observation)
+    c.serverStatus(ctx, game, pod, &status)
+    // A StatefulSet whose status lags behind is left alone until it catches up
+    if existing == nil || observedLatest(existing) {
+        statefulSet.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition}
+        if err := c.apply(ctx, statefulSet); err != nil {
+            return err
+        }
+    }
+    if err := c.apply(ctx, createGameService(game, entry)); err != nil {
+        return err
+    }
+
+    if game.Spec.Backup != nil {
+        err = c.apply(ctx, createBackupCronJob(game))
+    } else {
+        err = c.deleteBackupCronJob(game)
+    }
+    if err != nil {
+        return err
+    }
+
+    if err := c.updateStatus(ctx, game, status); err != nil {
+        return err
+    }
+    if status.RestartPendingSince != nil && partition == partitionHold {
+        c.workqueue.AddAfter(key, drainPollInterval)
+    }
+    return nil
+}
+
+// serverPod returns the pod running the Game's server, or nil if there is none
+func (c *Controller) serverPod(ctx context.Context, game *Game) *corev1.Pod {
+    pod, err := c.kubeClient.CoreV1().Pods(game.Namespace).Get(ctx, game.Name+"-0", metav1.GetOptions{})
+    if err != nil {
+        if !errors.IsNotFound(err) {
+            log.Printf("Error getting server pod of game %s/%s: %v", game.Namespace, game.Name, err)
+        }
+        return nil
+    }
+    return pod
+}
+
+// serverStatus records the Game's state and where players connect to it
+func (c *Controller) serverStatus(ctx context.Context, game *Game, pod *corev1.Pod, status *GameStatus) {
+    status.State = GameStateStarting
+    if pod != nil && podReady(pod) {
+        status.State = GameStateReady
+    }
+    if game.Labels[allocationLabel] != "" {
+        status.State = GameStateAllocated
+    }
+
+    status.Address = ""
+    status.Ports = nil
+    if pod == nil || pod.Spec.NodeName == "" {
+        return
+    }
+    status.Address = c.nodeAddress(ctx, pod)
+    service, err := c.serviceLister.Services(game.Namespace).Get(game.Name)
+    if err != nil {
+        return
+    }
+    for _, port := range service.Spec.Ports {
+        if port.NodePort != 0 {
+            status.Ports = append(status.Ports, GamePort{Name: port.Name, Port: port.NodePort, Protocol: port.Protocol})
+        }
+    }
+}
+
+// nodeAddress returns the address players reach the pod's node at,
+// preferring its external IP
+func (c *Controller) nodeAddress(ctx context.Context, pod *corev1.Pod) string {
+    node, err := c.kubeClient.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+    if err != nil {
+        log.Printf("Error getting node %s: %v", pod.Spec.NodeName, err)
+        return pod.Status.HostIP
+    }
+    for _, addressType := range []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP} {
+        for _, address := range node.Status.Addresses {
+            if address.Type == addressType {
+                return address.Address
+            }
+        }
+    }
+    return pod.Status.HostIP
+}
+
+// deleteBackupCronJob stops the backups of a Game that no longer asks for
+// them. The archives already taken are kept.
+func (c *Controller) deleteBackupCronJob(game *Game) error {
+    name := backupCronJobName(game)
+    cronJob, err := c.cronJobLister.CronJobs(game.Namespace).Get(name)
+    if errors.IsNotFound(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if !metav1.IsControlledBy(cronJob, game) {
+        return nil
+    }
+
+    err = c.kubeClient.BatchV1().CronJobs(game.Namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+    if err != nil && !errors.IsNotFound(err) {
+        return fmt.Errorf("failed to delete cronjob %s/%s: %v", game.Namespace, name, err)
+    }
+    return nil
+}
+
+// deleteLegacyDeployment removes the Deployment game servers ran as before
+// they moved to a StatefulSet. That server kept no world, so none is lost.
+func (c *Controller) deleteLegacyDeployment(game *Game) error {
+    deployment, err := c.kubeClient.AppsV1().Deployments(game.Namespace).Get(context.TODO(), game.Name, metav1.GetOptions{})
+    if errors.IsNotFound(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if !metav1.IsControlledBy(deployment, game) {
+        return nil
+    }
+
+    log.Printf("Replacing deployment %s/%s with a StatefulSet", game.Namespace, game.Name)
+    err = c.kubeClient.AppsV1().Deployments(game.Namespace).Delete(context.TODO(), game.Name, metav1.DeleteOptions{})
+    if err != nil && !errors.IsNotFound(err) {
+        return fmt.Errorf("failed to delete deployment %s/%s: %v", game.Namespace, game.Name, err)
+    }
+    return nil
+}
+
+// apply server-side applies a generated object
+func (c *Controller) apply(ctx context.Context, obj runtime.Object) error {
+    accessor, err := apimeta.Accessor(obj)
+    if err != nil {
+        return err
+    }
+    data, err := json.Marshal(obj)
+    if err != nil {
+        return err
+    }
+
+    force := true
+    options := metav1.PatchOptions{FieldManager: fieldManager, Force: &force}
+    namespace, name := accessor.GetNamespace(), accessor.GetName()
+    switch obj.(type) {
+    case *appsv1.StatefulSet:
+        _, err = c.kubeClient.AppsV1().StatefulSets(namespace).Patch(ctx, name, types.ApplyPatchType, data, options)
+    case *corev1.Service:
+        _, err = c.kubeClient.CoreV1().Services(namespace).Patch(ctx, name, types.ApplyPatchType, data, options)
+    case *batchv1.CronJob:
+        _, err = c.kubeClient.BatchV1().CronJobs(namespace).Patch(ctx, name, types.ApplyPatchType, data, options)
+    default:
+        return fmt.Errorf("cannot apply %T", obj)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to apply %s %s/%s: %v", obj.GetObjectKind().GroupVersionKind().Kind, namespace, name, err)
+    }
+    return nil
+}
+
+func gameFromObject(obj runtime.Object) (*Game, error) {
+    game := &Game{}
+    if err := fromUnstructured(obj, game); err != nil {
+        return nil, err
+    }
+    return game, nil
+}
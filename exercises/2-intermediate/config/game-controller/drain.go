@@ -0,0 +1,237 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "strconv"
+    "time"
+
+    appsv1 "k8s.io/api/apps/v1"
+    corev1 "k8s.io/api/core/v1"
+    apiequality "k8s.io/apimachinery/pkg/api/equality"
+    "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/types"
+)
+
+// A changed Game doesn't restart its server straight away. The StatefulSet's
+// rolling update partition holds the pod on the revision it runs while
+// players are on it; the restart goes ahead once the server is empty, can't
+// be asked, or the Game's drainTimeout has elapsed.
+const (
+    defaultDrainTimeout = 30 * time.Minute
+    // drainPollInterval is how often a held restart counts players again
+    drainPollInterval = 15 * time.Second
+    // probeTimeout bounds each conversation with a server
+    probeTimeout = 5 * time.Second
+)
+
+// Rolling update partitions: the single pod has ordinal 0, so a partition
+// of 1 keeps it on its revision
+const (
+    partitionRelease = int32(0)
+    partitionHold    = int32(1)
+)
+
+// Probers exposes the player prober registry so probers for more protocols
+// can be registered before the controller starts
+func (c *Controller) Probers() *ProberRegistry {
+    return c.probers
+}
+
+// playerObservation is what a sync learned about the players on a server
+type playerObservation struct {
+    // serving is false while no server is ready to take players
+    serving bool
+    // known is false when the players couldn't be counted
+    known   bool
+    players int
+    prober  PlayerProber
+    target  ProbeTarget
+}
+
+// rconPassword returns the Game's RCON password, creating it the first time
+func (c *Controller) rconPassword(ctx context.Context, game *Game) (string, error) {
+    name := rconSecretName(game)
+    secret, err := c.secretLister.Secrets(game.Namespace).Get(name)
+    if errors.IsNotFound(err) {
+        secret, err = createRCONSecret(game)
+        if err != nil {
+            return "", err
+        }
+        secret, err = c.kubeClient.CoreV1().Secrets(game.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+        if errors.IsAlreadyExists(err) {
+            // Created by an earlier sync the cache hasn't caught up with
+            secret, err = c.kubeClient.CoreV1().Secrets(game.Namespace).Get(ctx, name, metav1.GetOptions{})
+        }
+    }
+    if err != nil {
+        return "", fmt.Errorf("failed to get rcon password %s/%s: %v", game.Namespace, name, err)
+    }
+    return string(secret.Data[rconPasswordKey]), nil
+}
+
+// observePlayers counts the players on the Game's server, which runs in pod
+func (c *Controller) observePlayers(ctx context.Context, game *Game, entry *CatalogEntry, pod *corev1.Pod, password string) playerObservation {
+    if pod == nil || !podReady(pod) {
+        return playerObservation{}
+    }
+
+    observation := playerObservation{serving: true}
+    if entry.PlayerQuery == nil {
+        return observation
+    }
+    prober, err := c.probers.Prober(entry.PlayerQuery.Protocol)
+    if err != nil {
+        log.Printf("Cannot count players of game %s/%s: %v", game.Namespace, game.Name, err)
+        return observation
+    }
+    observation.prober = prober
+    observation.target = ProbeTarget{
+        Address: net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(entry.queryPort(game)))),
+        Password: password,
+    }
+
+    probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+    defer cancel()
+    players, err := prober.Players(probeCtx, observation.target)
+    if err != nil {
+        log.Printf("Error counting players of game %s/%s: %v", game.Namespace, game.Name, err)
+        return observation
+    }
+    observation.known = true
+    observation.players = players
+    return observation
+}
+
+// broadcast tells the players on the server, if there are any to tell
+func (o playerObservation) broadcast(ctx context.Context, game *Game, message string) {
+    if !o.known || o.players == 0 {
+        return
+    }
+    ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+    defer cancel()
+    if err := o.prober.Broadcast(ctx, o.target, message); err != nil {
+        log.Printf("Error warning players of game %s/%s: %v", game.Namespace, game.Name, err)
+    }
+}
+
+// drain picks the partition the StatefulSet is applied with and the status
+// recording it. A restart that has been released stays released until the
+// pod runs the new revision.
+func drain(ctx context.Context, game *Game, existing *appsv1.StatefulSet, observation playerObservation) (int32, GameStatus) {
+    status := game.Status
+    status.CurrentPlayers = nil
+    if observation.known {
+        players := int32(observation.players)
+        status.CurrentPlayers = &players
+        if players > 0 {
+            now := metav1.Now().Rfc3339Copy()
+            status.LastSeenActive = &now
+        }
+    }
+
+    if existing == nil {
+        return partitionRelease, status
+    }
+    // Until the StatefulSet's status catches up with its spec, a pending
+    // restart can't be told from one that was just released
+    if !observedLatest(existing) {
+        return currentPartition(existing), status
+    }
+    if !restartPending(existing) {
+        status.RestartPendingSince = nil
+        return partitionHold, status
+    }
+    if currentPartition(existing) == partitionRelease {
+        return partitionRelease, status
+    }
+
+    timeout := drainTimeout(game)
+    if status.RestartPendingSince == nil {
+        now := metav1.Now().Rfc3339Copy()
+        status.RestartPendingSince = &now
+        observation.broadcast(ctx, game, fmt.Sprintf("This server will restart for an update once everyone has left, in %s at the latest", timeout))
+    }
+
+    var reason string
+    switch {
+    case !observation.serving:
+        reason = "the server is not ready"
+    case observation.prober == nil:
+        reason = "its players can't be counted"
+    case observation.known && observation.players == 0:
+        reason = "the server is empty"
+    case time.Since(status.RestartPendingSince.Time) >= timeout:
+        reason = "the drain timeout elapsed"
+        observation.broadcast(ctx, game, "This server is restarting for an update now")
+    default:
+        return partitionHold, status
+    }
+    log.Printf("Restarting game %s/%s: %s", game.Namespace, game.Name, reason)
+    return partitionRelease, status
+}
+
+// restartPending tells whether the StatefulSet has a revision its pod
+// doesn't run yet
+func restartPending(statefulSet *appsv1.StatefulSet) bool {
+    status := statefulSet.Status
+    return status.UpdateRevision != "" && status.CurrentRevision != status.UpdateRevision
+}
+
+// observedLatest tells whether the StatefulSet's status describes its
+// current spec
+func observedLatest(statefulSet *appsv1.StatefulSet) bool {
+    return statefulSet.Status.ObservedGeneration >= statefulSet.Generation
+}
+
+func currentPartition(statefulSet *appsv1.StatefulSet) int32 {
+    update := statefulSet.Spec.UpdateStrategy.RollingUpdate
+    if update == nil || update.Partition == nil {
+        return partitionRelease
+    }
+    return *update.Partition
+}
+
+func drainTimeout(game *Game) time.Duration {
+    if game.Spec.DrainTimeout == "" {
+        return defaultDrainTimeout
+    }
+    timeout, err := time.ParseDuration(game.Spec.DrainTimeout)
+    if err != nil {
+        log.Printf("Invalid drainTimeout %q of game %s/%s, using %s", game.Spec.DrainTimeout, game.Namespace, game.Name, defaultDrainTimeout)
+        return defaultDrainTimeout
+    }
+    return timeout
+}
+
+func podReady(pod *corev1.Pod) bool {
+    if pod.DeletionTimestamp != nil {
+        return false
+    }
+    for _, condition := range pod.Status.Conditions {
+        if condition.Type == corev1.PodReady {
+            return condition.Status == corev1.ConditionTrue
+        }
+    }
+    return false
+}
+
+// updateStatus writes status to the Game's status subresource if it changed
+func (c *Controller) updateStatus(ctx context.Context, game *Game, status GameStatus) error {
+    if apiequality.Semantic.DeepEqual(game.Status, status) {
+        return nil
+    }
+    data, err := json.Marshal(map[string]interface{}{"status": status})
+    if err != nil {
+        return err
+    }
+    _, err = c.gameClient.Namespace(game.Namespace).Patch(ctx, game.Name, types.MergePatchType, data, metav1.PatchOptions{}, "status")
+    if err != nil {
+        return fmt.Errorf("failed to update status of game %s/%s: %v", game.Namespace, game.Name, err)
+    }
+    return nil
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    apiequality "k8s.io/apimachinery/pkg/api/equality"
+    "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/labels"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/apimachinery/pkg/types"
+    utilrand "k8s.io/apimachinery/pkg/util/rand"
+    "k8s.io/apimachinery/pkg/util/wait"
+    "k8s.io/client-go/dynamic"
+    "k8s.io/client-go/dynamic/dynamicinformer"
+    "k8s.io/client-go/tools/cache"
+    "k8s.io/client-go/util/workqueue"
+)
+
+// gameFleetGVR and gameAllocationGVR identify the CRDs served by
+// 05-2-gamefleet-crd.yaml and 05-2-gameallocation-crd.yaml
+var (
+    gameFleetGVR = schema.GroupVersionResource{
+        Group:    "gaming.example.com",
+        Version:  "v1",
+        Resource: "gamefleets",
+    }
+    gameAllocationGVR = schema.GroupVersionResource{
+        Group:    "gaming.example.com",
+        Version:  "v1",
+        Resource: "gameallocations",
+    }
+)
+
+// States of a Game, in status.state
+const (
+    GameStateStarting  = "Starting"
+    GameStateReady     = "Ready"
+    GameStateAllocated = "Allocated"
+)
+
+// States of a GameAllocation, in status.state. Both are final: an
+// allocation that found no Ready server is retried by creating another.
+const (
+    AllocationStateAllocated   = "Allocated"
+    AllocationStateUnAllocated = "UnAllocated"
+)
+
+// fleetLabel names the GameFleet a Game belongs to; allocationLabel names
+// the GameAllocation that claimed it
+const (
+    fleetLabel      = "gaming.example.com/fleet"
+    allocationLabel = "gaming.example.com/allocation"
+)
+
+// fleetGenerationAnnotation records the fleet generation a Game's spec was
+// last applied from
+const fleetGenerationAnnotation = "gaming.example.com/fleet-generation"
+
+// fleetFieldManager owns the Game fields a fleet sets through server-side apply
+const fleetFieldManager = "game-fleet-controller"
+
+// createTimeout is how long a Game a fleet created is counted before the
+// informer has seen it
+const createTimeout = time.Minute
+
+// GameFleet keeps a buffer of Ready Games from one template for
+// GameAllocations to claim
+type GameFleet struct {
+    metav1.TypeMeta   `json:",inline"`
+    metav1.ObjectMeta `json:"metadata,omitempty"`
+    Spec             GameFleetSpec   `json:"spec"`
+    Status           GameFleetStatus `json:"status,omitempty"`
+}
+
+// GameFleetSpec sizes the fleet as its allocated Games plus BufferSize,
+// kept between MinReplicas and MaxReplicas
+type GameFleetSpec struct {
+    BufferSize  int32        `json:"bufferSize"`
+    MinReplicas int32        `json:"minReplicas,omitempty"`
+    MaxReplicas int32        `json:"maxReplicas"`
+    Template    GameTemplate `json:"template"`
+}
+
+type GameTemplate struct {
+    Spec GameSpec `json:"spec"`
+}
+
+type GameFleetStatus struct {
+    Replicas          int32 `json:"replicas"`
+    ReadyReplicas     int32 `json:"readyReplicas"`
+    AllocatedReplicas int32 `json:"allocatedReplicas"`
+}
+
+// GameAllocation claims a Ready Game of a fleet for one match. Deleting
+// the allocation ends the match: its Game is deleted and the fleet replaces
+// it.
+type GameAllocation struct {
+    metav1.TypeMeta   `json:",inline"`
+    metav1.ObjectMeta `json:"metadata,omitempty"`
+    Spec             GameAllocationSpec   `json:"spec"`
+    Status           GameAllocationStatus `json:"status,omitempty"`
+}
+
+type GameAllocationSpec struct {
+    FleetName string `json:"fleetName"`
+}
+
+type GameAllocationStatus struct {
+    State    string     `json:"state,omitempty"`
+    GameName string     `json:"gameName,omitempty"`
+    Address  string     `json:"address,omitempty"`
+    Ports    []GamePort `json:"ports,omitempty"`
+    Message  string     `json:"message,omitempty"`
+}
+
+// FleetController scales GameFleets and serves their GameAllocations. Each
+// fleet is synced by one worker at a time, which serves its allocations in
+// order; claiming a Game is a write conditional on its resourceVersion, so
+// a stale cache can't hand one server out twice.
+type FleetController struct {
+    gameClient        dynamic.NamespaceableResourceInterface
+    fleetClient       dynamic.NamespaceableResourceInterface
+    allocationClient  dynamic.NamespaceableResourceInterface
+    gameLister        cache.GenericLister
+    gamesSynced       cache.InformerSynced
+    fleetLister       cache.GenericLister
+    fleetsSynced      cache.InformerSynced
+    allocationLister  cache.GenericLister
+    allocationsSynced cache.InformerSynced
+    // creating holds, per fleet, the Games created but not yet seen by the
+    // informer, so a sync doesn't create them again
+    creating          map[string]map[string]time.Time
+    creatingMutex     sync.Mutex
+    workqueue         workqueue.RateLimitingInterface
+}
+
+func NewFleetController(dynamicClient dynamic.Interface, informerFactory dynamicinformer.DynamicSharedInformerFactory) *FleetController {
+    gameInformer := informerFactory.ForResource(gameGVR)
+    fleetInformer := informerFactory.ForResource(gameFleetGVR)
+    allocationInformer := informerFactory.ForResource(gameAllocationGVR)
+
+    controller := &FleetController{
+        gameClient:        dynamicClient.Resource(gameGVR),
+        fleetClient:       dynamicClient.Resource(gameFleetGVR),
+        allocationClient:  dynamicClient.Resource(gameAllocationGVR),
+        gameLister:        gameInformer.Lister(),
+        gamesSynced:       gameInformer.Informer().HasSynced,
+        fleetLister:       fleetInformer.Lister(),
+        fleetsSynced:      fleetInformer.Informer().HasSynced,
+        allocationLister:  allocationInformer.Lister(),
+        allocationsSynced: allocationInformer.Informer().HasSynced,
+        creating:          make(map[string]map[string]time.Time),
+        workqueue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "GameFleets"),
+    }
+
+    fleetInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.enqueueFleet,
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            controller.enqueueFleet(newObj)
+        },
+        DeleteFunc: controller.enqueueFleet,
+    })
+
+    // A fleet's Games changing state, and allocations coming and going,
+    // change what the fleet needs
+    gameInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.enqueueGameFleet,
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            controller.enqueueGameFleet(newObj)
+        },
+        DeleteFunc: controller.enqueueGameFleet,
+    })
+    allocationInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.enqueueAllocationFleet,
+        DeleteFunc: controller.enqueueAllocationFleet,
+    })
+
+    return controller
+}
+
+func (c *FleetController) enqueueFleet(obj interface{}) {
+    key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+    if err != nil {
+        log.Printf("Error computing key for game fleet: %v", err)
+        return
+    }
+    c.workqueue.Add(key)
+}
+
+// enqueueGameFleet enqueues the GameFleet controlling a Game
+func (c *FleetController) enqueueGameFleet(obj interface{}) {
+    if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+        obj = tombstone.Obj
+    }
+    game, ok := obj.(metav1.Object)
+    if !ok {
+        return
+    }
+    owner := metav1.GetControllerOf(game)
+    if owner == nil || owner.Kind != "GameFleet" {
+        return
+    }
+    c.workqueue.Add(game.GetNamespace() + "/" + owner.Name)
+}
+
+func (c *FleetController) enqueueAllocationFleet(obj interface{}) {
+    if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+        obj = tombstone.Obj
+    }
+    u, ok := obj.(*unstructured.Unstructured)
+    if !ok {
+        return
+    }
+    fleetName, _, _ := unstructured.NestedString(u.Object, "spec", "fleetName")
+    if fleetName != "" {
+        c.workqueue.Add(u.GetNamespace() + "/" + fleetName)
+    }
+}
+
+func (c *FleetController) Run(threadiness int, stopCh <-chan struct{}) error {
+    defer c.workqueue.ShutDown()
+
+    log.Print("Starting GameFleet controller")
+
+    log.Print("Waiting for informer caches to sync")
+    if ok := cache.WaitForCacheSync(stopCh, c.gamesSynced, c.fleetsSynced, c.allocationsSynced); !ok {
+        return fmt.Errorf("failed to wait for caches to sync")
+    }
+
+    for i := 0; i < threadiness; i++ {
+        go wait.Until(c.runWorker, time.Second, stopCh)
+    }
+
+    <-stopCh
+    return nil
+}
+
+func (c *FleetController) runWorker() {
+    for c.processNextWorkItem() {
+    }
+}
+
+func (c *FleetController) processNextWorkItem() bool {
+    obj, shutdown := c.workqueue.Get()
+    if shutdown {
+        return false
+    }
+
+    defer c.workqueue.Done(obj)
+
+    key, ok := obj.(string)
+    if !ok {
+        c.workqueue.Forget(obj)
+        return true
+    }
+
+    if err := c.syncFleet(key); err != nil {
+        log.Printf("Error syncing game fleet %s: %v", key, err)
+        c.workqueue.AddRateLimited(key)
+        return true
+    }
+
+    c.workqueue.Forget(obj)
+    return true
+}
+
+func (c *FleetController) syncFleet(key string) error {
+    namespace, name, err := cache.SplitMetaNamespaceKey(key)
+    if err != nil {
+        log.Printf("Invalid game fleet key %s: %v", key, err)
+        return nil
+    }
+    ctx := context.TODO()
+
+    allocations, err := c.fleetAllocations(namespace, name)
+    if err != nil {
+        return err
+    }
+
+    obj, err := c.fleetLister.ByNamespace(namespace).Get(name)
+    if errors.IsNotFound(err) {
+        // The fleet's Games go with it; its allocations can't be served
+        c.forgetCreating(key)
+        for _, allocation := range allocations {
+            if allocation.Status.State == "" {
+                status := GameAllocationStatus{State: AllocationStateUnAllocated, Message: fmt.Sprintf("game fleet %s does not exist", name)}
+                if err := c.updateAllocationStatus(ctx, allocation, status); err != nil {
+                    return err
+                }
+            }
+        }
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to get game fleet %s: %v", key, err)
+    }
+
+    fleet := &GameFleet{}
+    if err := fromUnstructured(obj, fleet); err != nil {
+        // A malformed object will not parse any better on retry
+        log.Printf("Error decoding game fleet %s: %v", key, err)
+        return nil
+    }
+
+    games, err := c.fleetGames(fleet)
+    if err != nil {
+        return err
+    }
+
+    // A Game whose allocation is gone has finished its match
+    live := make(map[string]bool, len(allocations))
+    for _, allocation := range allocations {
+        live[allocation.Name] = true
+    }
+    var allocated, unallocated []*Game
+    for _, game := range games {
+        switch claim := game.Labels[allocationLabel]; {
+        case claim == "":
+            unallocated = append(unallocated, game)
+        case live[claim]:
+            allocated = append(allocated, game)
+        default:
+            log.Printf("Deleting game %s/%s: its allocation %s is gone", game.Namespace, game.Name, claim)
+            if err := c.deleteGame(ctx, game); err != nil {
+                return err
+            }
+        }
+    }
+
+    for _, allocation := range allocations {
+        if allocation.Status.State != "" {
+            continue
+        }
+        claimed, err := c.allocate(ctx, fleet, allocation, allocated, unallocated)
+        if err != nil {
+            return err
+        }
+        if claimed != nil {
+            allocated = append(allocated, claimed)
+            unallocated = without(unallocated, claimed)
+        }
+    }
+
+    if err := c.scale(ctx, fleet, allocated, unallocated); err != nil {
+        return err
+    }
+
+    // Allocated Games keep the template they were claimed with
+    for _, game := range unallocated {
+        if game.Annotations[fleetGenerationAnnotation] == strconv.FormatInt(fleet.Generation, 10) {
+            continue
+        }
+        if err := c.applyGame(ctx, fleet, game.Name, game.ResourceVersion); err != nil {
+            return err
+        }
+    }
+
+    status := GameFleetStatus{
+        Replicas: int32(len(allocated) + len(unallocated)),
+        AllocatedReplicas: int32(len(allocated)),
+    }
+    for _, game := range unallocated {
+        if game.Status.State == GameStateReady {
+            status.ReadyReplicas++
+        }
+    }
+    return c.updateFleetStatus(ctx, fleet, status)
+}
+
+// allocate claims a Ready Game for allocation and records it in the
+// allocation's status. A Game already labelled with the allocation was
+// claimed by an earlier sync whose status write failed.
+func (c *FleetController) allocate(ctx context.Context, fleet *GameFleet, allocation *GameAllocation, allocated, unallocated []*Game) (*Game, error) {
+    for _, game := range allocated {
+        if game.Labels[allocationLabel] == allocation.Name {
+            return nil, c.updateAllocationStatus(ctx, allocation, allocatedStatus(game))
+        }
+    }
+
+    for _, game := range unallocated {
+        if game.Status.State != GameStateReady || game.DeletionTimestamp != nil {
+            continue
+        }
+        // The resourceVersion makes the claim fail if the Game changed
+        // since the cache saw it, e.g. because it was claimed already
+        patch, err := json.Marshal(map[string]interface{}{
+            "metadata": map[string]interface{}{
+                "resourceVersion": game.ResourceVersion,
+                "labels": map[string]string{
+                    allocationLabel: allocation.Name,
+                },
+            },
+        })
+        if err != nil {
+            return nil, err
+        }
+        _, err = c.gameClient.Namespace(game.Namespace).Patch(ctx, game.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+        if errors.IsConflict(err) || errors.IsNotFound(err) {
+            // The sync is retried against a fresh cache
+            return nil, fmt.Errorf("game %s/%s changed while allocating it: %v", game.Namespace, game.Name, err)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to allocate game %s/%s: %v", game.Namespace, game.Name, err)
+        }
+
+        log.Printf("Allocated game %s/%s to %s", game.Namespace, game.Name, allocation.Name)
+        if err := c.updateAllocationStatus(ctx, allocation, allocatedStatus(game)); err != nil {
+            return nil, err
+        }
+        return game, nil
+    }
+
+    status := GameAllocationStatus{State: AllocationStateUnAllocated, Message: fmt.Sprintf("game fleet %s has no Ready server", fleet.Name)}
+    return nil, c.updateAllocationStatus(ctx, allocation, status)
+}
+
+func allocatedStatus(game *Game) GameAllocationStatus {
+    return GameAllocationStatus{
+        State: AllocationStateAllocated,
+        GameName: game.Name,
+        Address: game.Status.Address,
+        Ports: game.Status.Ports,
+    }
+}
+
+// scale creates or deletes unallocated Games until the fleet has its
+// allocated Games plus its buffer. Servers that aren't Ready yet are
+// deleted first. Games created but not yet in the cache count towards
+// creating no more, but not towards a surplus: they can't be deleted yet,
+// so counting them would delete Ready Games in their place. They are
+// weighed once they show up.
+func (c *FleetController) scale(ctx context.Context, fleet *GameFleet, allocated, unallocated []*Game) error {
+    desired := int32(len(allocated)) + fleet.Spec.BufferSize
+    if desired < fleet.Spec.MinReplicas {
+        desired = fleet.Spec.MinReplicas
+    }
+    if desired > fleet.Spec.MaxReplicas {
+        desired = fleet.Spec.MaxReplicas
+    }
+
+    observed := int32(len(allocated) + len(unallocated))
+    for current := observed + c.pendingCreates(fleet, unallocated); current < desired; current++ {
+        name := fmt.Sprintf("%s-%s", fleet.Name, utilrand.String(5))
+        if err := c.applyGame(ctx, fleet, name, ""); err != nil {
+            return err
+        }
+        c.recordCreate(fleet, name)
+    }
+
+    surplus := int(observed - desired)
+    if surplus <= 0 {
+        return nil
+    }
+    candidates := append([]*Game{}, unallocated...)
+    sort.SliceStable(candidates, func(i, j int) bool {
+        return candidates[i].Status.State != GameStateReady && candidates[j].Status.State == GameStateReady
+    })
+    for _, game := range candidates {
+        if surplus == 0 {
+            break
+        }
+        if err := c.deleteGame(ctx, game); err != nil {
+            return err
+        }
+        surplus--
+    }
+    return nil
+}
+
+// applyGame creates or updates a fleet Game from the fleet's template. An
+// update passes the resourceVersion the cache saw, so a Game claimed in the
+// meantime is not restarted under its players.
+func (c *FleetController) applyGame(ctx context.Context, fleet *GameFleet, name, resourceVersion string) error {
+    spec, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&fleet.Spec.Template.Spec)
+    if err != nil {
+        return err
+    }
+    game := &unstructured.Unstructured{Object: map[string]interface{}{
+        "spec": spec,
+    }}
+    game.SetAPIVersion(gameGVR.GroupVersion().String())
+    game.SetKind("Game")
+    game.SetName(name)
+    game.SetNamespace(fleet.Namespace)
+    game.SetResourceVersion(resourceVersion)
+    game.SetLabels(map[string]string{
+        fleetLabel: fleet.Name,
+    })
+    game.SetAnnotations(map[string]string{
+        fleetGenerationAnnotation: strconv.FormatInt(fleet.Generation, 10),
+    })
+    game.SetOwnerReferences([]metav1.OwnerReference{
+        *metav1.NewControllerRef(fleet, gameFleetGVR.GroupVersion().WithKind("GameFleet")),
+    })
+
+    data, err := json.Marshal(game)
+    if err != nil {
+        return err
+    }
+    force := true
+    _, err = c.gameClient.Namespace(fleet.Namespace).Patch(ctx, name, types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: fleetFieldManager, Force: &force})
+    if errors.IsConflict(err) {
+        // The sync is retried against a fresh cache
+        return fmt.Errorf("game %s/%s changed while updating it: %v", fleet.Namespace, name, err)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to apply game %s/%s: %v", fleet.Namespace, name, err)
+    }
+    return nil
+}
+
+// deleteGame deletes a fleet Game unless it changed since the cache saw it,
+// so a Game claimed in the meantime survives
+func (c *FleetController) deleteGame(ctx context.Context, game *Game) error {
+    resourceVersion := game.ResourceVersion
+    err := c.gameClient.Namespace(game.Namespace).Delete(ctx, game.Name, metav1.DeleteOptions{
+        Preconditions: &metav1.Preconditions{ResourceVersion: &resourceVersion},
+    })
+    if err != nil && !errors.IsNotFound(err) {
+        return fmt.Errorf("failed to delete game %s/%s: %v", game.Namespace, game.Name, err)
+    }
+    return nil
+}
+
+// fleetGames lists the Games the fleet controls, leaving out those being
+// deleted
+func (c *FleetController) fleetGames(fleet *GameFleet) ([]*Game, error) {
+    selector := labels.SelectorFromSet(labels.Set{fleetLabel: fleet.Name})
+    objs, err := c.gameLister.ByNamespace(fleet.Namespace).List(selector)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list games of fleet %s/%s: %v", fleet.Namespace, fleet.Name, err)
+    }
+
+    var games []*Game
+    for _, obj := range objs {
+        game := &Game{}
+        if err := fromUnstructured(obj, game); err != nil {
+            log.Printf("Error decoding game: %v", err)
+            continue
+        }
+        if !metav1.IsControlledBy(game, fleet) || game.DeletionTimestamp != nil {
+            continue
+        }
+        games = append(games, game)
+    }
+    sort.Slice(games, func(i, j int) bool {
+        return games[i].Name < games[j].Name
+    })
+    return games, nil
+}
+
+// fleetAllocations lists the fleet's allocations, oldest first
+func (c *FleetController) fleetAllocations(namespace, fleetName string) ([]*GameAllocation, error) {
+    objs, err := c.allocationLister.ByNamespace(namespace).List(labels.Everything())
+    if err != nil {
+        return nil, fmt.Errorf("failed to list game allocations in %s: %v", namespace, err)
+    }
+
+    var allocations []*GameAllocation
+    for _, obj := range objs {
+        allocation := &GameAllocation{}
+        if err := fromUnstructured(obj, allocation); err != nil {
+            log.Printf("Error decoding game allocation: %v", err)
+            continue
+        }
+        if allocation.Spec.FleetName == fleetName {
+            allocations = append(allocations, allocation)
+        }
+    }
+    sort.SliceStable(allocations, func(i, j int) bool {
+        return allocations[i].CreationTimestamp.Before(&allocations[j].CreationTimestamp)
+    })
+    return allocations, nil
+}
+
+// pendingCreates counts the Games created for the fleet that the cache
+// doesn't hold yet
+func (c *FleetController) pendingCreates(fleet *GameFleet, seen []*Game) int32 {
+    c.creatingMutex.Lock()
+    defer c.creatingMutex.Unlock()
+
+    created := c.creating[fleet.Namespace+"/"+fleet.Name]
+    for _, game := range seen {
+        delete(created, game.Name)
+    }
+    for name, at := range created {
+        if time.Since(at) > createTimeout {
+            delete(created, name)
+        }
+    }
+    return int32(len(created))
+}
+
+func (c *FleetController) recordCreate(fleet *GameFleet, name string) {
+    c.creatingMutex.Lock()
+    defer c.creatingMutex.Unlock()
+
+    key := fleet.Namespace + "/" + fleet.Name
+    if c.creating[key] == nil {
+        c.creating[key] = make(map[string]time.Time)
+    }
+    c.creating[key][name] = time.Now()
+}
+
+func (c *FleetController) forgetCreating(key string) {
+    c.creatingMutex.Lock()
+    defer c.creatingMutex.Unlock()
+
+    delete(c.creating, key)
+}
+
+func (c *FleetController) updateFleetStatus(ctx context.Context, fleet *GameFleet, status GameFleetStatus) error {
+    if apiequality.Semantic.DeepEqual(fleet.Status, status) {
+        return nil
+    }
+    data, err := json.Marshal(map[string]interface{}{"status": status})
+    if err != nil {
+        return err
+    }
+    _, err = c.fleetClient.Namespace(fleet.Namespace).Patch(ctx, fleet.Name, types.MergePatchType, data, metav1.PatchOptions{}, "status")
+    if err != nil {
+        return fmt.Errorf("failed to update status of game fleet %s/%s: %v", fleet.Namespace, fleet.Name, err)
+    }
+    return nil
+}
+
+func (c *FleetController) updateAllocationStatus(ctx context.Context, allocation *GameAllocation, status GameAllocationStatus) error {
+    data, err := json.Marshal(map[string]interface{}{"status": status})
+    if err != nil {
+        return err
+    }
+    _, err = c.allocationClient.Namespace(allocation.Namespace).Patch(ctx, allocation.Name, types.MergePatchType, data, metav1.PatchOptions{}, "status")
+    if err != nil && !errors.IsNotFound(err) {
+        return fmt.Errorf("failed to update status of game allocation %s/%s: %v", allocation.Namespace, allocation.Name, err)
+    }
+    return nil
+}
+
+func without(games []*Game, game *Game) []*Game {
+    var rest []*Game
+    for _, g := range games {
+        if g != game {
+            rest = append(rest, g)
+        }
+    }
+    return rest
+}
+
+func fromUnstructured(obj runtime.Object, into interface{}) error {
+    u, ok := obj.(*unstructured.Unstructured)
+    if !ok {
+        return fmt.Errorf("unexpected object type %T", obj)
+    }
+    return runtime.DefaultUnstructuredConverter.FromUnstructured(u.DeepCopy().UnstructuredContent(), into)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "reflect"
+    "sort"
+    "testing"
+    "time"
+
+    "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/runtime"
+    dynamicfake "k8s.io/client-go/dynamic/fake"
+    k8stesting "k8s.io/client-go/testing"
+)
+
+func fleetGame(name, state string) *Game {
+    game := &Game{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "games"}}
+    game.Status.State = state
+    return game
+}
+
+func TestFleetScale(t *testing.T) {
+    tests := []struct {
+        name        string
+        bufferSize  int32
+        allocated   []*Game
+        unallocated []*Game
+        // pending Games were created but aren't in the cache yet
+        pending     int
+        creates     int
+        deletes     []string
+    }{
+        {
+            name:        "fills the buffer",
+            bufferSize:  3,
+            unallocated: []*Game{fleetGame("ready-1", GameStateReady)},
+            creates:     2,
+        },
+        {
+            name:        "pending creates fill the buffer",
+            bufferSize:  3,
+            unallocated: []*Game{fleetGame("ready-1", GameStateReady)},
+            pending:     2,
+        },
+        {
+            name:        "lowered buffer keeps Ready Games while creates are pending",
+            bufferSize:  1,
+            unallocated: []*Game{fleetGame("ready-1", GameStateReady)},
+            pending:     2,
+        },
+        {
+            name:       "deletes starting Games first",
+            bufferSize: 1,
+            allocated:  []*Game{fleetGame("claimed-1", GameStateAllocated)},
+            unallocated: []*Game{
+                fleetGame("ready-1", GameStateReady),
+                fleetGame("starting-1", GameStateStarting),
+                fleetGame("ready-2", GameStateReady),
+            },
+            deletes: []string{"ready-1", "starting-1"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+            // The fake can't create objects by server-side apply
+            client.PrependReactor("patch", "games", func(action k8stesting.Action) (bool, runtime.Object, error) {
+                return true, nil, nil
+            })
+            controller := &FleetController{
+                gameClient: client.Resource(gameGVR),
+                creating:   make(map[string]map[string]time.Time),
+            }
+            fleet := &GameFleet{ObjectMeta: metav1.ObjectMeta{Name: "arena", Namespace: "games", UID: "fleet-uid"}}
+            fleet.Spec.BufferSize = tt.bufferSize
+            fleet.Spec.MaxReplicas = 10
+            for i := 0; i < tt.pending; i++ {
+                controller.recordCreate(fleet, fmt.Sprintf("arena-pending-%d", i))
+            }
+
+            if err := controller.scale(context.Background(), fleet, tt.allocated, tt.unallocated); err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+
+            creates := 0
+            var deletes []string
+            for _, action := range client.Actions() {
+                switch action := action.(type) {
+                case k8stesting.PatchAction:
+                    creates++
+                case k8stesting.DeleteAction:
+                    deletes = append(deletes, action.GetName())
+                }
+            }
+            sort.Strings(deletes)
+            if creates != tt.creates {
+                t.Errorf("created %d Games, want %d", creates, tt.creates)
+            }
+            if !reflect.DeepEqual(deletes, tt.deletes) {
+                t.Errorf("deleted %v, want %v", deletes, tt.deletes)
+            }
+        })
+    }
+}
+
+func TestApplyGameResourceVersion(t *testing.T) {
+    tests := []struct {
+        name            string
+        resourceVersion string
+        conflict        bool
+        wantErr         bool
+    }{
+        {name: "create", resourceVersion: ""},
+        {name: "rollout", resourceVersion: "42"},
+        {name: "claimed during rollout", resourceVersion: "42", conflict: true, wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+            var sent string
+            client.PrependReactor("patch", "games", func(action k8stesting.Action) (bool, runtime.Object, error) {
+                var applied Game
+                if err := json.Unmarshal(action.(k8stesting.PatchAction).GetPatch(), &applied); err != nil {
+                    t.Errorf("cannot decode patch: %v", err)
+                }
+                sent = applied.ResourceVersion
+                if tt.conflict {
+                    return true, nil, errors.NewConflict(gameGVR.GroupResource(), "arena-1", fmt.Errorf("object was modified"))
+                }
+                return true, nil, nil
+            })
+            controller := &FleetController{gameClient: client.Resource(gameGVR)}
+            fleet := &GameFleet{ObjectMeta: metav1.ObjectMeta{Name: "arena", Namespace: "games", UID: "fleet-uid"}}
+
+            err := controller.applyGame(context.Background(), fleet, "arena-1", tt.resourceVersion)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("applyGame() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if sent != tt.resourceVersion {
+                t.Errorf("applied resourceVersion %q, want %q", sent, tt.resourceVersion)
+            }
+        })
+    }
+}
@@ -1,94 +1,244 @@
 package main
 
 import (
-    "context"
+    "crypto/rand"
+    "encoding/hex"
     "flag"
     "fmt"
-    "os"
+    "log"
     "path/filepath"
-    
+    "time"
+
     appsv1 "k8s.io/api/apps/v1"
     corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/resource"
     metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-    "k8s.io/apimachinery/pkg/util/intstr"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/client-go/dynamic"
+    "k8s.io/client-go/dynamic/dynamicinformer"
     "k8s.io/client-go/kubernetes"
     "k8s.io/client-go/tools/clientcmd"
     "k8s.io/client-go/util/homedir"
 )
 
+// gameGVR identifies the Game CRD served by 05-2-game-crd.yaml
+var gameGVR = schema.GroupVersionResource{
+    Group:    "gaming.example.com",
+    Version:  "v1",
+    Resource: "games",
+}
+
 // Game represents our custom resource
 type Game struct {
     metav1.TypeMeta   `json:",inline"`
     metav1.ObjectMeta `json:"metadata,omitempty"`
-    Spec             GameSpec `json:"spec"`
+    Spec             GameSpec   `json:"spec"`
+    Status           GameStatus `json:"status,omitempty"`
 }
 
 // GameSpec defines our game server configuration
 type GameSpec struct {
-    GameName string `json:"gameName"`
-    Players  int32  `json:"players"`
-    Port     int32  `json:"port"`
+    GameName    string `json:"gameName"`
+    GameVersion string `json:"gameVersion,omitempty"`
+    ServerName  string `json:"serverName"`
+    Players     int32  `json:"players"`
+    Port        int32  `json:"port"`
+    Mode        string `json:"mode,omitempty"`
+    Difficulty  string `json:"difficulty,omitempty"`
+    // Storage overrides the catalog's size of the world volume; it is fixed
+    // once the server has been created
+    Storage     string `json:"storage,omitempty"`
+    // Backup schedules archives of the world; RestoreFrom seeds a new
+    // world from one of them and needs Backup for where they are kept
+    Backup      *BackupSpec  `json:"backup,omitempty"`
+    RestoreFrom *RestoreSpec `json:"restoreFrom,omitempty"`
+    // DrainTimeout is how long a restart waits for players to leave, e.g.
+    // 30m
+    DrainTimeout string      `json:"drainTimeout,omitempty"`
+}
+
+// GameStatus reports what the controller last saw of the server. Unset
+// fields are written as null so a patch clears them.
+type GameStatus struct {
+    // State is Starting until the server is ready to take players, then
+    // Ready, or Allocated once a GameAllocation has claimed it
+    State               string       `json:"state"`
+    // Address and Ports are where players connect: the node running the
+    // server and the Service's node ports
+    Address             string       `json:"address"`
+    Ports               []GamePort   `json:"ports"`
+    // CurrentPlayers is unknown while the server can't be asked
+    CurrentPlayers      *int32       `json:"currentPlayers"`
+    LastSeenActive      *metav1.Time `json:"lastSeenActive"`
+    // RestartPendingSince is set while a changed spec waits for players to
+    // leave before the server restarts
+    RestartPendingSince *metav1.Time `json:"restartPendingSince"`
+}
+
+type GamePort struct {
+    Name     string          `json:"name"`
+    Port     int32           `json:"port"`
+    Protocol corev1.Protocol `json:"protocol"`
 }
 
+// worldVolume names the volume claim template holding the world
+const worldVolume = "world"
+
+// terminationGracePeriod gives a server time to save its world on shutdown
+const terminationGracePeriod = int64(60)
+
 func main() {
     // Setup kubernetes config
     kubeconfig := flag.String("kubeconfig", filepath.Join(homedir.HomeDir(), ".kube", "config"), "")
+    catalogNamespace := flag.String("catalog-namespace", "default", "namespace of the game catalog ConfigMap")
+    catalogName := flag.String("catalog-name", "game-catalog", "name of the game catalog ConfigMap")
     flag.Parse()
 
     config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
     if err != nil {
-        fmt.Printf("Error building config: %v\n", err)
-        os.Exit(1)
+        log.Fatalf("Error building config: %v", err)
     }
 
     clientset, err := kubernetes.NewForConfig(config)
     if err != nil {
-        fmt.Printf("Error creating clientset: %v\n", err)
-        os.Exit(1)
+        log.Fatalf("Error creating clientset: %v", err)
     }
 
-    // Example game server
-    game := &Game{
-        ObjectMeta: metav1.ObjectMeta{
-            Name: "minecraft-server",
-            Namespace: "default",
-        },
-        Spec: GameSpec{
-            GameName: "minecraft",
-            Players: 20,
-            Port: 25565,
-        },
+    dynamicClient, err := dynamic.NewForConfig(config)
+    if err != nil {
+        log.Fatalf("Error creating dynamic client: %v", err)
     }
 
-    // Create deployment for the game server
-    deployment := createGameDeployment(game)
-    _, err = clientset.AppsV1().Deployments(game.Namespace).Create(context.TODO(), deployment, metav1.CreateOptions{})
-    if err != nil {
-        fmt.Printf("Error creating deployment: %v\n", err)
+    informerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, time.Second*30)
+    kubeInformerFactory := NewKubeInformerFactory(clientset)
+    catalogInformerFactory := NewCatalogInformerFactory(clientset, *catalogNamespace, *catalogName)
+    controller := NewController(clientset, dynamicClient, informerFactory, kubeInformerFactory, catalogInformerFactory, *catalogNamespace, *catalogName)
+    fleetController := NewFleetController(dynamicClient, informerFactory)
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+
+    informerFactory.Start(stopCh)
+    kubeInformerFactory.Start(stopCh)
+    catalogInformerFactory.Start(stopCh)
+
+    go func() {
+        if err := fleetController.Run(2, stopCh); err != nil {
+            log.Fatalf("Error running fleet controller: %v", err)
+        }
+    }()
+
+    if err = controller.Run(2, stopCh); err != nil {
+        log.Fatalf("Error running controller: %v", err)
     }
+}
 
-    // Create service to expose the game server
-    service := createGameService(game)
-    _, err = clientset.CoreV1().Services(game.Namespace).Create(context.TODO(), service, metav1.CreateOptions{})
-    if err != nil {
-        fmt.Printf("Error creating service: %v\n", err)
+// ownerReference makes game the controller of an object created for it
+func ownerReference(game *Game) metav1.OwnerReference {
+    return *metav1.NewControllerRef(game, gameGVR.GroupVersion().WithKind("Game"))
+}
+
+// childLabels marks an object generated for game
+func childLabels(game *Game) map[string]string {
+    return map[string]string{
+        managedByLabel: managedBy,
+        gameLabel: game.Name,
     }
 }
 
-func createGameDeployment(game *Game) *appsv1.Deployment {
+// createGameStatefulSet runs the server as a single-replica StatefulSet
+// whose pod keeps its world volume across restarts and rescheduling. A
+// changed spec rolls the pod once the new one can replace it; the old one
+// gets terminationGracePeriod to save the world first.
+func createGameStatefulSet(game *Game, entry *CatalogEntry) (*appsv1.StatefulSet, error) {
+    storageSize := entry.Storage.Size
+    if game.Spec.Storage != "" {
+        storageSize = game.Spec.Storage
+    }
+    size, err := resource.ParseQuantity(storageSize)
+    if err != nil {
+        return nil, fmt.Errorf("invalid storage size %q: %v", storageSize, err)
+    }
+
+    var initContainers []corev1.Container
+    var volumes []corev1.Volume
+    if game.Spec.RestoreFrom != nil {
+        if game.Spec.Backup == nil {
+            return nil, fmt.Errorf("restoreFrom needs a backup target")
+        }
+        initContainers, volumes = restoreContainers(game)
+    }
+
+    env := entry.env(game)
+    volumeMounts := []corev1.VolumeMount{
+        {
+            Name: worldVolume,
+            MountPath: entry.Storage.MountPath,
+        },
+    }
+    if entry.needsPassword() {
+        query := entry.PlayerQuery
+        if query.PasswordEnv != "" {
+            env = append(env, corev1.EnvVar{
+                Name: query.PasswordEnv,
+                ValueFrom: &corev1.EnvVarSource{
+                    SecretKeyRef: &corev1.SecretKeySelector{
+                        LocalObjectReference: corev1.LocalObjectReference{Name: rconSecretName(game)},
+                        Key: rconPasswordKey,
+                    },
+                },
+            })
+        }
+        if query.PasswordFile != "" {
+            volumes = append(volumes, corev1.Volume{
+                Name: "rcon-password",
+                VolumeSource: corev1.VolumeSource{
+                    Secret: &corev1.SecretVolumeSource{SecretName: rconSecretName(game)},
+                },
+            })
+            volumeMounts = append(volumeMounts, corev1.VolumeMount{
+                Name: "rcon-password",
+                MountPath: query.PasswordFile,
+                SubPath: rconPasswordKey,
+                ReadOnly: true,
+            })
+        }
+    }
+
     replicas := int32(1)
-    return &appsv1.Deployment{
+    gracePeriod := terminationGracePeriod
+    return &appsv1.StatefulSet{
+        TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
         ObjectMeta: metav1.ObjectMeta{
             Name: game.Name,
             Namespace: game.Namespace,
+            Labels: childLabels(game),
+            OwnerReferences: []metav1.OwnerReference{
+                ownerReference(game),
+            },
         },
-        Spec: appsv1.DeploymentSpec{
+        Spec: appsv1.StatefulSetSpec{
             Replicas: &replicas,
+            // Per-pod DNS is deliberately not provided: players reach the
+            // single server through the NodePort Service of the same name,
+            // which isn't headless, and the controller finds the pod by its
+            // labels. serviceName can't be changed once the StatefulSet
+            // exists, so it stays pointed at that Service.
+            ServiceName: game.Name,
             Selector: &metav1.LabelSelector{
                 MatchLabels: map[string]string{
                     "game": game.Name,
                 },
             },
+            UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+                Type: appsv1.RollingUpdateStatefulSetStrategyType,
+            },
+            // The world is deleted with the Game, like everything else the
+            // Game owns, but survives scaling down
+            PersistentVolumeClaimRetentionPolicy: &appsv1.StatefulSetPersistentVolumeClaimRetentionPolicy{
+                WhenDeleted: appsv1.DeletePersistentVolumeClaimRetentionPolicyType,
+                WhenScaled: appsv1.RetainPersistentVolumeClaimRetentionPolicyType,
+            },
             Template: corev1.PodTemplateSpec{
                 ObjectMeta: metav1.ObjectMeta{
                     Labels: map[string]string{
@@ -96,46 +246,90 @@ func createGameDeployment(game *Game) *appsv1.Deployment {
                     },
                 },
                 Spec: corev1.PodSpec{
+                    TerminationGracePeriodSeconds: &gracePeriod,
+                    InitContainers: initContainers,
                     Containers: []corev1.Container{
                         {
                             Name:  game.Spec.GameName,
-                            Image: fmt.Sprintf("%s:latest", game.Spec.GameName),
-                            Ports: []corev1.ContainerPort{
-                                {
-                                    ContainerPort: game.Spec.Port,
-                                },
-                            },
-                            Env: []corev1.EnvVar{
-                                {
-                                    Name: "MAX_PLAYERS",
-                                    Value: fmt.Sprintf("%d", game.Spec.Players),
-                                },
+                            Image: entry.image(game),
+                            Ports: entry.containerPorts(game),
+                            Env: env,
+                            ReadinessProbe: entry.ReadinessProbe,
+                            Resources: entry.Resources,
+                            VolumeMounts: volumeMounts,
+                        },
+                    },
+                    Volumes: volumes,
+                },
+            },
+            VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+                {
+                    TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+                    ObjectMeta: metav1.ObjectMeta{
+                        Name: worldVolume,
+                        Labels: childLabels(game),
+                    },
+                    Spec: corev1.PersistentVolumeClaimSpec{
+                        AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+                        Resources: corev1.VolumeResourceRequirements{
+                            Requests: corev1.ResourceList{
+                                corev1.ResourceStorage: size,
                             },
                         },
                     },
                 },
             },
         },
-    }
+    }, nil
 }
 
-func createGameService(game *Game) *corev1.Service {
+func createGameService(game *Game, entry *CatalogEntry) *corev1.Service {
     return &corev1.Service{
+        TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
         ObjectMeta: metav1.ObjectMeta{
             Name: game.Name,
             Namespace: game.Namespace,
+            Labels: childLabels(game),
+            OwnerReferences: []metav1.OwnerReference{
+                ownerReference(game),
+            },
         },
         Spec: corev1.ServiceSpec{
             Type: corev1.ServiceTypeNodePort,
             Selector: map[string]string{
                 "game": game.Name,
             },
-            Ports: []corev1.ServicePort{
-                {
-                    Port: game.Spec.Port,
-                    TargetPort: intstr.FromInt(int(game.Spec.Port)),
-                },
-            },
+            Ports: entry.servicePorts(game),
         },
     }
-}
\ No newline at end of file
+}
+
+// The RCON password the controller generated for a Game
+const rconPasswordKey = "password"
+
+func rconSecretName(game *Game) string {
+    return game.Name + "-rcon"
+}
+
+// createRCONSecret holds a new random RCON password for game. It is created
+// once and never applied, so the password stays what the server knows.
+func createRCONSecret(game *Game) (*corev1.Secret, error) {
+    password := make([]byte, 24)
+    if _, err := rand.Read(password); err != nil {
+        return nil, fmt.Errorf("failed to generate rcon password: %v", err)
+    }
+    return &corev1.Secret{
+        ObjectMeta: metav1.ObjectMeta{
+            Name: rconSecretName(game),
+            Namespace: game.Namespace,
+            Labels: childLabels(game),
+            OwnerReferences: []metav1.OwnerReference{
+                ownerReference(game),
+            },
+        },
+        Type: corev1.SecretTypeOpaque,
+        StringData: map[string]string{
+            rconPasswordKey: hex.EncodeToString(password),
+        },
+    }, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "regexp"
+    "strconv"
+    "sync"
+)
+
+// PlayerProber asks a running server how many players are on it, through
+// the game's query or RCON protocol. Probers are registered by protocol
+// name with a ProberRegistry, and the catalog's playerQuery picks one per
+// game, so a new game only needs a prober for its protocol:
+//
+//     controller.Probers().Register("terraria-tshock", tshockProber)
+type PlayerProber interface {
+    Players(ctx context.Context, target ProbeTarget) (int, error)
+    // Broadcast posts a message to everyone on the server. Probers whose
+    // protocol can't message players return nil without doing anything.
+    Broadcast(ctx context.Context, target ProbeTarget, message string) error
+}
+
+// ProbeTarget is the server a prober talks to
+type ProbeTarget struct {
+    // Address is the host:port of the catalog's playerQuery port
+    Address  string
+    // Password authenticates RCON; empty for protocols without one
+    Password string
+}
+
+// ProberRegistry maps protocol names to their probers
+type ProberRegistry struct {
+    probers map[string]PlayerProber
+    mutex   sync.RWMutex
+}
+
+// NewProberRegistry returns a registry holding the built-in probers
+func NewProberRegistry() *ProberRegistry {
+    return &ProberRegistry{
+        probers: map[string]PlayerProber{
+            "minecraft-rcon": &rconProber{
+                listCommand: "list",
+                // "There are 3 of a max of 20 players online: ..."
+                countPattern: regexp.MustCompile(`There are (\d+)`),
+                broadcastCommand: func(message string) string {
+                    return "say " + message
+                },
+            },
+            "factorio-rcon": &rconProber{
+                listCommand: "/players online count",
+                // "Online players (3):"
+                countPattern: regexp.MustCompile(`Online players \((\d+)\)`),
+                // Anything that isn't a command is posted to the chat
+                broadcastCommand: func(message string) string {
+                    return message
+                },
+            },
+            "a2s": &a2sProber{},
+        },
+    }
+}
+
+func (r *ProberRegistry) Register(protocol string, prober PlayerProber) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if _, exists := r.probers[protocol]; exists {
+        return fmt.Errorf("prober for protocol %s already registered", protocol)
+    }
+    r.probers[protocol] = prober
+    return nil
+}
+
+func (r *ProberRegistry) Prober(protocol string) (PlayerProber, error) {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+
+    prober, exists := r.probers[protocol]
+    if !exists {
+        return nil, fmt.Errorf("unsupported player query protocol: %s", protocol)
+    }
+    return prober, nil
+}
+
+// rconProber counts players with a console command sent over RCON
+type rconProber struct {
+    listCommand      string
+    // countPattern captures the player count in the command's output
+    countPattern     *regexp.Regexp
+    broadcastCommand func(message string) string
+}
+
+func (p *rconProber) Players(ctx context.Context, target ProbeTarget) (int, error) {
+    output, err := p.execute(ctx, target, p.listCommand)
+    if err != nil {
+        return 0, err
+    }
+    match := p.countPattern.FindStringSubmatch(output)
+    if match == nil {
+        return 0, fmt.Errorf("unexpected player list %q", output)
+    }
+    return strconv.Atoi(match[1])
+}
+
+func (p *rconProber) Broadcast(ctx context.Context, target ProbeTarget, message string) error {
+    _, err := p.execute(ctx, target, p.broadcastCommand(message))
+    return err
+}
+
+func (p *rconProber) execute(ctx context.Context, target ProbeTarget, command string) (string, error) {
+    conn, err := dialRCON(ctx, target.Address, target.Password)
+    if err != nil {
+        return "", err
+    }
+    defer conn.Close()
+    return conn.Execute(command)
+}
+
+// a2sProber reads the player count from the Steam server query (A2S_INFO)
+// answer. A2S can't message players, so Broadcast does nothing.
+type a2sProber struct{}
+
+func (p *a2sProber) Players(ctx context.Context, target ProbeTarget) (int, error) {
+    return queryA2SPlayers(ctx, target.Address)
+}
+
+func (p *a2sProber) Broadcast(ctx context.Context, target ProbeTarget, message string) error {
+    return nil
+}
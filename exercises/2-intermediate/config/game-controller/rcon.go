@@ -0,0 +1,129 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+)
+
+// Packet types of the Source RCON protocol, which Minecraft and Factorio
+// speak. An auth response and an exec command share a type, told apart by
+// direction.
+const (
+    rconAuth          = int32(3)
+    rconAuthResponse  = int32(2)
+    rconExecCommand   = int32(2)
+    rconResponseValue = int32(0)
+)
+
+// rconMaxPacket bounds the size a server may announce for a packet
+const rconMaxPacket = 64 * 1024
+
+// rconConn is an authenticated RCON connection
+type rconConn struct {
+    conn   net.Conn
+    nextID int32
+}
+
+// dialRCON connects to addr and logs in. The connection gives up once ctx
+// is done.
+func dialRCON(ctx context.Context, addr, password string) (*rconConn, error) {
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, "tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+
+    c := &rconConn{conn: conn}
+    if err := c.login(password); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return c, nil
+}
+
+func (c *rconConn) login(password string) error {
+    id, err := c.send(rconAuth, password)
+    if err != nil {
+        return err
+    }
+    for {
+        respID, respType, _, err := c.read()
+        if err != nil {
+            return err
+        }
+        // Source servers send an empty response value ahead of the answer
+        if respType != rconAuthResponse {
+            continue
+        }
+        if respID == -1 {
+            return fmt.Errorf("rcon authentication failed")
+        }
+        if respID == id {
+            return nil
+        }
+    }
+}
+
+// Execute runs a console command and returns its output
+func (c *rconConn) Execute(command string) (string, error) {
+    id, err := c.send(rconExecCommand, command)
+    if err != nil {
+        return "", err
+    }
+    for {
+        respID, respType, body, err := c.read()
+        if err != nil {
+            return "", err
+        }
+        if respID == id && respType == rconResponseValue {
+            return body, nil
+        }
+    }
+}
+
+func (c *rconConn) Close() error {
+    return c.conn.Close()
+}
+
+// send writes a packet: its length, ID and type as little-endian int32s,
+// then the body followed by two NUL bytes
+func (c *rconConn) send(packetType int32, body string) (int32, error) {
+    c.nextID++
+    packet := new(bytes.Buffer)
+    binary.Write(packet, binary.LittleEndian, int32(4+4+len(body)+2))
+    binary.Write(packet, binary.LittleEndian, c.nextID)
+    binary.Write(packet, binary.LittleEndian, packetType)
+    packet.WriteString(body)
+    packet.Write([]byte{0, 0})
+
+    if _, err := c.conn.Write(packet.Bytes()); err != nil {
+        return 0, fmt.Errorf("failed to send rcon packet: %v", err)
+    }
+    return c.nextID, nil
+}
+
+func (c *rconConn) read() (int32, int32, string, error) {
+    var size int32
+    if err := binary.Read(c.conn, binary.LittleEndian, &size); err != nil {
+        return 0, 0, "", fmt.Errorf("failed to read rcon packet: %v", err)
+    }
+    if size < 10 || size > rconMaxPacket {
+        return 0, 0, "", fmt.Errorf("invalid rcon packet size %d", size)
+    }
+
+    packet := make([]byte, size)
+    if _, err := io.ReadFull(c.conn, packet); err != nil {
+        return 0, 0, "", fmt.Errorf("failed to read rcon packet: %v", err)
+    }
+    id := int32(binary.LittleEndian.Uint32(packet[0:4]))
+    packetType := int32(binary.LittleEndian.Uint32(packet[4:8]))
+    body := string(bytes.TrimRight(packet[8:], "\x00"))
+    return id, packetType, body, nil
+}
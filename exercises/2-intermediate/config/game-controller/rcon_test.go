@@ -0,0 +1,153 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io"
+    "net"
+    "strings"
+    "testing"
+)
+
+// rconPacket encodes a packet the way a Source RCON server sends it
+func rconPacket(id, packetType int32, body string) []byte {
+    var b bytes.Buffer
+    binary.Write(&b, binary.LittleEndian, int32(4+4+len(body)+2))
+    binary.Write(&b, binary.LittleEndian, id)
+    binary.Write(&b, binary.LittleEndian, packetType)
+    b.WriteString(body)
+    b.Write([]byte{0, 0})
+    return b.Bytes()
+}
+
+// readRCONRequest reads one packet the client sent; ok is false once the
+// connection is closed
+func readRCONRequest(conn net.Conn) (id, packetType int32, body string, ok bool) {
+    var size int32
+    if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
+        return 0, 0, "", false
+    }
+    packet := make([]byte, size)
+    if _, err := io.ReadFull(conn, packet); err != nil {
+        return 0, 0, "", false
+    }
+    id = int32(binary.LittleEndian.Uint32(packet[0:4]))
+    packetType = int32(binary.LittleEndian.Uint32(packet[4:8]))
+    return id, packetType, strings.TrimRight(string(packet[8:]), "\x00"), true
+}
+
+// fakeRCONServer answers each request the client sends with the packets
+// reply returns for it
+func fakeRCONServer(t *testing.T, reply func(id, packetType int32, body string) [][]byte) *rconConn {
+    client, server := net.Pipe()
+    t.Cleanup(func() {
+        client.Close()
+        server.Close()
+    })
+    go func() {
+        for {
+            id, packetType, body, ok := readRCONRequest(server)
+            if !ok {
+                return
+            }
+            for _, packet := range reply(id, packetType, body) {
+                if _, err := server.Write(packet); err != nil {
+                    return
+                }
+            }
+        }
+    }()
+    return &rconConn{conn: client}
+}
+
+func TestRCONLogin(t *testing.T) {
+    tests := []struct {
+        name    string
+        reply   func(id, packetType int32, body string) [][]byte
+        wantErr string
+    }{
+        {
+            name: "accepted after an empty response value",
+            reply: func(id, packetType int32, body string) [][]byte {
+                if packetType != rconAuth || body != "secret" {
+                    return [][]byte{rconPacket(-1, rconAuthResponse, "")}
+                }
+                return [][]byte{rconPacket(id, rconResponseValue, ""), rconPacket(id, rconAuthResponse, "")}
+            },
+        },
+        {
+            name: "accepted without an empty response value",
+            reply: func(id, packetType int32, body string) [][]byte {
+                return [][]byte{rconPacket(id, rconAuthResponse, "")}
+            },
+        },
+        {
+            name: "wrong password",
+            reply: func(id, packetType int32, body string) [][]byte {
+                return [][]byte{rconPacket(id, rconResponseValue, ""), rconPacket(-1, rconAuthResponse, "")}
+            },
+            wantErr: "rcon authentication failed",
+        },
+        {
+            name: "oversized packet",
+            reply: func(id, packetType int32, body string) [][]byte {
+                return [][]byte{{0x01, 0x00, 0x01, 0x00}}
+            },
+            wantErr: "invalid rcon packet size 65537",
+        },
+        {
+            name: "undersized packet",
+            reply: func(id, packetType int32, body string) [][]byte {
+                return [][]byte{{0x04, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}}
+            },
+            wantErr: "invalid rcon packet size 4",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            conn := fakeRCONServer(t, tt.reply)
+            err := conn.login("secret")
+            switch {
+            case tt.wantErr == "" && err != nil:
+                t.Fatalf("unexpected error: %v", err)
+            case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+                t.Fatalf("got error %v, want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestRCONExecute(t *testing.T) {
+    conn := fakeRCONServer(t, func(id, packetType int32, body string) [][]byte {
+        switch {
+        case packetType == rconAuth:
+            return [][]byte{rconPacket(id, rconAuthResponse, "")}
+        case body == "list":
+            // A stale answer to an earlier request comes first
+            return [][]byte{
+                rconPacket(id-1, rconResponseValue, "Unknown command"),
+                rconPacket(id, rconResponseValue, "There are 2 of a max of 20 players online: alex, steve"),
+            }
+        }
+        return [][]byte{rconPacket(id, rconResponseValue, "")}
+    })
+    if err := conn.login("secret"); err != nil {
+        t.Fatalf("login failed: %v", err)
+    }
+
+    output, err := conn.Execute("list")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if output != "There are 2 of a max of 20 players online: alex, steve" {
+        t.Errorf("got output %q", output)
+    }
+
+    prober := NewProberRegistry()
+    minecraft, _ := prober.Prober("minecraft-rcon")
+    match := minecraft.(*rconProber).countPattern.FindStringSubmatch(output)
+    if match == nil || match[1] != "2" {
+        t.Errorf("player count not matched in %q", output)
+    }
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "time"
+
+    appsv1 "k8s.io/api/apps/v1"
+    corev1 "k8s.io/api/core/v1"
+    networkingv1 "k8s.io/api/networking/v1"
+    "k8s.io/apimachinery/pkg/api/errors"
+    apimeta "k8s.io/apimachinery/pkg/api/meta"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/apimachinery/pkg/types"
+    "k8s.io/apimachinery/pkg/util/wait"
+    "k8s.io/client-go/dynamic/dynamicinformer"
+    "k8s.io/client-go/informers"
+    "k8s.io/client-go/kubernetes"
+    networkinglisters "k8s.io/client-go/listers/networking/v1"
+    "k8s.io/client-go/tools/cache"
+    "k8s.io/client-go/util/workqueue"
+)
+
+// webappGVR identifies the WebApp CRD served by 05-1-webapp-crd.yaml
+var webappGVR = schema.GroupVersionResource{
+    Group:    "example.com",
+    Version:  "v1",
+    Resource: "webapps",
+}
+
+// Labels on every object the controller generates. The child informers
+// only watch objects carrying managedByLabel; webappLabel names the WebApp
+// a child belongs to. Children are also owned by their WebApp, so deleting
+// the WebApp deletes them; nothing a WebApp creates lives outside its
+// namespace, so no finalizer is needed.
+const (
+    managedByLabel = "app.kubernetes.io/managed-by"
+    webappLabel    = "example.com/webapp"
+)
+
+// fieldManager owns the fields the controller sets through server-side apply
+const fieldManager = "webapp-controller"
+
+// Controller reconciles WebApps into a Deployment, a Service and, for
+// WebApps serving domains over SSL, an Ingress
+type Controller struct {
+    kubeClient        kubernetes.Interface
+    webappLister      cache.GenericLister
+    webappsSynced     cache.InformerSynced
+    deploymentsSynced cache.InformerSynced
+    servicesSynced    cache.InformerSynced
+    ingressLister     networkinglisters.IngressLister
+    ingressesSynced   cache.InformerSynced
+    workqueue         workqueue.RateLimitingInterface
+}
+
+// NewKubeInformerFactory returns an informer factory restricted to the
+// objects the controller generated
+func NewKubeInformerFactory(kubeClient kubernetes.Interface) informers.SharedInformerFactory {
+    return informers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30,
+        informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+            options.LabelSelector = managedByLabel + "=" + managedBy
+        }))
+}
+
+func NewController(kubeClient kubernetes.Interface, informerFactory dynamicinformer.DynamicSharedInformerFactory, kubeInformerFactory informers.SharedInformerFactory) *Controller {
+    webappInformer := informerFactory.ForResource(webappGVR)
+    deploymentInformer := kubeInformerFactory.Apps().V1().Deployments()
+    serviceInformer := kubeInformerFactory.Core().V1().Services()
+    ingressInformer := kubeInformerFactory.Networking().V1().Ingresses()
+
+    controller := &Controller{
+        kubeClient:        kubeClient,
+        webappLister:      webappInformer.Lister(),
+        webappsSynced:     webappInformer.Informer().HasSynced,
+        deploymentsSynced: deploymentInformer.Informer().HasSynced,
+        servicesSynced:    serviceInformer.Informer().HasSynced,
+        ingressLister:     ingressInformer.Lister(),
+        ingressesSynced:   ingressInformer.Informer().HasSynced,
+        workqueue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "WebApps"),
+    }
+
+    webappInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.enqueueWebApp,
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            controller.enqueueWebApp(newObj)
+        },
+        DeleteFunc: controller.enqueueWebApp,
+    })
+
+    // Changes to a child, including someone else's edits or deleting it,
+    // reconcile its WebApp, which puts the child back the way it should be
+    childHandler := cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.enqueueParent,
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            controller.enqueueParent(newObj)
+        },
+        DeleteFunc: controller.enqueueParent,
+    }
+    deploymentInformer.Informer().AddEventHandler(childHandler)
+    serviceInformer.Informer().AddEventHandler(childHandler)
+    ingressInformer.Informer().AddEventHandler(childHandler)
+
+    return controller
+}
+
+func (c *Controller) enqueueWebApp(obj interface{}) {
+    key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+    if err != nil {
+        log.Printf("Error computing key for webapp: %v", err)
+        return
+    }
+    c.workqueue.Add(key)
+}
+
+// enqueueParent enqueues the WebApp controlling a generated object
+func (c *Controller) enqueueParent(obj interface{}) {
+    if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+        obj = tombstone.Obj
+    }
+    child, ok := obj.(metav1.Object)
+    if !ok {
+        return
+    }
+    owner := metav1.GetControllerOf(child)
+    if owner == nil || owner.Kind != "WebApp" {
+        return
+    }
+    c.workqueue.Add(child.GetNamespace() + "/" + owner.Name)
+}
+
+func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
+    defer c.workqueue.ShutDown()
+
+    log.Print("Starting WebApp controller")
+
+    log.Print("Waiting for informer caches to sync")
+    if ok := cache.WaitForCacheSync(stopCh, c.webappsSynced, c.deploymentsSynced, c.servicesSynced, c.ingressesSynced); !ok {
+        return fmt.Errorf("failed to wait for caches to sync")
+    }
+
+    for i := 0; i < threadiness; i++ {
+        go wait.Until(c.runWorker, time.Second, stopCh)
+    }
+
+    <-stopCh
+    return nil
+}
+
+func (c *Controller) runWorker() {
+    for c.processNextWorkItem() {
+    }
+}
+
+func (c *Controller) processNextWorkItem() bool {
+    obj, shutdown := c.workqueue.Get()
+    if shutdown {
+        return false
+    }
+
+    defer c.workqueue.Done(obj)
+
+    key, ok := obj.(string)
+    if !ok {
+        c.workqueue.Forget(obj)
+        return true
+    }
+
+    if err := c.syncWebApp(key); err != nil {
+        log.Printf("Error syncing webapp %s: %v", key, err)
+        c.workqueue.AddRateLimited(key)
+        return true
+    }
+
+    c.workqueue.Forget(obj)
+    return true
+}
+
+// syncWebApp applies the desired children of a WebApp. Server-side apply
+// leaves objects that already match untouched, so resyncs cost no writes.
+func (c *Controller) syncWebApp(key string) error {
+    namespace, name, err := cache.SplitMetaNamespaceKey(key)
+    if err != nil {
+        log.Printf("Invalid webapp key %s: %v", key, err)
+        return nil
+    }
+
+    obj, err := c.webappLister.ByNamespace(namespace).Get(name)
+    if errors.IsNotFound(err) {
+        log.Printf("WebApp %s no longer exists", key)
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to get webapp %s: %v", key, err)
+    }
+
+    webapp, err := webappFromObject(obj)
+    if err != nil {
+        // A malformed object will not parse any better on retry
+        log.Printf("Error decoding webapp %s: %v", key, err)
+        return nil
+    }
+
+    ctx := context.TODO()
+    if err := c.apply(ctx, createDeployment(webapp)); err != nil {
+        return err
+    }
+    if err := c.apply(ctx, createService(webapp)); err != nil {
+        return err
+    }
+
+    if wantsIngress(webapp) {
+        return c.apply(ctx, createIngress(webapp))
+    }
+    return c.deleteIngress(ctx, webapp)
+}
+
+// wantsIngress reports whether the WebApp is exposed through an Ingress
+func wantsIngress(webapp *WebApp) bool {
+    return len(webapp.Spec.Domains) > 0 && webapp.Spec.SSL != nil && webapp.Spec.SSL.Enabled
+}
+
+// deleteIngress removes the Ingress once a WebApp no longer wants one
+func (c *Controller) deleteIngress(ctx context.Context, webapp *WebApp) error {
+    ingress, err := c.ingressLister.Ingresses(webapp.Namespace).Get(webapp.Name)
+    if errors.IsNotFound(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    // Ingresses applied before WebApps owned their children carry only the label
+    if !metav1.IsControlledBy(ingress, webapp) && ingress.Labels[webappLabel] != webapp.Name {
+        return nil
+    }
+
+    log.Printf("Deleting ingress %s/%s: no domains with SSL left", webapp.Namespace, webapp.Name)
+    err = c.kubeClient.NetworkingV1().Ingresses(webapp.Namespace).Delete(ctx, webapp.Name, metav1.DeleteOptions{})
+    if err != nil && !errors.IsNotFound(err) {
+        return fmt.Errorf("failed to delete ingress %s/%s: %v", webapp.Namespace, webapp.Name, err)
+    }
+    return nil
+}
+
+// apply server-side applies a generated object. Fields dropped from the
+// desired state are removed from the live object, since the controller owns
+// everything it applied before; fields other managers own are left alone.
+func (c *Controller) apply(ctx context.Context, obj runtime.Object) error {
+    accessor, err := apimeta.Accessor(obj)
+    if err != nil {
+        return err
+    }
+    data, err := json.Marshal(obj)
+    if err != nil {
+        return err
+    }
+
+    force := true
+    options := metav1.PatchOptions{FieldManager: fieldManager, Force: &force}
+    namespace, name := accessor.GetNamespace(), accessor.GetName()
+    switch obj.(type) {
+    case *appsv1.Deployment:
+        _, err = c.kubeClient.AppsV1().Deployments(namespace).Patch(ctx, name, types.ApplyPatchType, data, options)
+    case *corev1.Service:
+        _, err = c.kubeClient.CoreV1().Services(namespace).Patch(ctx, name, types.ApplyPatchType, data, options)
+    case *networkingv1.Ingress:
+        _, err = c.kubeClient.NetworkingV1().Ingresses(namespace).Patch(ctx, name, types.ApplyPatchType, data, options)
+    default:
+        return fmt.Errorf("cannot apply %T", obj)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to apply %s %s/%s: %v", obj.GetObjectKind().GroupVersionKind().Kind, namespace, name, err)
+    }
+    return nil
+}
+
+func webappFromObject(obj runtime.Object) (*WebApp, error) {
+    u, ok := obj.(*unstructured.Unstructured)
+    if !ok {
+        return nil, fmt.Errorf("unexpected object type %T", obj)
+    }
+
+    webapp := &WebApp{}
+    if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.DeepCopy().UnstructuredContent(), webapp); err != nil {
+        return nil, err
+    }
+    return webapp, nil
+}
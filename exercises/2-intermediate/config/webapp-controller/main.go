@@ -1,18 +1,19 @@
 package main
 
 import (
-    "context"
     "flag"
-    "fmt"
-    "os"
+    "log"
     "path/filepath"
-    
+    "time"
+
     appsv1 "k8s.io/api/apps/v1"
     corev1 "k8s.io/api/core/v1"
     networkingv1 "k8s.io/api/networking/v1"
+    "k8s.io/apimachinery/pkg/api/resource"
     metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-    "k8s.io/apimachinery/pkg/runtime"
     "k8s.io/apimachinery/pkg/util/intstr"
+    "k8s.io/client-go/dynamic"
+    "k8s.io/client-go/dynamic/dynamicinformer"
     "k8s.io/client-go/kubernetes"
     "k8s.io/client-go/tools/clientcmd"
     "k8s.io/client-go/util/homedir"
@@ -50,76 +51,72 @@ type Resources struct {
 
 func main() {
     kubeconfig := flag.String("kubeconfig", filepath.Join(homedir.HomeDir(), ".kube", "config"), "kubeconfig file")
+    webhookAddr := flag.String("webhook-addr", ":9443", "address the mutating webhook listens on; empty disables it")
+    webhookCertDir := flag.String("webhook-cert-dir", "/tmp/webapp-controller-webhook", "directory holding the webhook's tls.crt and tls.key")
     flag.Parse()
 
     config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
     if err != nil {
-        fmt.Printf("Error building config: %v\n", err)
-        os.Exit(1)
+        log.Fatalf("Error building config: %v", err)
     }
 
     clientset, err := kubernetes.NewForConfig(config)
     if err != nil {
-        fmt.Printf("Error creating clientset: %v\n", err)
-        os.Exit(1)
+        log.Fatalf("Error creating clientset: %v", err)
     }
 
-    // Example WebApp
-    webapp := &WebApp{
-        ObjectMeta: metav1.ObjectMeta{
-            Name:      "example-webapp",
-            Namespace: "default",
-        },
-        Spec: WebAppSpec{
-            Image:    "nginx:1.14",
-            Port:     80,
-            Replicas: 3,
-            SSL: &SSLConfig{
-                Enabled:    true,
-                SecretName: "webapp-tls",
-            },
-            Resources: &ResourceRequests{
-                Limits: &Resources{
-                    CPU:    "500m",
-                    Memory: "512Mi",
-                },
-                Requests: &Resources{
-                    CPU:    "250m",
-                    Memory: "256Mi",
-                },
-            },
-        },
+    dynamicClient, err := dynamic.NewForConfig(config)
+    if err != nil {
+        log.Fatalf("Error creating dynamic client: %v", err)
     }
 
-    // Create deployment
-    deployment := createDeployment(webapp)
-    _, err = clientset.AppsV1().Deployments(webapp.Namespace).Create(context.TODO(), deployment, metav1.CreateOptions{})
-    if err != nil {
-        fmt.Printf("Error creating deployment: %v\n", err)
+    informerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, time.Second*30)
+    kubeInformerFactory := NewKubeInformerFactory(clientset)
+    controller := NewController(clientset, informerFactory, kubeInformerFactory)
+
+    stopCh := make(chan struct{})
+    defer close(stopCh)
+
+    informerFactory.Start(stopCh)
+    kubeInformerFactory.Start(stopCh)
+
+    if *webhookAddr != "" {
+        go func() {
+            if err := NewWebhookServer(*webhookAddr, *webhookCertDir).Run(stopCh); err != nil {
+                log.Fatalf("Error running webhook: %v", err)
+            }
+        }()
     }
 
-    // Create service
-    service := createService(webapp)
-    _, err = clientset.CoreV1().Services(webapp.Namespace).Create(context.TODO(), service, metav1.CreateOptions{})
-    if err != nil {
-        fmt.Printf("Error creating service: %v\n", err)
+    if err = controller.Run(2, stopCh); err != nil {
+        log.Fatalf("Error running controller: %v", err)
     }
+}
 
-    if len(webapp.Spec.Domains) > 0 && webapp.Spec.SSL != nil && webapp.Spec.SSL.Enabled {
-        // Create Ingress with TLS
-        ingress := createIngress(webapp)
-        _, err = clientset.NetworkingV1().Ingresses(webapp.Namespace).Create(context.TODO(), ingress, metav1.CreateOptions{})
-        if err != nil {
-            fmt.Printf("Error creating ingress: %v\n", err)
-        }
+// ownerReference makes webapp the controller of a generated object, so the
+// garbage collector deletes the object together with the WebApp
+func ownerReference(webapp *WebApp) metav1.OwnerReference {
+    return *metav1.NewControllerRef(webapp, webappGVR.GroupVersion().WithKind("WebApp"))
+}
+
+// childLabels marks an object generated for webapp
+func childLabels(webapp *WebApp) map[string]string {
+    return map[string]string{
+        managedByLabel: managedBy,
+        webappLabel:    webapp.Name,
     }
 }
 
 func createDeployment(webapp *WebApp) *appsv1.Deployment {
     return &appsv1.Deployment{
+        TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
         ObjectMeta: metav1.ObjectMeta{
             Name:      webapp.Name,
             Namespace: webapp.Namespace,
+            Labels:    childLabels(webapp),
+            OwnerReferences: []metav1.OwnerReference{
+                ownerReference(webapp),
+            },
         },
         Spec: appsv1.DeploymentSpec{
             Replicas: &webapp.Spec.Replicas,
@@ -142,6 +139,7 @@ func createDeployment(webapp *WebApp) *appsv1.Deployment {
                             Ports: []corev1.ContainerPort{
                                 {
                                     ContainerPort: webapp.Spec.Port,
+                                    Protocol:      corev1.ProtocolTCP,
                                 },
                             },
                             Resources: createResourceRequirements(webapp.Spec.Resources),
@@ -155,9 +153,14 @@ func createDeployment(webapp *WebApp) *appsv1.Deployment {
 
 func createService(webapp *WebApp) *corev1.Service {
     return &corev1.Service{
+        TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
         ObjectMeta: metav1.ObjectMeta{
             Name:      webapp.Name,
             Namespace: webapp.Namespace,
+            Labels:    childLabels(webapp),
+            OwnerReferences: []metav1.OwnerReference{
+                ownerReference(webapp),
+            },
         },
         Spec: corev1.ServiceSpec{
             Selector: map[string]string{
@@ -165,7 +168,10 @@ func createService(webapp *WebApp) *corev1.Service {
             },
             Ports: []corev1.ServicePort{
                 {
+                    // Port and protocol together key the list under
+                    // server-side apply, so both are set
                     Port:       webapp.Spec.Port,
+                    Protocol:   corev1.ProtocolTCP,
                     TargetPort: intstr.FromInt(int(webapp.Spec.Port)),
                 },
             },
@@ -212,9 +218,14 @@ func createIngress(webapp *WebApp) *networkingv1.Ingress {
     }
 
     return &networkingv1.Ingress{
+        TypeMeta: metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "Ingress"},
         ObjectMeta: metav1.ObjectMeta{
             Name:      webapp.Name,
             Namespace: webapp.Namespace,
+            Labels:    childLabels(webapp),
+            OwnerReferences: []metav1.OwnerReference{
+                ownerReference(webapp),
+            },
         },
         Spec: networkingv1.IngressSpec{
             TLS:   tls,
@@ -0,0 +1,234 @@
+package main
+
+import (
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "path/filepath"
+    "reflect"
+    "strings"
+
+    admissionv1 "k8s.io/api/admission/v1"
+)
+
+// Defaults the mutating webhook fills into WebApps
+const (
+    defaultReplicas      int32 = 1
+    defaultCPURequest          = "100m"
+    defaultMemoryRequest       = "128Mi"
+    managedBy                  = "webapp-controller"
+)
+
+// WebhookServer serves the mutating admission webhook registered by
+// 05-1-webapp-webhook.yaml. It defaults and normalizes WebApps on create
+// and update, before the API server validates them against the CRD schema.
+type WebhookServer struct {
+    addr    string
+    certDir string
+}
+
+func NewWebhookServer(addr, certDir string) *WebhookServer {
+    return &WebhookServer{
+        addr:    addr,
+        certDir: certDir,
+    }
+}
+
+func (s *WebhookServer) Run(stopCh <-chan struct{}) error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/mutate", s.handleMutate)
+
+    server := &http.Server{
+        Addr:      s.addr,
+        Handler:   mux,
+        TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+    }
+    go func() {
+        <-stopCh
+        server.Close()
+    }()
+
+    log.Printf("Serving mutating webhook on %s", s.addr)
+    err := server.ListenAndServeTLS(filepath.Join(s.certDir, "tls.crt"), filepath.Join(s.certDir, "tls.key"))
+    if err != nil && err != http.ErrServerClosed {
+        return err
+    }
+    return nil
+}
+
+func (s *WebhookServer) handleMutate(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var review admissionv1.AdmissionReview
+    if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+        http.Error(w, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+        return
+    }
+    if review.Request == nil {
+        http.Error(w, "admission review has no request", http.StatusBadRequest)
+        return
+    }
+
+    response, err := mutate(review.Request)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    response.UID = review.Request.UID
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(admissionv1.AdmissionReview{
+        TypeMeta: review.TypeMeta,
+        Response: response,
+    })
+}
+
+// mutate answers an admission request with the JSON patch that defaults the
+// WebApp in it
+func mutate(req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, error) {
+    if req.Kind.Kind != "WebApp" {
+        return &admissionv1.AdmissionResponse{Allowed: true}, nil
+    }
+
+    webapp := &WebApp{}
+    if err := json.Unmarshal(req.Object.Raw, webapp); err != nil {
+        return nil, fmt.Errorf("cannot decode webapp: %v", err)
+    }
+    if webapp.Name == "" {
+        webapp.Name = req.Name
+    }
+
+    patch := defaultWebApp(webapp)
+    if len(patch) == 0 {
+        return &admissionv1.AdmissionResponse{Allowed: true}, nil
+    }
+    patchBytes, err := json.Marshal(patch)
+    if err != nil {
+        return nil, err
+    }
+    patchType := admissionv1.PatchTypeJSONPatch
+    return &admissionv1.AdmissionResponse{
+        Allowed:   true,
+        Patch:     patchBytes,
+        PatchType: &patchType,
+    }, nil
+}
+
+type patchOperation struct {
+    Op    string      `json:"op"`
+    Path  string      `json:"path"`
+    Value interface{} `json:"value"`
+}
+
+// defaultWebApp returns the JSON patch operations that fill in what the
+// WebApp leaves out:
+//   - replicas, which would otherwise create a Deployment scaled to zero
+//   - resource requests, taken from the limit when only that is set
+//   - the app.kubernetes.io/name and managed-by labels
+//   - a TLS secret name when SSL is enabled without one
+//   - domains lowercased, without a trailing dot and without duplicates
+// Fields the user did set are never overwritten.
+func defaultWebApp(webapp *WebApp) []patchOperation {
+    var patch []patchOperation
+    add := func(path string, value interface{}) {
+        // "add" replaces the value if the member already exists
+        patch = append(patch, patchOperation{Op: "add", Path: path, Value: value})
+    }
+
+    if webapp.Spec.Replicas == 0 {
+        add("/spec/replicas", defaultReplicas)
+    }
+
+    resources := defaultResources(webapp.Spec.Resources)
+    if !reflect.DeepEqual(resources, webapp.Spec.Resources) {
+        add("/spec/resources", resources)
+    }
+
+    if ssl := webapp.Spec.SSL; ssl != nil && ssl.Enabled && ssl.SecretName == "" && webapp.Name != "" {
+        add("/spec/ssl/secretName", webapp.Name+"-tls")
+    }
+
+    if webapp.Spec.Domains != nil {
+        domains := normalizeDomains(webapp.Spec.Domains)
+        if !reflect.DeepEqual(domains, webapp.Spec.Domains) {
+            add("/spec/domains", domains)
+        }
+    }
+
+    // a generateName WebApp has no name yet to derive the label from
+    labels := map[string]string{managedByLabel: managedBy}
+    keys := []string{managedByLabel}
+    if webapp.Name != "" {
+        labels["app.kubernetes.io/name"] = webapp.Name
+        keys = append([]string{"app.kubernetes.io/name"}, keys...)
+    }
+    if webapp.Labels == nil {
+        add("/metadata/labels", labels)
+    } else {
+        for _, key := range keys {
+            if _, exists := webapp.Labels[key]; !exists {
+                add("/metadata/labels/"+escapeJSONPointer(key), labels[key])
+            }
+        }
+    }
+
+    return patch
+}
+
+// defaultResources fills in missing requests. Like Kubernetes itself, a
+// request defaults to the limit when one is set, so a default request is
+// never above the limit.
+func defaultResources(resources *ResourceRequests) *ResourceRequests {
+    defaulted := &ResourceRequests{Requests: &Resources{}}
+    if resources != nil {
+        if resources.Limits != nil {
+            limits := *resources.Limits
+            defaulted.Limits = &limits
+        }
+        if resources.Requests != nil {
+            requests := *resources.Requests
+            defaulted.Requests = &requests
+        }
+    }
+
+    requests := defaulted.Requests
+    if requests.CPU == "" {
+        requests.CPU = defaultCPURequest
+        if defaulted.Limits != nil && defaulted.Limits.CPU != "" {
+            requests.CPU = defaulted.Limits.CPU
+        }
+    }
+    if requests.Memory == "" {
+        requests.Memory = defaultMemoryRequest
+        if defaulted.Limits != nil && defaulted.Limits.Memory != "" {
+            requests.Memory = defaulted.Limits.Memory
+        }
+    }
+    return defaulted
+}
+
+// normalizeDomains lowercases domains and drops trailing dots, empty
+// entries and duplicates, keeping the first occurrence of each
+func normalizeDomains(domains []string) []string {
+    normalized := make([]string, 0, len(domains))
+    seen := make(map[string]bool, len(domains))
+    for _, domain := range domains {
+        domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+        if domain == "" || seen[domain] {
+            continue
+        }
+        seen[domain] = true
+        normalized = append(normalized, domain)
+    }
+    return normalized
+}
+
+// escapeJSONPointer escapes a key for use as a JSON pointer segment
+func escapeJSONPointer(key string) string {
+    return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
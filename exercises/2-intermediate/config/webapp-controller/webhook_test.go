@@ -0,0 +1,169 @@
+package main
+
+import (
+    "encoding/json"
+    "reflect"
+    "strings"
+    "testing"
+
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDefaultWebApp(t *testing.T) {
+    defaulted := &ResourceRequests{Requests: &Resources{CPU: defaultCPURequest, Memory: defaultMemoryRequest}}
+    labelled := map[string]string{
+        "app.kubernetes.io/name": "web",
+        managedByLabel:           managedBy,
+    }
+
+    tests := []struct {
+        name   string
+        webapp WebApp
+        want   []patchOperation
+    }{
+        {
+            name: "fully set",
+            webapp: WebApp{
+                ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: labelled},
+                Spec:       WebAppSpec{Replicas: 2, Resources: defaulted},
+            },
+        },
+        {
+            name:   "empty",
+            webapp: WebApp{ObjectMeta: metav1.ObjectMeta{Name: "web"}},
+            want: []patchOperation{
+                {Op: "add", Path: "/spec/replicas", Value: defaultReplicas},
+                {Op: "add", Path: "/spec/resources", Value: defaulted},
+                {Op: "add", Path: "/metadata/labels", Value: labelled},
+            },
+        },
+        {
+            name: "generateName",
+            webapp: WebApp{
+                ObjectMeta: metav1.ObjectMeta{GenerateName: "web-"},
+                Spec:       WebAppSpec{Replicas: 1, Resources: defaulted, SSL: &SSLConfig{Enabled: true}},
+            },
+            want: []patchOperation{
+                {Op: "add", Path: "/metadata/labels", Value: map[string]string{managedByLabel: managedBy}},
+            },
+        },
+        {
+            name: "missing labels and secret name",
+            webapp: WebApp{
+                ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"team": "a"}},
+                Spec:       WebAppSpec{Replicas: 1, Resources: defaulted, SSL: &SSLConfig{Enabled: true}},
+            },
+            want: []patchOperation{
+                {Op: "add", Path: "/spec/ssl/secretName", Value: "web-tls"},
+                {Op: "add", Path: "/metadata/labels/app.kubernetes.io~1name", Value: "web"},
+                {Op: "add", Path: "/metadata/labels/app.kubernetes.io~1managed-by", Value: managedBy},
+            },
+        },
+        {
+            name: "domains normalized away",
+            webapp: WebApp{
+                ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: labelled},
+                Spec:       WebAppSpec{Replicas: 1, Resources: defaulted, Domains: []string{"", "."}},
+            },
+            want: []patchOperation{
+                {Op: "add", Path: "/spec/domains", Value: []string{}},
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := defaultWebApp(&tt.webapp)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("defaultWebApp() = %+v, want %+v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestPatchOperationKeepsEmptyValue(t *testing.T) {
+    data, err := json.Marshal(patchOperation{Op: "add", Path: "/spec/domains", Value: []string{}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(string(data), `"value":[]`) {
+        t.Errorf("marshalled patch %s has no value", data)
+    }
+}
+
+func TestDefaultResources(t *testing.T) {
+    tests := []struct {
+        name      string
+        resources *ResourceRequests
+        want      *ResourceRequests
+    }{
+        {
+            name:      "nil",
+            resources: nil,
+            want:      &ResourceRequests{Requests: &Resources{CPU: defaultCPURequest, Memory: defaultMemoryRequest}},
+        },
+        {
+            name:      "limits only",
+            resources: &ResourceRequests{Limits: &Resources{CPU: "50m", Memory: "64Mi"}},
+            want: &ResourceRequests{
+                Limits:   &Resources{CPU: "50m", Memory: "64Mi"},
+                Requests: &Resources{CPU: "50m", Memory: "64Mi"},
+            },
+        },
+        {
+            name: "partial requests",
+            resources: &ResourceRequests{
+                Limits:   &Resources{Memory: "1Gi"},
+                Requests: &Resources{CPU: "200m"},
+            },
+            want: &ResourceRequests{
+                Limits:   &Resources{Memory: "1Gi"},
+                Requests: &Resources{CPU: "200m", Memory: "1Gi"},
+            },
+        },
+        {
+            name:      "requests set",
+            resources: &ResourceRequests{Requests: &Resources{CPU: "1", Memory: "2Gi"}},
+            want:      &ResourceRequests{Requests: &Resources{CPU: "1", Memory: "2Gi"}},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var before ResourceRequests
+            if tt.resources != nil {
+                before = *tt.resources
+            }
+            got := defaultResources(tt.resources)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("defaultResources() = %+v, want %+v", got, tt.want)
+            }
+            if tt.resources != nil && !reflect.DeepEqual(*tt.resources, before) {
+                t.Errorf("defaultResources() modified its input")
+            }
+        })
+    }
+}
+
+func TestNormalizeDomains(t *testing.T) {
+    tests := []struct {
+        name    string
+        domains []string
+        want    []string
+    }{
+        {"unchanged", []string{"example.com", "www.example.com"}, []string{"example.com", "www.example.com"}},
+        {"case and trailing dot", []string{" Example.COM. "}, []string{"example.com"}},
+        {"duplicates", []string{"a.com", "A.com.", "b.com", "a.com"}, []string{"a.com", "b.com"}},
+        {"empty", []string{""}, []string{}},
+        {"root", []string{"."}, []string{}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := normalizeDomains(tt.domains)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("normalizeDomains(%q) = %q, want %q", tt.domains, got, tt.want)
+            }
+        })
+    }
+}
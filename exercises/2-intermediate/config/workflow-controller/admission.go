@@ -0,0 +1,486 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Admission validation catches what the CRD schemas can't express: task
+// names that clash, dependencies on unknown tasks, ${...} expressions that
+// can never resolve, task inputs their handler would refuse and forkTasks
+// that aren't tasks. Every problem carries the path of the field at fault,
+// e.g. spec.tasks[2].inputParameters.job.image.
+
+// FieldError is one problem found by admission validation
+type FieldError struct {
+    Path    string
+    Message string
+}
+
+func (e FieldError) Error() string {
+    if e.Path == "" {
+        return e.Message
+    }
+    return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// AdmissionResult collects the errors and warnings found in one object.
+// Errors deny the request; warnings are shown to the client.
+type AdmissionResult struct {
+    Errors   []FieldError
+    Warnings []string
+}
+
+func (r *AdmissionResult) fail(path, format string, args ...interface{}) {
+    r.Errors = append(r.Errors, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *AdmissionResult) warn(format string, args ...interface{}) {
+    r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// AdmissionValidator runs the semantic checks behind the validating
+// webhook. Task inputs are checked against the handlers registered with the
+// controller; template references against the templates it has loaded.
+type AdmissionValidator struct {
+    registry        *TaskRegistry
+    templateManager *TemplateManager
+}
+
+func NewAdmissionValidator(registry *TaskRegistry, templateManager *TemplateManager) *AdmissionValidator {
+    return &AdmissionValidator{
+        registry:        registry,
+        templateManager: templateManager,
+    }
+}
+
+// ValidateWorkflow checks a Workflow definition
+func (v *AdmissionValidator) ValidateWorkflow(workflow *Workflow) *AdmissionResult {
+    result := &AdmissionResult{}
+    spec := workflow.Spec
+
+    inputs := make(map[string]bool, len(spec.InputParameters))
+    for i, param := range spec.InputParameters {
+        path := fmt.Sprintf("spec.inputParameters[%d]", i)
+        if inputs[param.Name] {
+            result.fail(path+".name", "duplicate input parameter %s", param.Name)
+        }
+        inputs[param.Name] = true
+        if param.Type != "" && param.Default != nil && !matchesFieldType(param.Default, param.Type) {
+            result.fail(path+".default", "must be of type %s", param.Type)
+        }
+    }
+
+    if spec.TemplateRef != nil {
+        v.checkTemplateRef(spec.TemplateRef, result)
+    }
+
+    check := &taskCheck{
+        validator:     v,
+        result:        result,
+        input:         "inputParameters",
+        inputs:        inputs,
+        checkUpstream: true,
+    }
+    check.run(spec.Tasks, "spec.tasks")
+    return result
+}
+
+// ValidateTemplate checks a WorkflowTemplate. Tasks and parameters it
+// inherits are taken from the loaded base template when there is one.
+func (v *AdmissionValidator) ValidateTemplate(template *WorkflowTemplate) *AdmissionResult {
+    result := &AdmissionResult{}
+    spec := template.Spec
+
+    params := make(map[string]bool)
+    inherited := make(map[string]bool)
+    baseKnown := true
+    if spec.Extends != nil {
+        base, err := v.templateManager.ResolveTemplate(spec.Extends)
+        var baseSpec WorkflowTemplateSpec
+        if err == nil {
+            baseSpec, err = v.templateManager.ResolvedSpec(base)
+        }
+        if err != nil {
+            result.warn("spec.extends: %v; inherited tasks and parameters are not checked", err)
+            baseKnown = false
+        }
+        for _, param := range baseSpec.Parameters {
+            params[param.Name] = true
+        }
+        for _, taskTemplate := range baseSpec.Tasks {
+            inherited[taskTemplate.Name] = true
+        }
+        if baseKnown {
+            for _, name := range sortedKeys(spec.Extends.Parameters) {
+                if !params[name] {
+                    result.fail("spec.extends.parameters."+name, "%s is not a parameter of template %s", name, base.Spec.Name)
+                }
+            }
+        }
+    }
+
+    // Declarations only; references are checked below with their paths
+    declarations := &WorkflowTemplate{Spec: WorkflowTemplateSpec{Name: spec.Name, Version: spec.Version, Parameters: spec.Parameters}}
+    if err, ok := validateParameterDeclarations(declarations).(*ParameterValidationError); ok {
+        for _, paramErr := range err.Errors {
+            result.fail(parameterPath(spec.Parameters, paramErr), "%s", paramErr.Reason)
+        }
+    }
+    for _, param := range spec.Parameters {
+        params[param.Name] = true
+    }
+
+    tasks := make([]Task, len(spec.Tasks))
+    for i, taskTemplate := range spec.Tasks {
+        tasks[i] = Task{
+            Name:            taskTemplate.Name,
+            TaskType:        taskTemplate.TaskType,
+            InputParameters: taskTemplate.InputTemplate,
+            DependsOn:       taskTemplate.DependsOn,
+        }
+    }
+
+    check := &taskCheck{
+        validator: v,
+        result:    result,
+        input:     "inputTemplate",
+        template:  true,
+        inherited: inherited,
+        baseKnown: baseKnown,
+        // Inherited tasks can be overridden, so ordering across the
+        // inheritance chain is left to expansion
+        checkUpstream: spec.Extends == nil,
+    }
+    if baseKnown {
+        check.params = params
+    }
+    check.run(tasks, "spec.tasks")
+
+    for i, taskTemplate := range spec.Tasks {
+        if taskTemplate.SubWorkflow == nil {
+            continue
+        }
+        path := fmt.Sprintf("spec.tasks[%d].subWorkflow", i)
+        if _, err := v.templateManager.ResolveTemplate(taskTemplate.SubWorkflow); err != nil {
+            result.warn("%s: %v", path, err)
+        }
+        check.checkExpressions(check.byName[taskTemplate.Name], taskTemplate.SubWorkflow.Parameters, path+".parameters")
+    }
+    return result
+}
+
+// ValidateTemplateDelete refuses to delete a template version that workflow
+// runs still use
+func (v *AdmissionValidator) ValidateTemplateDelete(template *WorkflowTemplate) *AdmissionResult {
+    result := &AdmissionResult{}
+    if users := v.templateManager.Users(template.Spec.Name, template.Spec.Version); len(users) > 0 {
+        result.fail("", "template %s version %d is still used by workflow runs %s", template.Spec.Name, template.Spec.Version, strings.Join(users, ", "))
+    }
+    return result
+}
+
+// checkTemplateRef reports a templateRef that doesn't resolve. Parameter
+// problems are errors for a pinned version and warnings otherwise, since a
+// later version may accept them.
+func (v *AdmissionValidator) checkTemplateRef(ref *TemplateRef, result *AdmissionResult) {
+    template, err := v.templateManager.ResolveTemplate(ref)
+    if err != nil {
+        result.warn("spec.templateRef: %v", err)
+        return
+    }
+    if template.deprecated() {
+        result.warn("spec.templateRef: template %s version %d is deprecated: %s", template.Spec.Name, template.Spec.Version, template.Lifecycle.Message)
+    }
+
+    spec, err := v.templateManager.ResolvedSpec(template)
+    if err != nil {
+        result.warn("spec.templateRef: %v", err)
+        return
+    }
+    _, err = validateParameterValues(&WorkflowTemplate{Spec: spec}, ref.Parameters)
+    paramErr, ok := err.(*ParameterValidationError)
+    if !ok {
+        return
+    }
+    for _, e := range paramErr.Errors {
+        path := "spec.templateRef.parameters." + e.Parameter
+        if ref.Version != 0 {
+            result.fail(path, "%s", e.Reason)
+        } else {
+            result.warn("%s: %s", path, e.Reason)
+        }
+    }
+}
+
+// parameterPath finds the declaration a parameter error is about
+func parameterPath(params []Parameter, paramErr ParameterError) string {
+    seen := 0
+    for i, param := range params {
+        if param.Name != paramErr.Parameter {
+            continue
+        }
+        seen++
+        // A duplicate is reported at its second declaration
+        if seen == 2 || paramErr.Reason != "declared more than once" {
+            return fmt.Sprintf("spec.parameters[%d]", i)
+        }
+    }
+    return "spec.parameters"
+}
+
+// taskSite is a task found in a spec, at the top level or as a fork branch
+type taskSite struct {
+    task Task
+    path string // JSON path of the task
+    top  string // top-level task the site belongs to
+}
+
+// taskCheck validates one list of tasks
+type taskCheck struct {
+    validator *AdmissionValidator
+    result    *AdmissionResult
+    input     string // field holding the task input: inputParameters or inputTemplate
+    template  bool
+
+    inputs    map[string]bool // declared workflow inputs; nil skips the check
+    params    map[string]bool // declared template parameters; nil skips the check
+    inherited map[string]bool // tasks inherited from a base template
+    baseKnown bool            // false if the base template could not be loaded
+    checkUpstream bool
+
+    sites        []taskSite
+    byName       map[string]taskSite
+    dynamicForks map[string]string // dynamic fork -> its top-level task
+    upstream     map[string]map[string]bool
+}
+
+func (c *taskCheck) run(tasks []Task, basePath string) {
+    c.byName = make(map[string]taskSite)
+    c.dynamicForks = make(map[string]string)
+    c.upstream = make(map[string]map[string]bool)
+    if c.inherited == nil {
+        c.inherited = make(map[string]bool)
+    }
+
+    for i, task := range tasks {
+        c.collect(task, fmt.Sprintf("%s[%d]", basePath, i), task.Name)
+    }
+    for _, site := range c.sites {
+        c.checkTask(site)
+    }
+
+    topLevel := make([]Task, 0, len(tasks))
+    for i, task := range tasks {
+        var known []string
+        for j, dep := range task.DependsOn {
+            path := fmt.Sprintf("%s[%d].dependsOn[%d]", basePath, i, j)
+            target, exists := c.byName[dep]
+            switch {
+            case exists && target.top != dep:
+                c.result.fail(path, "%s is a branch of fork %s; depend on the fork task instead", dep, target.top)
+            case exists:
+                known = append(known, dep)
+            case c.inherited[dep] || !c.baseKnown:
+            default:
+                c.result.fail(path, "unknown task %s", dep)
+            }
+        }
+        topLevel = append(topLevel, Task{Name: task.Name, DependsOn: known})
+    }
+
+    // Cycles are only meaningful once every name resolves
+    if len(c.result.Errors) == 0 {
+        if _, err := BuildDAG(topLevel); err != nil {
+            c.result.fail(basePath, "%v", err)
+        }
+    }
+
+    for _, site := range c.sites {
+        input := site.task.InputParameters
+        if site.task.TaskType == "FORK_JOIN" {
+            // Branches are checked as tasks of their own
+            input = make(map[string]interface{}, len(site.task.InputParameters))
+            for k, value := range site.task.InputParameters {
+                if k != "forkTasks" {
+                    input[k] = value
+                }
+            }
+        }
+        c.checkExpressions(site, input, site.path+"."+c.input)
+    }
+}
+
+// collect records a task and, for forks, its branches
+func (c *taskCheck) collect(task Task, path, top string) {
+    switch previous, duplicate := c.byName[task.Name]; {
+    case task.Name == "":
+        c.result.fail(path+".name", "is required")
+    case duplicate:
+        c.result.fail(path+".name", "duplicate task name %s, also used at %s", task.Name, previous.path)
+    default:
+        c.byName[task.Name] = taskSite{task: task, path: path, top: top}
+    }
+    if task.TaskType == "" {
+        c.result.fail(path+".taskType", "is required")
+    }
+    c.sites = append(c.sites, taskSite{task: task, path: path, top: top})
+
+    if task.TaskType == "DYNAMIC_FORK" {
+        c.dynamicForks[task.Name] = top
+    }
+    if task.TaskType != "FORK_JOIN" {
+        return
+    }
+    // A missing or malformed forkTasks is reported by the handler's schema
+    forkTasks, _ := task.InputParameters["forkTasks"].([]interface{})
+    for i, raw := range forkTasks {
+        branchPath := fmt.Sprintf("%s.%s.forkTasks[%d]", path, c.input, i)
+        branch, err := decodeTask(raw)
+        if err != nil {
+            c.result.fail(branchPath, "not a valid task: %v", err)
+            continue
+        }
+        if len(branch.DependsOn) > 0 {
+            c.result.fail(branchPath+".dependsOn", "fork branches cannot declare dependsOn")
+        }
+        branch.Parent = task.Name
+        c.collect(branch, branchPath, top)
+    }
+}
+
+// checkTask checks a task's type and input against its handler
+func (c *taskCheck) checkTask(site taskSite) {
+    task := site.task
+    if task.TaskType == "" {
+        return
+    }
+    if task.TaskType == "SUB_WORKFLOW" {
+        if !c.template {
+            c.result.fail(site.path+".taskType", "SUB_WORKFLOW tasks are only supported in WorkflowTemplates")
+        }
+        // The template manager fills in the input when it inlines the sub-workflow
+        return
+    }
+
+    handler, err := c.validator.registry.Handler(task.TaskType)
+    if err != nil {
+        c.result.fail(site.path+".taskType", "unsupported task type %s", task.TaskType)
+        return
+    }
+    inputPath := site.path + "." + c.input
+    for _, problem := range handler.Schema().Check(task.InputParameters) {
+        c.result.fail(inputPath+"."+problem.Path, "%s", problem.Reason)
+    }
+
+    branchCount := -1
+    switch task.TaskType {
+    case "FORK_JOIN":
+        forkTasks, _ := task.InputParameters["forkTasks"].([]interface{})
+        branchCount = len(forkTasks)
+    case "DYNAMIC_FORK":
+    default:
+        return
+    }
+    if _, err := parseJoinPolicy(task, branchCount); err != nil {
+        field := ".joinPolicy"
+        if strings.Contains(err.Error(), "joinCount") {
+            field = ".joinCount"
+        }
+        c.result.fail(inputPath+field, "%v", err)
+    }
+}
+
+// checkExpressions reports ${...} expressions in value that can't resolve
+// when the task at site runs
+func (c *taskCheck) checkExpressions(site taskSite, value interface{}, basePath string) {
+    refs, err := FindReferences(value, basePath)
+    if exprErr, ok := err.(*ExpressionError); ok {
+        for _, refErr := range exprErr.Errors {
+            c.result.fail(refErr.Path, "%s: %s", refErr.Expression, refErr.Reason)
+        }
+    }
+
+    for _, path := range sortedReferencePaths(refs) {
+        for _, ref := range refs[path] {
+            c.checkReference(site, path, ref)
+        }
+    }
+}
+
+func (c *taskCheck) checkReference(site taskSite, path string, ref Reference) {
+    switch ref.Kind {
+    case RefParameter:
+        // ${item} and ${index} are bound per branch of a dynamic fork
+        forkTemplate := site.path + "." + c.input + ".forkTemplate"
+        if site.task.TaskType == "DYNAMIC_FORK" && strings.HasPrefix(path, forkTemplate) && (ref.Name == "item" || ref.Name == "index") {
+            return
+        }
+        if !c.template {
+            c.result.fail(path, "unknown parameter %s; workflows can reference ${workflow.input.<field>} and ${<task>.output.<field>}", ref.Name)
+            return
+        }
+        if c.params != nil && !c.params[ref.Name] {
+            c.result.fail(path, "unknown parameter %s", ref.Name)
+        }
+
+    case RefWorkflowInput:
+        if c.inputs != nil && len(ref.Path) > 0 && !c.inputs[ref.Path[0]] {
+            c.result.fail(path, "workflow input %s is not declared in spec.inputParameters", ref.Path[0])
+        }
+
+    case RefTaskOutput:
+        var targetTop string
+        if target, exists := c.byName[ref.Task]; exists {
+            targetTop = target.top
+        } else if fork, ok := c.dynamicBranchFork(ref.Task); ok {
+            targetTop = c.dynamicForks[fork]
+        } else if c.inherited[ref.Task] || !c.baseKnown {
+            return
+        } else {
+            c.result.fail(path, "unknown task %s", ref.Task)
+            return
+        }
+
+        if !c.checkUpstream {
+            return
+        }
+        if targetTop == site.top || !c.upstreamOf(site.top)[targetTop] {
+            c.result.fail(path, "task %s is not guaranteed to finish before %s starts; add %s to dependsOn", ref.Task, site.task.Name, targetTop)
+        }
+    }
+}
+
+// dynamicBranchFork recognizes the <fork>-<index> branches of dynamic forks
+func (c *taskCheck) dynamicBranchFork(name string) (string, bool) {
+    i := strings.LastIndex(name, "-")
+    if i < 0 {
+        return "", false
+    }
+    if _, err := strconv.Atoi(name[i+1:]); err != nil {
+        return "", false
+    }
+    _, isFork := c.dynamicForks[name[:i]]
+    return name[:i], isFork
+}
+
+// upstreamOf returns every top-level task that must finish before name starts
+func (c *taskCheck) upstreamOf(name string) map[string]bool {
+    if upstream, done := c.upstream[name]; done {
+        return upstream
+    }
+    upstream := make(map[string]bool)
+    // Guards against cycles, which are reported separately
+    c.upstream[name] = upstream
+    for _, dep := range c.byName[name].task.DependsOn {
+        if _, exists := c.byName[dep]; !exists || upstream[dep] {
+            continue
+        }
+        upstream[dep] = true
+        for ancestor := range c.upstreamOf(dep) {
+            upstream[ancestor] = true
+        }
+    }
+    return upstream
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "context"
+    "fmt"
+
+    "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/client-go/dynamic"
+    "k8s.io/client-go/util/retry"
+)
+
+// checkpointError marks a failure to persist workflow status, as opposed to a
+// failure of the workflow itself
+type checkpointError struct {
+    err error
+}
+
+func (e *checkpointError) Error() string {
+    return fmt.Sprintf("failed to checkpoint workflow status: %v", e.err)
+}
+
+// workflowCheckpointer is the TaskTracker used by the controller. Status
+// changes are made by the StatusManager and every task transition is written
+// through the status subresource before the scheduler moves on, so a
+// restarted controller resumes from the last recorded state instead of
+// starting over.
+type workflowCheckpointer struct {
+    client        dynamic.ResourceInterface
+    outputStore   *OutputStore
+    run           *WorkflowRun
+    statusManager *StatusManager
+}
+
+func newWorkflowCheckpointer(client dynamic.ResourceInterface, outputStore *OutputStore, run *WorkflowRun) *workflowCheckpointer {
+    return &workflowCheckpointer{
+        client:        client,
+        outputStore:   outputStore,
+        run:           run,
+        statusManager: NewStatusManager(run),
+    }
+}
+
+// Initialize records the start of a workflow that has never run
+func (cp *workflowCheckpointer) Initialize() error {
+    if cp.run.Status.Phase != "" {
+        return nil
+    }
+    cp.statusManager.InitializeWorkflow()
+    return cp.persist()
+}
+
+// Reject records why the run cannot start
+func (cp *workflowCheckpointer) Reject(reason string, err error) error {
+    cp.statusManager.Reject(reason, err)
+    return cp.persist()
+}
+
+func (cp *workflowCheckpointer) TaskPhase(name string) string {
+    return cp.statusManager.TaskPhase(name)
+}
+
+// TaskOutput returns the recorded output of a finished task, reading it back
+// from its ConfigMap or Secret when it was too large to inline
+func (cp *workflowCheckpointer) TaskOutput(name string) (map[string]interface{}, error) {
+    taskStatus := cp.statusManager.taskStatus(name)
+    if taskStatus == nil {
+        return nil, nil
+    }
+    if taskStatus.OutputRef == nil {
+        return taskStatus.Output, nil
+    }
+
+    output, err := cp.outputStore.Load(cp.run.Namespace, taskStatus.OutputRef)
+    if err != nil {
+        return nil, &checkpointError{err: fmt.Errorf("failed to load output of task %s: %v", name, err)}
+    }
+    return output, nil
+}
+
+func (cp *workflowCheckpointer) TaskStarted(task Task) error {
+    cp.statusManager.StartTask(task)
+    return cp.persist()
+}
+
+func (cp *workflowCheckpointer) TaskFinished(task Task, output map[string]interface{}, err error) error {
+    if err == nil {
+        inline, ref, saveErr := cp.outputStore.Save(cp.run, task, output)
+        if saveErr != nil {
+            return &checkpointError{err: saveErr}
+        }
+        cp.statusManager.SetTaskOutput(task.Name, inline, ref)
+    }
+
+    cp.statusManager.CompleteTask(task.Name, err)
+    return cp.persist()
+}
+
+// RecordTimeout applies the workflow's timeout policy to the status and
+// persists it. A failed write is returned as a checkpointError, otherwise the
+// error is the policy's own, e.g. a TIME_OUT failing the workflow.
+func (cp *workflowCheckpointer) RecordTimeout() error {
+    policyErr := cp.statusManager.HandleTimeout()
+    if err := cp.persist(); err != nil {
+        return err
+    }
+    return policyErr
+}
+
+// persist writes the in-memory status back to the API server. On a conflict
+// the latest object is fetched and the status is reapplied on top of it, as
+// long as the server does not know of progress this copy is missing; in that
+// case our copy came from a stale cache and the sync must start over.
+func (cp *workflowCheckpointer) persist() error {
+    err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+        content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(cp.run)
+        if err != nil {
+            return err
+        }
+
+        updated, err := cp.client.UpdateStatus(context.Background(), &unstructured.Unstructured{Object: content}, metav1.UpdateOptions{})
+        if err == nil {
+            cp.run.ResourceVersion = updated.GetResourceVersion()
+            return nil
+        }
+        if !errors.IsConflict(err) {
+            return err
+        }
+
+        latest, getErr := cp.client.Get(context.Background(), cp.run.Name, metav1.GetOptions{})
+        if getErr != nil {
+            return getErr
+        }
+        latestRun, getErr := runFromObject(latest)
+        if getErr != nil {
+            return getErr
+        }
+        if staleErr := cp.checkNotStale(latestRun); staleErr != nil {
+            return staleErr
+        }
+
+        cp.run.ResourceVersion = latestRun.ResourceVersion
+        return err
+    })
+    if err != nil {
+        return &checkpointError{err: err}
+    }
+    return nil
+}
+
+// checkNotStale fails if the server records a task as finished that this
+// copy of the workflow does not
+func (cp *workflowCheckpointer) checkNotStale(latest *WorkflowRun) error {
+    latestStatus := NewStatusManager(latest)
+    for _, task := range cp.run.Workflow.Spec.Tasks {
+        switch latestStatus.TaskPhase(task.Name) {
+        case PhaseCompleted, PhaseFailed:
+            if cp.TaskPhase(task.Name) == PhaseRunning || cp.TaskPhase(task.Name) == "" {
+                return fmt.Errorf("task %s already finished on the server, local copy is stale", task.Name)
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+)
+
+// DAG is the dependency graph of a workflow's tasks, built from Task.DependsOn.
+// The branches of FORK_JOIN tasks are expanded into nodes of their own; a
+// branch becomes ready once its fork has started, and the fork completes
+// when its join policy is decided.
+type DAG struct {
+    tasks    map[string]Task
+    paths    map[string]string     // JSON path of each task's inputParameters, for error messages
+    branches map[string][]string   // fork task -> branch tasks
+    joins    map[string]JoinPolicy // fork task -> join policy
+    order    []string              // topological order, ties broken by position in the spec
+}
+
+// BuildDAG validates the task dependencies and returns the resulting graph.
+// Duplicate task names (including fork branches), references to unknown
+// tasks, cycles and malformed forks are rejected.
+func BuildDAG(tasks []Task) (*DAG, error) {
+    dag := &DAG{
+        tasks:    make(map[string]Task, len(tasks)),
+        paths:    make(map[string]string, len(tasks)),
+        branches: make(map[string][]string),
+        joins:    make(map[string]JoinPolicy),
+    }
+
+    for i, task := range tasks {
+        if err := dag.addTask(task, fmt.Sprintf("spec.tasks[%d]", i)); err != nil {
+            return nil, err
+        }
+    }
+
+    for _, task := range tasks {
+        for _, dep := range task.DependsOn {
+            if _, exists := dag.tasks[dep]; !exists {
+                return nil, fmt.Errorf("task %s depends on unknown task %s", task.Name, dep)
+            }
+            if dag.tasks[dep].Parent != "" {
+                return nil, fmt.Errorf("task %s depends on fork branch %s; depend on its fork task %s instead", task.Name, dep, dag.tasks[dep].Parent)
+            }
+        }
+    }
+
+    // Depth-first search in spec order; a task reached again while it is
+    // still on the stack closes a cycle.
+    const (
+        unvisited = iota
+        visiting
+        visited
+    )
+    marks := make(map[string]int, len(tasks))
+    var stack []string
+
+    var visit func(name string) error
+    visit = func(name string) error {
+        switch marks[name] {
+        case visited:
+            return nil
+        case visiting:
+            start := 0
+            for i, n := range stack {
+                if n == name {
+                    start = i
+                }
+            }
+            cycle := append(append([]string{}, stack[start:]...), name)
+            return fmt.Errorf("dependency cycle detected: %s", strings.Join(cycle, " -> "))
+        }
+
+        marks[name] = visiting
+        stack = append(stack, name)
+        for _, dep := range dag.tasks[name].DependsOn {
+            if err := visit(dep); err != nil {
+                return err
+            }
+        }
+        stack = stack[:len(stack)-1]
+        marks[name] = visited
+        dag.appendWithBranches(name)
+        return nil
+    }
+
+    for _, task := range tasks {
+        if err := visit(task.Name); err != nil {
+            return nil, err
+        }
+    }
+
+    return dag, nil
+}
+
+// addTask registers a task and, for forks, its branches recursively
+func (d *DAG) addTask(task Task, path string) error {
+    if _, exists := d.tasks[task.Name]; exists {
+        return fmt.Errorf("duplicate task name %s", task.Name)
+    }
+    d.tasks[task.Name] = task
+    d.paths[task.Name] = path + ".inputParameters"
+
+    switch task.TaskType {
+    case "FORK_JOIN":
+    case "DYNAMIC_FORK":
+        // Branches are only known once the item list is resolved
+        policy, err := parseJoinPolicy(task, -1)
+        if err != nil {
+            return err
+        }
+        d.joins[task.Name] = policy
+        return nil
+    default:
+        return nil
+    }
+
+    branches, err := parseForkBranches(task)
+    if err != nil {
+        return err
+    }
+    policy, err := parseJoinPolicy(task, len(branches))
+    if err != nil {
+        return err
+    }
+    d.joins[task.Name] = policy
+
+    for i, branch := range branches {
+        if err := d.addTask(branch, fmt.Sprintf("%s.inputParameters.forkTasks[%d]", path, i)); err != nil {
+            return err
+        }
+        d.branches[task.Name] = append(d.branches[task.Name], branch.Name)
+    }
+    return nil
+}
+
+// appendWithBranches adds a task to the order followed by its fork branches
+func (d *DAG) appendWithBranches(name string) {
+    d.order = append(d.order, name)
+    for _, branch := range d.branches[name] {
+        d.appendWithBranches(branch)
+    }
+}
+
+// Tasks returns every task in the graph, fork branches included
+func (d *DAG) Tasks() []Task {
+    tasks := make([]Task, 0, len(d.order))
+    for _, name := range d.order {
+        tasks = append(tasks, d.tasks[name])
+    }
+    return tasks
+}
+
+func (d *DAG) isFork(name string) bool {
+    _, isFork := d.joins[name]
+    return isFork
+}
+
+// ready reports whether every dependency of the task has finished in a way
+// that lets dependents proceed. A failed optional dependency counts as
+// finished; see failedOptional. Fork branches only wait for their fork to
+// start.
+func (d *DAG) ready(name string, phases map[string]string) bool {
+    if parent := d.tasks[name].Parent; parent != "" {
+        return phases[parent] == PhaseRunning
+    }
+
+    for _, dep := range d.tasks[name].DependsOn {
+        switch phases[dep] {
+        case PhaseCompleted:
+        case PhaseFailed:
+            if !d.tasks[dep].Optional {
+                return false
+            }
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+// failedOptional returns the optional tasks that failed. Their dependents
+// still run, with references to their output resolving to null.
+func (d *DAG) failedOptional(phases map[string]string) map[string]bool {
+    failed := make(map[string]bool)
+    for name, phase := range phases {
+        if phase == PhaseFailed && d.tasks[name].Optional {
+            failed[name] = true
+        }
+    }
+    return failed
+}
+
+// Scheduler runs the tasks of a DAG, starting every task whose dependencies
+// are satisfied as soon as a slot is free
+type Scheduler struct {
+    executor    TaskExecutor
+    maxParallel int
+}
+
+func NewScheduler(executor TaskExecutor, maxParallel int) *Scheduler {
+    if maxParallel < 1 {
+        maxParallel = 1
+    }
+    return &Scheduler{
+        executor:    executor,
+        maxParallel: maxParallel,
+    }
+}
+
+// TaskTracker records task transitions. The scheduler calls it from a single
+// goroutine, so implementations need no locking.
+type TaskTracker interface {
+    // TaskPhase returns the last recorded phase of a task, or "" if it never ran
+    TaskPhase(name string) string
+    // TaskOutput returns the recorded output of a finished task
+    TaskOutput(name string) (map[string]interface{}, error)
+    TaskStarted(task Task) error
+    TaskFinished(task Task, output map[string]interface{}, err error) error
+}
+
+type taskResult struct {
+    name   string
+    output map[string]interface{}
+    err    error
+}
+
+// Run executes the workflow's tasks, skipping those the tracker already
+// records as finished. After the first failure of a non-optional top-level
+// task, or the first error from the tracker, no new tasks are started; tasks
+// already running are waited for before the error is returned. Failures of
+// fork branches are left to the fork's join policy.
+//
+// Cancelling ctx cancels every running task and stops new ones from
+// starting; if nothing else failed first, ctx's error is returned once the
+// running tasks have finished.
+func (s *Scheduler) Run(ctx context.Context, dag *DAG, run *WorkflowRun, tracker TaskTracker) error {
+    phases := make(map[string]string, len(dag.order))
+    // Dynamic forks grow the graph, so size the buffer by the tasks that
+    // can be in flight rather than by the initial order
+    results := make(chan taskResult, s.maxParallel)
+    outputs := make(map[string]map[string]interface{})
+    running := 0
+
+    firstErr := s.restorePhases(dag, tracker, phases, outputs)
+    if _, ok := firstErr.(*checkpointError); ok {
+        return firstErr
+    }
+
+    for {
+        progressed := false
+
+        if firstErr == nil && ctx.Err() == nil {
+            for _, name := range dag.order {
+                if running >= s.maxParallel {
+                    break
+                }
+                if phases[name] != "" || !dag.ready(name, phases) {
+                    continue
+                }
+
+                task := dag.tasks[name]
+                if err := tracker.TaskStarted(task); err != nil {
+                    firstErr = err
+                    break
+                }
+                phases[name] = PhaseRunning
+                progressed = true
+
+                // A fork does no work itself and takes no slot; starting it
+                // releases its branches
+                if dag.isFork(name) {
+                    if task.TaskType != "DYNAMIC_FORK" {
+                        continue
+                    }
+                    err := dag.expandDynamicFork(name, ExpressionContext{
+                        WorkflowInput: run.Input,
+                        TaskOutputs:   outputs,
+                        FailedTasks:   dag.failedOptional(phases),
+                    })
+                    if err == nil {
+                        // Branches finished before a restart keep their results
+                        err = s.restorePhases(dag, tracker, phases, outputs)
+                        if _, ok := err.(*checkpointError); ok {
+                            firstErr = err
+                            break
+                        }
+                    }
+                    if err != nil {
+                        if err := s.finishTask(dag, run, tracker, name, nil, err, phases, outputs); err != nil {
+                            firstErr = err
+                        }
+                    }
+                    // The order changed; rescan it before starting anything else
+                    break
+                }
+
+                running++
+
+                // Inputs are resolved here, on the scheduling goroutine, so
+                // references see the outputs of every finished upstream task
+                resolved, err := ResolveExpressions(task.InputParameters, ExpressionContext{
+                    WorkflowInput: run.Input,
+                    TaskOutputs:   outputs,
+                    FailedTasks:   dag.failedOptional(phases),
+                }, dag.paths[name])
+                if err != nil {
+                    results <- taskResult{name: name, err: err}
+                    continue
+                }
+                task.InputParameters = resolved
+
+                go func(task Task) {
+                    taskCtx, cancel := taskContext(ctx, task)
+                    defer cancel()
+
+                    output, err := s.executor.ExecuteTask(taskCtx, task, run)
+                    if err != nil && ctx.Err() == nil && taskCtx.Err() == context.DeadlineExceeded {
+                        err = fmt.Errorf("task timed out after %d seconds: %v", task.TimeoutSeconds, err)
+                    }
+                    results <- taskResult{name: task.Name, output: output, err: err}
+                }(task)
+            }
+        }
+
+        // Innermost forks come last in the order, so walking it backwards
+        // lets a nested join settle before its parent is evaluated
+        for i := len(dag.order) - 1; i >= 0; i-- {
+            name := dag.order[i]
+            if !dag.isFork(name) || phases[name] != PhaseRunning {
+                continue
+            }
+            decided, joinErr := dag.evaluateJoin(name, phases)
+            if !decided {
+                continue
+            }
+            progressed = true
+
+            var output map[string]interface{}
+            if joinErr == nil {
+                output = dag.joinOutput(name, outputs)
+            }
+            if err := s.finishTask(dag, run, tracker, name, output, joinErr, phases, outputs); err != nil && firstErr == nil {
+                firstErr = err
+            }
+        }
+
+        // Keep scheduling while state is changing; only wait for a result
+        // once nothing else can start
+        if progressed && firstErr == nil {
+            continue
+        }
+        if running == 0 {
+            if firstErr == nil {
+                firstErr = ctx.Err()
+            }
+            return firstErr
+        }
+
+        result := <-results
+        running--
+
+        if err := s.finishTask(dag, run, tracker, result.name, result.output, result.err, phases, outputs); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+}
+
+// taskContext bounds a task by its timeoutSeconds, within whatever deadline
+// the workflow's context already carries
+func taskContext(ctx context.Context, task Task) (context.Context, context.CancelFunc) {
+    if task.TimeoutSeconds > 0 {
+        return context.WithTimeout(ctx, time.Duration(task.TimeoutSeconds)*time.Second)
+    }
+    return context.WithCancel(ctx)
+}
+
+// restorePhases loads the recorded phase and output of every task not yet
+// known to this run. It returns the error of a non-optional top-level task
+// that already failed, or a checkpointError if an output can't be loaded.
+func (s *Scheduler) restorePhases(dag *DAG, tracker TaskTracker, phases map[string]string, outputs map[string]map[string]interface{}) error {
+    var failed error
+    for _, name := range dag.order {
+        if phases[name] != "" {
+            continue
+        }
+        switch phase := tracker.TaskPhase(name); phase {
+        case PhaseCompleted:
+            output, err := tracker.TaskOutput(name)
+            if err != nil {
+                return err
+            }
+            phases[name] = phase
+            outputs[name] = output
+        case PhaseFailed:
+            phases[name] = phase
+            task := dag.tasks[name]
+            if !task.Optional && task.Parent == "" && failed == nil {
+                failed = fmt.Errorf("task %s previously failed", name)
+            }
+        }
+    }
+    return failed
+}
+
+// finishTask records the outcome of a task and returns the error that should
+// stop the workflow, if any
+func (s *Scheduler) finishTask(dag *DAG, run *WorkflowRun, tracker TaskTracker, name string, output map[string]interface{}, taskErr error, phases map[string]string, outputs map[string]map[string]interface{}) error {
+    task := dag.tasks[name]
+    if err := tracker.TaskFinished(task, output, taskErr); err != nil {
+        return err
+    }
+
+    if taskErr == nil {
+        phases[name] = PhaseCompleted
+        outputs[name] = output
+        return nil
+    }
+
+    phases[name] = PhaseFailed
+    if task.Parent != "" {
+        log.Printf("Branch %s of fork %s in workflow run %s failed: %v", name, task.Parent, run.Name, taskErr)
+        return nil
+    }
+    if task.Optional {
+        log.Printf("Optional task %s of workflow run %s failed: %v", name, run.Name, taskErr)
+        return nil
+    }
+    return fmt.Errorf("failed to execute task %s: %v", name, taskErr)
+}
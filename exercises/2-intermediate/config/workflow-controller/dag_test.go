@@ -0,0 +1,223 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+
+    "sigs.k8s.io/yaml"
+)
+
+func TestBuildDAG(t *testing.T) {
+    tests := []struct {
+        name    string
+        tasks   []Task
+        order   []string
+        wantErr string
+    }{
+        {
+            name: "dependencies come first",
+            tasks: []Task{
+                {Name: "publish", TaskType: "SIMPLE", DependsOn: []string{"encode", "thumbnails"}},
+                {Name: "encode", TaskType: "SIMPLE", DependsOn: []string{"extract"}},
+                {Name: "extract", TaskType: "SIMPLE"},
+                {Name: "thumbnails", TaskType: "SIMPLE", DependsOn: []string{"extract"}},
+            },
+            order: []string{"extract", "encode", "thumbnails", "publish"},
+        },
+        {
+            name: "fork branches follow their fork",
+            tasks: []Task{
+                {Name: "transcode", TaskType: "FORK_JOIN", InputParameters: map[string]interface{}{
+                    "forkTasks": []interface{}{
+                        map[string]interface{}{"name": "hd", "taskType": "SIMPLE"},
+                        map[string]interface{}{"name": "sd", "taskType": "SIMPLE"},
+                    },
+                }},
+                {Name: "publish", TaskType: "SIMPLE", DependsOn: []string{"transcode"}},
+            },
+            order: []string{"transcode", "hd", "sd", "publish"},
+        },
+        {
+            name: "unknown dependency",
+            tasks: []Task{
+                {Name: "encode", TaskType: "SIMPLE", DependsOn: []string{"extract"}},
+            },
+            wantErr: "task encode depends on unknown task extract",
+        },
+        {
+            name: "self dependency",
+            tasks: []Task{
+                {Name: "encode", TaskType: "SIMPLE", DependsOn: []string{"encode"}},
+            },
+            wantErr: "dependency cycle detected: encode -> encode",
+        },
+        {
+            name: "cycle",
+            tasks: []Task{
+                {Name: "a", TaskType: "SIMPLE", DependsOn: []string{"c"}},
+                {Name: "b", TaskType: "SIMPLE", DependsOn: []string{"a"}},
+                {Name: "c", TaskType: "SIMPLE", DependsOn: []string{"b"}},
+                {Name: "d", TaskType: "SIMPLE"},
+            },
+            wantErr: "dependency cycle detected: a -> c -> b -> a",
+        },
+        {
+            name: "duplicate name",
+            tasks: []Task{
+                {Name: "encode", TaskType: "SIMPLE"},
+                {Name: "encode", TaskType: "SIMPLE"},
+            },
+            wantErr: "duplicate task name encode",
+        },
+        {
+            name: "dependency on a fork branch",
+            tasks: []Task{
+                {Name: "transcode", TaskType: "FORK_JOIN", InputParameters: map[string]interface{}{
+                    "forkTasks": []interface{}{
+                        map[string]interface{}{"name": "hd", "taskType": "SIMPLE"},
+                    },
+                }},
+                {Name: "publish", TaskType: "SIMPLE", DependsOn: []string{"hd"}},
+            },
+            wantErr: "task publish depends on fork branch hd",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dag, err := BuildDAG(tt.tasks)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("got error %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if strings.Join(dag.order, ",") != strings.Join(tt.order, ",") {
+                t.Errorf("order %v, want %v", dag.order, tt.order)
+            }
+        })
+    }
+}
+
+// fakeExecutor answers each task with a canned output, or fails it
+type fakeExecutor struct {
+    outputs map[string]map[string]interface{}
+    fail    map[string]bool
+    inputs  map[string]map[string]interface{}
+    mutex   sync.Mutex
+}
+
+func (e *fakeExecutor) ExecuteTask(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    e.inputs[task.Name] = task.InputParameters
+    if e.fail[task.Name] {
+        return nil, fmt.Errorf("%s failed", task.Name)
+    }
+    return e.outputs[task.Name], nil
+}
+
+func (e *fakeExecutor) ValidateTask(task Task) error {
+    return nil
+}
+
+// fakeTracker keeps task phases and outputs in memory
+type fakeTracker struct {
+    phases  map[string]string
+    outputs map[string]map[string]interface{}
+}
+
+func (t *fakeTracker) TaskPhase(name string) string {
+    return t.phases[name]
+}
+
+func (t *fakeTracker) TaskOutput(name string) (map[string]interface{}, error) {
+    return t.outputs[name], nil
+}
+
+func (t *fakeTracker) TaskStarted(task Task) error {
+    t.phases[task.Name] = PhaseRunning
+    return nil
+}
+
+func (t *fakeTracker) TaskFinished(task Task, output map[string]interface{}, err error) error {
+    if err != nil {
+        t.phases[task.Name] = PhaseFailed
+        return nil
+    }
+    t.phases[task.Name] = PhaseCompleted
+    t.outputs[task.Name] = output
+    return nil
+}
+
+// TestSchedulerRunsExample runs the video-processing example workflow with
+// its optional thumbnails task failing
+func TestSchedulerRunsExample(t *testing.T) {
+    data, err := os.ReadFile("../05-3-netflix-workflow-example.yaml")
+    if err != nil {
+        t.Fatalf("failed to read example: %v", err)
+    }
+    var workflow Workflow
+    if err := yaml.Unmarshal([]byte(strings.Split(string(data), "\n---\n")[0]), &workflow); err != nil {
+        t.Fatalf("failed to parse example: %v", err)
+    }
+    dag, err := BuildDAG(workflow.Spec.Tasks)
+    if err != nil {
+        t.Fatalf("failed to build DAG: %v", err)
+    }
+
+    lambdaOutput := func(location string) map[string]interface{} {
+        return map[string]interface{}{
+            "statusCode": int64(200),
+            "payload":    map[string]interface{}{"location": location},
+        }
+    }
+    executor := &fakeExecutor{
+        outputs: map[string]map[string]interface{}{
+            "validate-media":   {"statusCode": int64(200)},
+            "extract-metadata": {"metadata": map[string]interface{}{"duration": 5400.0}},
+            "transcode-4k":     lambdaOutput("s3://media/m1/4k.mp4"),
+            "transcode-1080p":  lambdaOutput("s3://media/m1/1080p.mp4"),
+            "transcode-720p":   lambdaOutput("s3://media/m1/720p.mp4"),
+            "update-catalog":   {"statusCode": int64(200)},
+        },
+        fail:   map[string]bool{"create-thumbnails": true},
+        inputs: make(map[string]map[string]interface{}),
+    }
+    tracker := &fakeTracker{phases: make(map[string]string), outputs: make(map[string]map[string]interface{})}
+    run := &WorkflowRun{
+        Workflow: &workflow,
+        Input:    map[string]interface{}{"mediaId": "m1", "mediaPath": "s3://uploads/m1.mov"},
+    }
+    run.Name = "video-processing-1"
+
+    if err := NewScheduler(executor, 4).Run(context.Background(), dag, run, tracker); err != nil {
+        t.Fatalf("workflow failed: %v", err)
+    }
+    if phase := tracker.phases["update-catalog"]; phase != PhaseCompleted {
+        t.Fatalf("update-catalog is %s, want %s", phase, PhaseCompleted)
+    }
+
+    http, _ := executor.inputs["update-catalog"]["http"].(map[string]interface{})
+    want := map[string]interface{}{
+        "mediaId":  "m1",
+        "metadata": map[string]interface{}{"duration": 5400.0},
+        "variants": map[string]interface{}{
+            "4k":    "s3://media/m1/4k.mp4",
+            "1080p": "s3://media/m1/1080p.mp4",
+            "720p":  "s3://media/m1/720p.mp4",
+        },
+        "thumbnails": nil,
+    }
+    if !reflect.DeepEqual(http["body"], want) {
+        t.Errorf("update-catalog body %#v, want %#v", http["body"], want)
+    }
+}
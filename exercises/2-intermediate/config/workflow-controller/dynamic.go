@@ -0,0 +1,180 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "time"
+)
+
+// DYNAMIC tasks pick their concrete task definition at execution time. The
+// dynamicTask parameter is resolved like any other input, so it can come from
+// the workflow input or an upstream output:
+//
+//     - name: notify
+//       taskType: DYNAMIC
+//       inputParameters:
+//         dynamicTask:
+//           taskType: "${workflow.input.notifier}"
+//           inputParameters:
+//             message: "${transcode.output.summary}"
+//
+// DYNAMIC_FORK tasks fan out over a list produced upstream, creating one
+// branch per item from forkTemplate. ${item} and ${index} refer to the
+// current element; branches are named <fork>-<index> and joined like the
+// branches of a FORK_JOIN:
+//
+//     - name: transcode
+//       taskType: DYNAMIC_FORK
+//       inputParameters:
+//         items: "${workflow.input.resolutions}"
+//         joinPolicy: ALL
+//         forkTemplate:
+//           taskType: LAMBDA
+//           inputParameters:
+//             quality: "${item}"
+
+var dynamicParameterSchema = &ParameterSchema{
+    Fields: []ParameterField{
+        {Path: "dynamicTask", Required: true},
+    },
+}
+
+var dynamicForkParameterSchema = &ParameterSchema{
+    Fields: []ParameterField{
+        {Path: "items", Required: true},
+        {Path: "forkTemplate", Type: FieldTypeObject, Required: true},
+        {Path: "forkTemplate.taskType", Type: FieldTypeString, Required: true},
+        {Path: "joinPolicy", Type: FieldTypeString, Enum: []string{JoinAll, JoinAllRequired, JoinAny, JoinNOfM}},
+        {Path: "joinCount", Type: FieldTypeNumber},
+    },
+}
+
+// decodeTask converts a generic map into a Task
+func decodeTask(value interface{}) (Task, error) {
+    var task Task
+    data, err := json.Marshal(value)
+    if err != nil {
+        return task, err
+    }
+    err = json.Unmarshal(data, &task)
+    return task, err
+}
+
+// executeDynamicTask runs the task definition carried in the resolved
+// dynamicTask parameter under the DYNAMIC task's own name
+func (e *DefaultTaskExecutor) executeDynamicTask(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+    definition, ok := task.InputParameters["dynamicTask"].(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("dynamicTask of task %s did not resolve to a task definition", task.Name)
+    }
+
+    concrete, err := decodeTask(definition)
+    if err != nil {
+        return nil, fmt.Errorf("invalid dynamicTask of task %s: %v", task.Name, err)
+    }
+    switch concrete.TaskType {
+    case "":
+        return nil, fmt.Errorf("dynamicTask of task %s has no taskType", task.Name)
+    case "FORK_JOIN", "DYNAMIC_FORK":
+        return nil, fmt.Errorf("dynamicTask of task %s cannot be a %s; use DYNAMIC_FORK", task.Name, concrete.TaskType)
+    }
+
+    // The concrete task inherits everything it doesn't override
+    concrete.Name = task.Name
+    if _, set := definition["retryCount"]; !set {
+        concrete.RetryCount = task.RetryCount
+    }
+    if _, set := definition["retryLogic"]; !set {
+        concrete.RetryLogic = task.RetryLogic
+    }
+    if _, set := definition["timeoutSeconds"]; !set {
+        concrete.TimeoutSeconds = task.TimeoutSeconds
+    } else if concrete.TimeoutSeconds > 0 {
+        // The scheduler only applied the DYNAMIC task's own timeout
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, time.Duration(concrete.TimeoutSeconds)*time.Second)
+        defer cancel()
+    }
+    concrete.Optional = task.Optional
+    concrete.SensitiveOutput = task.SensitiveOutput
+    concrete.Parent = task.Parent
+
+    return e.ExecuteTask(ctx, concrete, run)
+}
+
+// expandDynamicFork creates the branches of a started DYNAMIC_FORK from its
+// resolved item list and adds them to the DAG. Branch names depend only on
+// the item position, so a resumed workflow expands to the same branches.
+func (d *DAG) expandDynamicFork(fork string, ctx ExpressionContext) error {
+    task := d.tasks[fork]
+
+    // Branch inputs are resolved again when each branch starts
+    ctx.KeepEscapes = true
+    resolved, err := ResolveExpressions(map[string]interface{}{
+        "items": task.InputParameters["items"],
+    }, ctx, d.paths[fork])
+    if err != nil {
+        return err
+    }
+    items, ok := resolved["items"].([]interface{})
+    if !ok {
+        return fmt.Errorf("items of dynamic fork %s did not resolve to a list", fork)
+    }
+
+    policy, err := parseJoinPolicy(task, len(items))
+    if err != nil {
+        return err
+    }
+
+    template, _ := task.InputParameters["forkTemplate"].(map[string]interface{})
+    branches := make([]Task, len(items))
+    for i, item := range items {
+        itemCtx := ctx
+        itemCtx.Parameters = map[string]interface{}{
+            "item":  item,
+            "index": int64(i),
+        }
+        branchDef, err := ResolveExpressions(template, itemCtx, d.paths[fork]+".forkTemplate")
+        if err != nil {
+            return err
+        }
+
+        branch, err := decodeTask(branchDef)
+        if err != nil {
+            return fmt.Errorf("invalid forkTemplate of dynamic fork %s: %v", fork, err)
+        }
+        branch.Name = fmt.Sprintf("%s-%d", fork, i)
+        branch.Parent = fork
+        branch.DependsOn = nil
+        branches[i] = branch
+    }
+
+    d.joins[fork] = policy
+    return d.insertBranches(fork, branches)
+}
+
+// insertBranches adds runtime branches to the graph directly after their fork
+func (d *DAG) insertBranches(fork string, branches []Task) error {
+    d.branches[fork] = nil
+    position := 0
+    for i, name := range d.order {
+        if name == fork {
+            position = i + 1
+            break
+        }
+    }
+
+    before := d.order
+    d.order = append([]string{}, before[:position]...)
+    for i, branch := range branches {
+        if err := d.addTask(branch, fmt.Sprintf("%s.forkTemplate[%d]", d.paths[fork], i)); err != nil {
+            d.order = before
+            return err
+        }
+        d.branches[fork] = append(d.branches[fork], branch.Name)
+        d.appendWithBranches(branch.Name)
+    }
+    d.order = append(d.order, before[position:]...)
+    return nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Reference kinds understood inside ${...}
+const (
+    RefParameter     = "parameter"     // ${inputPath}
+    RefWorkflowInput = "workflowInput" // ${workflow.input.mediaPath}
+    RefTaskOutput    = "taskOutput"    // ${extract-metadata.output.metadata}
+)
+
+// Reference is a single parsed ${...} expression
+type Reference struct {
+    Kind string
+    Task string   // set for RefTaskOutput
+    Name string   // set for RefParameter
+    Path []string // field path below the input or output
+}
+
+// ExpressionContext holds the values references resolve against. Kinds listed
+// in Defer are left untouched so a later stage can resolve them, e.g.
+// templates resolve parameters but leave workflow inputs and task outputs for
+// execution time.
+//
+// $${...} escapes an expression and is rendered as a literal ${...}, e.g. for
+// a shell's ${HOME}. Stages followed by another resolution set KeepEscapes so
+// the escape survives until the last one.
+type ExpressionContext struct {
+    Parameters    map[string]interface{}
+    WorkflowInput map[string]interface{}
+    TaskOutputs   map[string]map[string]interface{}
+    // FailedTasks are optional tasks that failed; every reference to their
+    // output resolves to null
+    FailedTasks   map[string]bool
+    Defer         map[string]bool
+    KeepEscapes   bool
+}
+
+// ReferenceError describes one expression that could not be resolved
+type ReferenceError struct {
+    Path       string // JSON path of the string holding the expression
+    Expression string
+    Reason     string
+}
+
+// ExpressionError collects every unresolved reference found in a value
+type ExpressionError struct {
+    Errors []ReferenceError
+}
+
+func (e *ExpressionError) Error() string {
+    msgs := make([]string, len(e.Errors))
+    for i, refErr := range e.Errors {
+        msgs[i] = fmt.Sprintf("%s: %s: %s", refErr.Path, refErr.Expression, refErr.Reason)
+    }
+    return fmt.Sprintf("unresolved expressions: %s", strings.Join(msgs, "; "))
+}
+
+// ResolveExpressions returns a copy of params with every ${...} reference
+// replaced, walking nested maps and arrays. A string made of a single
+// reference takes the referenced value as-is (map, list, number); references
+// embedded in a larger string are rendered as text. basePath prefixes the JSON
+// paths reported in errors.
+func ResolveExpressions(params map[string]interface{}, ctx ExpressionContext, basePath string) (map[string]interface{}, error) {
+    resolver := &expressionResolver{ctx: ctx}
+    resolved, _ := resolver.resolveValue(params, basePath).(map[string]interface{})
+    if len(resolver.errors) > 0 {
+        return nil, &ExpressionError{Errors: resolver.errors}
+    }
+    return resolved, nil
+}
+
+// FindReferences returns every reference in value keyed by the JSON path of
+// the string it appears in. Unparseable expressions are reported as errors.
+func FindReferences(value interface{}, basePath string) (map[string][]Reference, error) {
+    refs := make(map[string][]Reference)
+    var refErrs []ReferenceError
+
+    walkStrings(value, basePath, func(path, s string) {
+        exprs, err := splitExpressions(s)
+        if err != nil {
+            refErrs = append(refErrs, ReferenceError{Path: path, Expression: s, Reason: err.Error()})
+            return
+        }
+        for _, expr := range exprs {
+            if expr.escaped {
+                continue
+            }
+            ref, err := parseReference(expr.text)
+            if err != nil {
+                refErrs = append(refErrs, ReferenceError{Path: path, Expression: s[expr.start:expr.end], Reason: err.Error()})
+                continue
+            }
+            refs[path] = append(refs[path], ref)
+        }
+    })
+
+    if len(refErrs) > 0 {
+        return refs, &ExpressionError{Errors: refErrs}
+    }
+    return refs, nil
+}
+
+type expressionResolver struct {
+    ctx    ExpressionContext
+    errors []ReferenceError
+}
+
+func (r *expressionResolver) resolveValue(value interface{}, path string) interface{} {
+    switch val := value.(type) {
+    case map[string]interface{}:
+        resolved := make(map[string]interface{}, len(val))
+        for _, k := range sortedKeys(val) {
+            resolved[k] = r.resolveValue(val[k], joinPath(path, k))
+        }
+        return resolved
+    case []interface{}:
+        resolved := make([]interface{}, len(val))
+        for i, item := range val {
+            resolved[i] = r.resolveValue(item, fmt.Sprintf("%s[%d]", path, i))
+        }
+        return resolved
+    case string:
+        return r.resolveString(val, path)
+    default:
+        return value
+    }
+}
+
+func (r *expressionResolver) resolveString(s, path string) interface{} {
+    exprs, err := splitExpressions(s)
+    if err != nil {
+        r.errors = append(r.errors, ReferenceError{Path: path, Expression: s, Reason: err.Error()})
+        return s
+    }
+    if len(exprs) == 0 {
+        return s
+    }
+
+    // A lone reference keeps the type of the value it points at
+    if len(exprs) == 1 && !exprs[0].escaped && exprs[0].start == 0 && exprs[0].end == len(s) {
+        value, ok := r.lookup(exprs[0].text, path)
+        if !ok {
+            return s
+        }
+        return value
+    }
+
+    var b strings.Builder
+    last := 0
+    for _, expr := range exprs {
+        b.WriteString(s[last:expr.start])
+        if expr.escaped {
+            if r.ctx.KeepEscapes {
+                b.WriteString(s[expr.start:expr.end])
+            } else {
+                b.WriteString(s[expr.start+1 : expr.end])
+            }
+        } else if value, ok := r.lookup(expr.text, path); ok {
+            b.WriteString(renderValue(value))
+        } else {
+            b.WriteString(s[expr.start:expr.end])
+        }
+        last = expr.end
+    }
+    b.WriteString(s[last:])
+    return b.String()
+}
+
+// lookup resolves one expression; ok is false when the reference is deferred
+// or could not be resolved, in which case the original text is kept
+func (r *expressionResolver) lookup(expr, path string) (interface{}, bool) {
+    fail := func(reason string) (interface{}, bool) {
+        r.errors = append(r.errors, ReferenceError{Path: path, Expression: "${" + expr + "}", Reason: reason})
+        return nil, false
+    }
+
+    ref, err := parseReference(expr)
+    if err != nil {
+        return fail(err.Error())
+    }
+    if r.ctx.Defer[ref.Kind] {
+        return nil, false
+    }
+
+    switch ref.Kind {
+    case RefParameter:
+        value, exists := r.ctx.Parameters[ref.Name]
+        if !exists {
+            return fail(fmt.Sprintf("unknown parameter %s", ref.Name))
+        }
+        return value, true
+    case RefWorkflowInput:
+        value, err := lookupPath(r.ctx.WorkflowInput, ref.Path)
+        if err != nil {
+            return fail(fmt.Sprintf("workflow input: %v", err))
+        }
+        return value, true
+    case RefTaskOutput:
+        if r.ctx.FailedTasks[ref.Task] {
+            return nil, true
+        }
+        output, exists := r.ctx.TaskOutputs[ref.Task]
+        if !exists {
+            return fail(fmt.Sprintf("no output available from task %s", ref.Task))
+        }
+        value, err := lookupPath(output, ref.Path)
+        if err != nil {
+            return fail(fmt.Sprintf("output of task %s: %v", ref.Task, err))
+        }
+        return value, true
+    }
+    return fail("unsupported expression")
+}
+
+type expressionSpan struct {
+    text       string
+    start, end int // byte offsets of the whole ${...} in the source string
+    // escaped spans are written $${...} and start at the first $
+    escaped    bool
+}
+
+func splitExpressions(s string) ([]expressionSpan, error) {
+    var spans []expressionSpan
+    offset := 0
+    for {
+        start := strings.Index(s[offset:], "${")
+        if start < 0 {
+            return spans, nil
+        }
+        start += offset
+        escaped := start > 0 && s[start-1] == '$'
+        end := strings.Index(s[start:], "}")
+        if end < 0 {
+            return nil, fmt.Errorf("unterminated expression at offset %d", start)
+        }
+        end += start + 1
+        span := expressionSpan{
+            text:  strings.TrimSpace(s[start+2 : end-1]),
+            start: start,
+            end:   end,
+        }
+        if escaped {
+            span.start--
+            span.escaped = true
+        }
+        spans = append(spans, span)
+        offset = end
+    }
+}
+
+func parseReference(expr string) (Reference, error) {
+    if expr == "" {
+        return Reference{}, fmt.Errorf("empty expression")
+    }
+    parts := strings.Split(expr, ".")
+    for _, part := range parts {
+        if part == "" {
+            return Reference{}, fmt.Errorf("empty path segment")
+        }
+    }
+
+    switch {
+    case len(parts) >= 2 && parts[0] == "workflow" && parts[1] == "input":
+        return Reference{Kind: RefWorkflowInput, Path: parts[2:]}, nil
+    case len(parts) >= 2 && parts[1] == "output":
+        return Reference{Kind: RefTaskOutput, Task: parts[0], Path: parts[2:]}, nil
+    case len(parts) == 1:
+        return Reference{Kind: RefParameter, Name: parts[0]}, nil
+    }
+    return Reference{}, fmt.Errorf("unsupported expression, expected workflow.input.<field>, <task>.output.<field> or <parameter>")
+}
+
+// lookupPath walks maps by key and lists by numeric index
+func lookupPath(root map[string]interface{}, path []string) (interface{}, error) {
+    var current interface{} = root
+    for i, segment := range path {
+        switch node := current.(type) {
+        case map[string]interface{}:
+            value, exists := node[segment]
+            if !exists {
+                return nil, fmt.Errorf("field %s not found", strings.Join(path[:i+1], "."))
+            }
+            current = value
+        case []interface{}:
+            index, err := strconv.Atoi(segment)
+            if err != nil || index < 0 || index >= len(node) {
+                return nil, fmt.Errorf("invalid index %s", strings.Join(path[:i+1], "."))
+            }
+            current = node[index]
+        default:
+            return nil, fmt.Errorf("field %s not found", strings.Join(path[:i+1], "."))
+        }
+    }
+    return current, nil
+}
+
+func renderValue(value interface{}) string {
+    switch val := value.(type) {
+    case string:
+        return val
+    case nil:
+        return ""
+    }
+    data, err := json.Marshal(value)
+    if err != nil {
+        return fmt.Sprintf("%v", value)
+    }
+    return string(data)
+}
+
+func walkStrings(value interface{}, path string, fn func(path, s string)) {
+    switch val := value.(type) {
+    case map[string]interface{}:
+        for _, k := range sortedKeys(val) {
+            walkStrings(val[k], joinPath(path, k), fn)
+        }
+    case []interface{}:
+        for i, item := range val {
+            walkStrings(item, fmt.Sprintf("%s[%d]", path, i), fn)
+        }
+    case string:
+        fn(path, val)
+    }
+}
+
+func joinPath(path, key string) string {
+    if path == "" {
+        return key
+    }
+    return path + "." + key
+}
+
+// sortedReferencePaths returns the paths of FindReferences in order
+func sortedReferencePaths(refs map[string][]Reference) []string {
+    paths := make([]string, 0, len(refs))
+    for path := range refs {
+        paths = append(paths, path)
+    }
+    sort.Strings(paths)
+    return paths
+}
+
+// sortedKeys keeps error output stable across runs
+func sortedKeys(m map[string]interface{}) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParseReference(t *testing.T) {
+    tests := []struct {
+        expr    string
+        want    Reference
+        wantErr bool
+    }{
+        {expr: "inputPath", want: Reference{Kind: RefParameter, Name: "inputPath"}},
+        {expr: "workflow.input.mediaPath", want: Reference{Kind: RefWorkflowInput, Path: []string{"mediaPath"}}},
+        {expr: "workflow.input", want: Reference{Kind: RefWorkflowInput, Path: []string{}}},
+        {expr: "extract-metadata.output.metadata.duration", want: Reference{Kind: RefTaskOutput, Task: "extract-metadata", Path: []string{"metadata", "duration"}}},
+        {expr: "encode.output", want: Reference{Kind: RefTaskOutput, Task: "encode", Path: []string{}}},
+        {expr: "", wantErr: true},
+        {expr: "workflow..mediaPath", wantErr: true},
+        {expr: "encode.", wantErr: true},
+        {expr: "encode.result.path", wantErr: true},
+    }
+
+    for _, tt := range tests {
+        got, err := parseReference(tt.expr)
+        if tt.wantErr {
+            if err == nil {
+                t.Errorf("parseReference(%q) = %+v, want error", tt.expr, got)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("parseReference(%q) failed: %v", tt.expr, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parseReference(%q) = %+v, want %+v", tt.expr, got, tt.want)
+        }
+    }
+}
+
+func TestResolveExpressions(t *testing.T) {
+    ctx := ExpressionContext{
+        Parameters: map[string]interface{}{
+            "bitrate": int64(5000),
+            "codec":   "h264",
+        },
+        WorkflowInput: map[string]interface{}{
+            "mediaPath": "s3://media/in.mov",
+            "variants": []interface{}{
+                map[string]interface{}{"height": int64(720)},
+                map[string]interface{}{"height": int64(1080)},
+            },
+        },
+        TaskOutputs: map[string]map[string]interface{}{
+            "extract-metadata": {
+                "metadata": map[string]interface{}{"duration": 42.5, "tags": []interface{}{"hd", "movie"}},
+            },
+        },
+    }
+
+    tests := []struct {
+        name    string
+        params  map[string]interface{}
+        ctx     ExpressionContext
+        want    map[string]interface{}
+        wantErr []string
+    }{
+        {
+            name:   "lone reference keeps its type",
+            params: map[string]interface{}{"bitrate": "${bitrate}", "metadata": "${extract-metadata.output.metadata}"},
+            want: map[string]interface{}{
+                "bitrate":  int64(5000),
+                "metadata": map[string]interface{}{"duration": 42.5, "tags": []interface{}{"hd", "movie"}},
+            },
+        },
+        {
+            name:   "embedded references are rendered as text",
+            params: map[string]interface{}{"args": "-c ${codec} -b ${bitrate} -i ${workflow.input.mediaPath} -t ${extract-metadata.output.metadata.tags}"},
+            want:   map[string]interface{}{"args": `-c h264 -b 5000 -i s3://media/in.mov -t ["hd","movie"]`},
+        },
+        {
+            name: "nested maps and lists",
+            params: map[string]interface{}{
+                "encode": map[string]interface{}{
+                    "outputs": []interface{}{
+                        map[string]interface{}{"height": "${workflow.input.variants.1.height}", "codec": "${codec}"},
+                        "${ codec }",
+                        int64(7),
+                    },
+                },
+            },
+            want: map[string]interface{}{
+                "encode": map[string]interface{}{
+                    "outputs": []interface{}{
+                        map[string]interface{}{"height": int64(1080), "codec": "h264"},
+                        "h264",
+                        int64(7),
+                    },
+                },
+            },
+        },
+        {
+            name:   "escaped expressions are rendered literally",
+            params: map[string]interface{}{"script": "echo $${HOME} ${codec}", "lone": "$${codec}"},
+            want:   map[string]interface{}{"script": "echo ${HOME} h264", "lone": "${codec}"},
+        },
+        {
+            name:   "escapes are kept for a later stage",
+            params: map[string]interface{}{"script": "echo $${HOME} ${codec}"},
+            ctx:    ExpressionContext{Parameters: ctx.Parameters, KeepEscapes: true},
+            want:   map[string]interface{}{"script": "echo $${HOME} h264"},
+        },
+        {
+            name:   "outputs of failed optional tasks are null",
+            params: map[string]interface{}{"thumbnails": "${create-thumbnails.output.thumbnails}", "args": "-t ${create-thumbnails.output.thumbnails.0}"},
+            ctx: ExpressionContext{
+                Parameters:  ctx.Parameters,
+                TaskOutputs: ctx.TaskOutputs,
+                FailedTasks: map[string]bool{"create-thumbnails": true},
+            },
+            want: map[string]interface{}{"thumbnails": nil, "args": "-t "},
+        },
+        {
+            name:   "deferred kinds are left untouched",
+            params: map[string]interface{}{"path": "${workflow.input.mediaPath}", "args": "${codec} ${extract-metadata.output.metadata}"},
+            ctx: ExpressionContext{
+                Parameters: ctx.Parameters,
+                Defer:      map[string]bool{RefWorkflowInput: true, RefTaskOutput: true},
+            },
+            want: map[string]interface{}{"path": "${workflow.input.mediaPath}", "args": "h264 ${extract-metadata.output.metadata}"},
+        },
+        {
+            name: "unresolved paths are reported",
+            params: map[string]interface{}{
+                "a": "${missing}",
+                "b": map[string]interface{}{"c": []interface{}{"x ${workflow.input.variants.5.height}"}},
+                "d": "${extract-metadata.output.metadata.size}",
+                "e": "${encode.output.path}",
+                "f": "${workflow.input.mediaPath",
+            },
+            wantErr: []string{
+                "spec.a: ${missing}: unknown parameter missing",
+                "spec.b.c[0]: ${workflow.input.variants.5.height}: workflow input: invalid index variants.5",
+                "spec.d: ${extract-metadata.output.metadata.size}: output of task extract-metadata: field metadata.size not found",
+                "spec.e: ${encode.output.path}: no output available from task encode",
+                "spec.f: ${workflow.input.mediaPath: unterminated expression at offset 0",
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            resolveCtx := ctx
+            if tt.ctx.Parameters != nil {
+                resolveCtx = tt.ctx
+            }
+            got, err := ResolveExpressions(tt.params, resolveCtx, "spec")
+            if tt.wantErr != nil {
+                exprErr, ok := err.(*ExpressionError)
+                if !ok {
+                    t.Fatalf("got %v, %v, want an ExpressionError", got, err)
+                }
+                var reported []string
+                for _, refErr := range exprErr.Errors {
+                    reported = append(reported, refErr.Path+": "+refErr.Expression+": "+refErr.Reason)
+                }
+                if !reflect.DeepEqual(reported, tt.wantErr) {
+                    t.Errorf("errors:\n%s\nwant:\n%s", strings.Join(reported, "\n"), strings.Join(tt.wantErr, "\n"))
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %#v, want %#v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestFindReferences(t *testing.T) {
+    value := map[string]interface{}{
+        "args":  "${codec} $${HOME} ${encode.output.path}",
+        "items": []interface{}{"${workflow.input.variants}"},
+    }
+    refs, err := FindReferences(value, "spec")
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    want := map[string][]Reference{
+        "spec.args": {
+            {Kind: RefParameter, Name: "codec"},
+            {Kind: RefTaskOutput, Task: "encode", Path: []string{"path"}},
+        },
+        "spec.items[0]": {
+            {Kind: RefWorkflowInput, Path: []string{"variants"}},
+        },
+    }
+    if !reflect.DeepEqual(refs, want) {
+        t.Errorf("got %+v, want %+v", refs, want)
+    }
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "context"
+    "log"
+
+    "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/client-go/dynamic"
+    "k8s.io/client-go/tools/cache"
+    "k8s.io/client-go/util/retry"
+)
+
+// Jobs and stored outputs are owned by their WorkflowRun, so the garbage
+// collector removes them with it. What the garbage collector can't see is
+// held in this process: tasks still executing, SIMPLE tasks leased to
+// external workers and the templates a run retains. runFinalizer keeps a
+// deleted run around until the controller has let go of those.
+const runFinalizer = "conductor.netflix.com/cleanup"
+
+// runOwnerReference makes run the controller of an object created for it
+func runOwnerReference(run *WorkflowRun) metav1.OwnerReference {
+    return *metav1.NewControllerRef(run, workflowRunGVR.GroupVersion().WithKind("WorkflowRun"))
+}
+
+// startRun makes the run's tasks cancellable by cancelRun until finishRun
+func (c *Controller) startRun(key string, cancel context.CancelFunc) {
+    c.runningMutex.Lock()
+    c.running[key] = cancel
+    c.runningMutex.Unlock()
+
+    // The run may have been deleted after it was read from the lister, but
+    // before cancelRun could find it
+    obj, err := c.runLister.Get(key)
+    if err == nil {
+        if accessor, ok := obj.(metav1.Object); ok && accessor.GetDeletionTimestamp() != nil {
+            cancel()
+        }
+    }
+}
+
+// isRunning tells whether the run's tasks are executing
+func (c *Controller) isRunning(key string) bool {
+    c.runningMutex.Lock()
+    defer c.runningMutex.Unlock()
+    _, running := c.running[key]
+    return running
+}
+
+func (c *Controller) finishRun(key string) {
+    c.runningMutex.Lock()
+    delete(c.running, key)
+    c.runningMutex.Unlock()
+}
+
+// cancelRun cancels the tasks of a run being deleted. It is called from the
+// event handlers, so the run stops without waiting for a sync.
+func (c *Controller) cancelRun(obj interface{}) {
+    key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+    if err != nil {
+        return
+    }
+
+    c.runningMutex.Lock()
+    cancel, running := c.running[key]
+    c.runningMutex.Unlock()
+    if running {
+        log.Printf("Workflow run %s is being deleted, cancelling its tasks", key)
+        cancel()
+    }
+}
+
+// ensureFinalizer adds runFinalizer before the run starts anything that
+// needs cleaning up
+func (c *Controller) ensureFinalizer(client dynamic.ResourceInterface, run *WorkflowRun) error {
+    if hasFinalizer(run.Finalizers) {
+        return nil
+    }
+    return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+        latest, err := client.Get(context.TODO(), run.Name, metav1.GetOptions{})
+        if err != nil {
+            return err
+        }
+        if !hasFinalizer(latest.GetFinalizers()) {
+            latest.SetFinalizers(append(latest.GetFinalizers(), runFinalizer))
+            if latest, err = client.Update(context.TODO(), latest, metav1.UpdateOptions{}); err != nil {
+                return err
+            }
+        }
+        run.Finalizers = latest.GetFinalizers()
+        run.ResourceVersion = latest.GetResourceVersion()
+        return nil
+    })
+}
+
+// finalizeRun cleans up after a deleted run and lets the deletion finish.
+// Its tasks were cancelled by cancelRun, which also withdrew any SIMPLE
+// tasks from the worker queue.
+func (c *Controller) finalizeRun(client dynamic.ResourceInterface, key string, run *WorkflowRun) error {
+    if !hasFinalizer(run.Finalizers) {
+        return nil
+    }
+
+    // Jobs created before runs owned them have no owner reference
+    c.deleteRunJobs(run)
+    c.releaseTemplates(key)
+
+    err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+        latest, err := client.Get(context.TODO(), run.Name, metav1.GetOptions{})
+        if errors.IsNotFound(err) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        _, err = client.Update(context.TODO(), withoutFinalizer(latest), metav1.UpdateOptions{})
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    log.Printf("Workflow run %s cleaned up", key)
+    return nil
+}
+
+func hasFinalizer(finalizers []string) bool {
+    for _, finalizer := range finalizers {
+        if finalizer == runFinalizer {
+            return true
+        }
+    }
+    return false
+}
+
+func withoutFinalizer(obj *unstructured.Unstructured) *unstructured.Unstructured {
+    var finalizers []string
+    for _, finalizer := range obj.GetFinalizers() {
+        if finalizer != runFinalizer {
+            finalizers = append(finalizers, finalizer)
+        }
+    }
+    obj.SetFinalizers(finalizers)
+    return obj
+}
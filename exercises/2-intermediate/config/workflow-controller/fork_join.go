@@ -0,0 +1,148 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+)
+
+// Join policies for FORK_JOIN tasks, set with inputParameters.joinPolicy
+const (
+    JoinAll         = "ALL"          // every branch must succeed
+    JoinAllRequired = "ALL_REQUIRED" // every non-optional branch must succeed
+    JoinAny         = "ANY"          // one successful branch is enough
+    JoinNOfM        = "N_OF_M"       // inputParameters.joinCount branches must succeed
+)
+
+// JoinPolicy decides when a fork's branches add up to success or failure
+type JoinPolicy struct {
+    Type  string
+    Count int
+}
+
+// parseForkBranches decodes inputParameters.forkTasks of a FORK_JOIN task.
+// Branches run in parallel once the fork starts, so they may not declare
+// dependencies of their own.
+func parseForkBranches(task Task) ([]Task, error) {
+    forkTasks, ok := task.InputParameters["forkTasks"].([]interface{})
+    if !ok || len(forkTasks) == 0 {
+        return nil, fmt.Errorf("fork task %s has no forkTasks", task.Name)
+    }
+
+    branches := make([]Task, len(forkTasks))
+    for i, taskData := range forkTasks {
+        taskBytes, err := json.Marshal(taskData)
+        if err != nil {
+            return nil, fmt.Errorf("failed to encode fork task %d of %s: %v", i, task.Name, err)
+        }
+        if err := json.Unmarshal(taskBytes, &branches[i]); err != nil {
+            return nil, fmt.Errorf("failed to parse fork task %d of %s: %v", i, task.Name, err)
+        }
+        if branches[i].Name == "" || branches[i].TaskType == "" {
+            return nil, fmt.Errorf("fork task %d of %s needs a name and taskType", i, task.Name)
+        }
+        if len(branches[i].DependsOn) > 0 {
+            return nil, fmt.Errorf("fork task %s of %s cannot declare dependsOn", branches[i].Name, task.Name)
+        }
+        branches[i].Parent = task.Name
+    }
+    return branches, nil
+}
+
+// parseJoinPolicy reads the join policy of a fork. A negative branchCount
+// means the branches are not known yet and skips the joinCount upper bound.
+func parseJoinPolicy(task Task, branchCount int) (JoinPolicy, error) {
+    policy := JoinPolicy{Type: JoinAll}
+    if value, ok := task.InputParameters["joinPolicy"]; ok {
+        policyType, ok := value.(string)
+        if !ok {
+            return policy, fmt.Errorf("joinPolicy of fork task %s must be a string", task.Name)
+        }
+        policy.Type = policyType
+    }
+
+    switch policy.Type {
+    case JoinAll, JoinAllRequired, JoinAny:
+        return policy, nil
+    case JoinNOfM:
+        var count int
+        switch value := task.InputParameters["joinCount"].(type) {
+        case int64:
+            count = int(value)
+        case float64:
+            count = int(value)
+        case int:
+            count = value
+        }
+        if count < 1 {
+            return policy, fmt.Errorf("joinCount of fork task %s must be at least 1", task.Name)
+        }
+        if branchCount >= 0 && count > branchCount {
+            return policy, fmt.Errorf("joinCount of fork task %s must be between 1 and %d", task.Name, branchCount)
+        }
+        policy.Count = count
+        return policy, nil
+    }
+    return policy, fmt.Errorf("unknown joinPolicy %s for fork task %s", policy.Type, task.Name)
+}
+
+// evaluateJoin reports whether the fork is decided yet and, if so, whether
+// it failed. Policies that can be satisfied early do not wait for the
+// remaining branches.
+func (d *DAG) evaluateJoin(fork string, phases map[string]string) (bool, error) {
+    policy := d.joins[fork]
+    succeeded, failed, requiredFailed, pending := 0, 0, 0, 0
+    for _, branch := range d.branches[fork] {
+        switch phases[branch] {
+        case PhaseCompleted:
+            succeeded++
+        case PhaseFailed:
+            failed++
+            if !d.tasks[branch].Optional {
+                requiredFailed++
+            }
+        default:
+            pending++
+        }
+    }
+
+    total := len(d.branches[fork])
+    switch policy.Type {
+    case JoinAll:
+        if failed > 0 {
+            return true, fmt.Errorf("%d of %d branches failed", failed, total)
+        }
+        return pending == 0, nil
+    case JoinAllRequired:
+        if requiredFailed > 0 {
+            return true, fmt.Errorf("%d required branches failed", requiredFailed)
+        }
+        return pending == 0, nil
+    case JoinAny:
+        if succeeded > 0 {
+            return true, nil
+        }
+        if pending == 0 {
+            return true, fmt.Errorf("all %d branches failed", total)
+        }
+    case JoinNOfM:
+        if succeeded >= policy.Count {
+            return true, nil
+        }
+        if succeeded+pending < policy.Count {
+            return true, fmt.Errorf("only %d of the required %d branches can succeed", succeeded+pending, policy.Count)
+        }
+    }
+    return false, nil
+}
+
+// joinOutput merges the outputs of the fork's successful branches, keyed by
+// branch name
+func (d *DAG) joinOutput(fork string, outputs map[string]map[string]interface{}) map[string]interface{} {
+    merged := make(map[string]interface{})
+    for _, branch := range d.branches[fork] {
+        if output, ok := outputs[branch]; ok {
+            merged[branch] = output
+        }
+    }
+    return merged
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestEvaluateJoin(t *testing.T) {
+    // Branch c is optional
+    tests := []struct {
+        name    string
+        policy  JoinPolicy
+        phases  map[string]string
+        decided bool
+        failed  bool
+    }{
+        {name: "all pending", policy: JoinPolicy{Type: JoinAll}, phases: map[string]string{"a": PhaseCompleted, "b": PhaseRunning}},
+        {name: "all succeeded", policy: JoinPolicy{Type: JoinAll}, phases: map[string]string{"a": PhaseCompleted, "b": PhaseCompleted, "c": PhaseCompleted}, decided: true},
+        {name: "all fails early", policy: JoinPolicy{Type: JoinAll}, phases: map[string]string{"c": PhaseFailed}, decided: true, failed: true},
+
+        {name: "all required ignores optional failure", policy: JoinPolicy{Type: JoinAllRequired}, phases: map[string]string{"a": PhaseCompleted, "b": PhaseCompleted, "c": PhaseFailed}, decided: true},
+        {name: "all required pending", policy: JoinPolicy{Type: JoinAllRequired}, phases: map[string]string{"a": PhaseCompleted, "c": PhaseFailed}},
+        {name: "all required fails", policy: JoinPolicy{Type: JoinAllRequired}, phases: map[string]string{"b": PhaseFailed}, decided: true, failed: true},
+
+        {name: "any succeeds early", policy: JoinPolicy{Type: JoinAny}, phases: map[string]string{"b": PhaseCompleted}, decided: true},
+        {name: "any pending", policy: JoinPolicy{Type: JoinAny}, phases: map[string]string{"a": PhaseFailed, "b": PhaseFailed}},
+        {name: "any fails", policy: JoinPolicy{Type: JoinAny}, phases: map[string]string{"a": PhaseFailed, "b": PhaseFailed, "c": PhaseFailed}, decided: true, failed: true},
+
+        {name: "n of m succeeds early", policy: JoinPolicy{Type: JoinNOfM, Count: 2}, phases: map[string]string{"a": PhaseCompleted, "b": PhaseCompleted}, decided: true},
+        {name: "n of m pending", policy: JoinPolicy{Type: JoinNOfM, Count: 2}, phases: map[string]string{"a": PhaseCompleted, "b": PhaseFailed}},
+        {name: "n of m can no longer succeed", policy: JoinPolicy{Type: JoinNOfM, Count: 2}, phases: map[string]string{"a": PhaseFailed, "b": PhaseFailed}, decided: true, failed: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dag := &DAG{
+                tasks: map[string]Task{
+                    "fork": {Name: "fork", TaskType: "FORK_JOIN"},
+                    "a":    {Name: "a", Parent: "fork"},
+                    "b":    {Name: "b", Parent: "fork"},
+                    "c":    {Name: "c", Parent: "fork", Optional: true},
+                },
+                branches: map[string][]string{"fork": {"a", "b", "c"}},
+                joins:    map[string]JoinPolicy{"fork": tt.policy},
+            }
+            decided, err := dag.evaluateJoin("fork", tt.phases)
+            if decided != tt.decided || (err != nil) != tt.failed {
+                t.Errorf("got decided %v, error %v; want decided %v, failed %v", decided, err, tt.decided, tt.failed)
+            }
+        })
+    }
+}
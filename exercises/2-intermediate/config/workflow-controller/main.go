@@ -2,33 +2,46 @@ package main
 
 import (
     "context"
-    "encoding/json"
+    "flag"
     "fmt"
     "log"
-    "os"
     "path/filepath"
+    "sync"
     "time"
 
     corev1 "k8s.io/api/core/v1"
     "k8s.io/apimachinery/pkg/api/errors"
     metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/labels"
     "k8s.io/apimachinery/pkg/runtime"
     "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/apimachinery/pkg/util/wait"
+    "k8s.io/client-go/dynamic"
+    "k8s.io/client-go/dynamic/dynamicinformer"
     "k8s.io/client-go/kubernetes"
     "k8s.io/client-go/kubernetes/scheme"
+    typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
     "k8s.io/client-go/rest"
+    "k8s.io/client-go/tools/cache"
     "k8s.io/client-go/tools/clientcmd"
+    "k8s.io/client-go/tools/record"
     "k8s.io/client-go/util/homedir"
     "k8s.io/client-go/util/workqueue"
-    "k8s.io/apimachinery/pkg/util/wait"
 )
 
-// Workflow represents our CRD
+// workflowGVR identifies the Workflow CRD served by 05-3-netflix-workflow-crd.yaml
+var workflowGVR = schema.GroupVersionResource{
+    Group:    "conductor.netflix.com",
+    Version:  "v1",
+    Resource: "workflows",
+}
+
+// Workflow is a workflow definition. It is executed through WorkflowRuns.
 type Workflow struct {
     metav1.TypeMeta   `json:",inline"`
     metav1.ObjectMeta `json:"metadata,omitempty"`
     Spec             WorkflowSpec   `json:"spec"`
-    Status           WorkflowStatus `json:"status,omitempty"`
 }
 
 type WorkflowSpec struct {
@@ -38,7 +51,20 @@ type WorkflowSpec struct {
     OwnerEmail     string `json:"ownerEmail,omitempty"`
     TimeoutPolicy  string `json:"timeoutPolicy,omitempty"`
     TimeoutSeconds int    `json:"timeoutSeconds,omitempty"`
-    Tasks          []Task `json:"tasks"`
+    Tasks          []Task `json:"tasks,omitempty"`
+    // TemplateRef builds the tasks from a WorkflowTemplate instead
+    TemplateRef    *TemplateRef `json:"templateRef,omitempty"`
+    // InputParameters declares the input a WorkflowRun must provide
+    InputParameters []WorkflowParameter `json:"inputParameters,omitempty"`
+}
+
+// WorkflowParameter declares one input of a workflow
+type WorkflowParameter struct {
+    Name        string      `json:"name"`
+    Type        string      `json:"type,omitempty"` // one of the FieldType constants; empty accepts any value
+    Description string      `json:"description,omitempty"`
+    Required    bool        `json:"required,omitempty"`
+    Default     interface{} `json:"default,omitempty"`
 }
 
 type Task struct {
@@ -49,11 +75,22 @@ type Task struct {
     TimeoutSeconds  int                   `json:"timeoutSeconds,omitempty"`
     InputParameters map[string]interface{} `json:"inputParameters,omitempty"`
     Optional        bool                  `json:"optional,omitempty"`
+    DependsOn       []string              `json:"dependsOn,omitempty"`
+    // SensitiveOutput keeps the task output out of the status, in a Secret
+    SensitiveOutput bool                  `json:"sensitiveOutput,omitempty"`
+    // Parent is the fork task a branch belongs to; set when the DAG is built
+    Parent          string                `json:"-"`
 }
 
 type WorkflowStatus struct {
     Phase      string       `json:"phase"`
     StartTime  metav1.Time  `json:"startTime,omitempty"`
+    // Attempt counts restarts under the RETRY timeout policy, starting at 1
+    Attempt    int          `json:"attempt,omitempty"`
+    // WorkflowVersion is the definition version the run started on
+    WorkflowVersion int     `json:"workflowVersion,omitempty"`
+    // TemplateVersion is the template version its tasks were expanded from
+    TemplateVersion int     `json:"templateVersion,omitempty"`
     Tasks      []TaskStatus `json:"tasks,omitempty"`
     Conditions []Condition  `json:"conditions,omitempty"`
 }
@@ -65,6 +102,10 @@ type TaskStatus struct {
     FinishTime metav1.Time `json:"finishTime,omitempty"`
     Error      string      `json:"error,omitempty"`
     Retries    int         `json:"retries,omitempty"`
+    Output     map[string]interface{} `json:"output,omitempty"`
+    OutputRef  *OutputRef  `json:"outputRef,omitempty"`
+    // Parent is set on the status of fork branches
+    Parent     string      `json:"parent,omitempty"`
 }
 
 type Condition struct {
@@ -77,76 +118,156 @@ type Condition struct {
 
 // Controller structure
 type Controller struct {
-    kubeClient   kubernetes.Interface
-    workqueue    workqueue.RateLimitingInterface
-    workflows    map[string]*Workflow
-    taskExecutor TaskExecutor
+    kubeClient      kubernetes.Interface
+    dynamicClient   dynamic.Interface
+    workflowLister  cache.GenericLister
+    workflowsSynced cache.InformerSynced
+    runLister       cache.GenericLister
+    runsSynced      cache.InformerSynced
+    templateLister  cache.GenericLister
+    templatesSynced cache.InformerSynced
+    templateManager *TemplateManager
+    workqueue       workqueue.RateLimitingInterface
+    // templateQueue holds the names of templates whose finalizer needs
+    // adding or removing
+    templateQueue   workqueue.RateLimitingInterface
+    taskExecutor    TaskExecutor
+    scheduler       *Scheduler
+    outputStore     *OutputStore
+    metricsCollector *MetricsCollector
+    recorder        record.EventRecorder
+    // running holds the cancel functions of the runs being executed
+    running         map[string]context.CancelFunc
+    runningMutex    sync.Mutex
 }
 
-// TaskExecutor interface for different task types
+// TaskExecutor interface for different task types. The returned output is
+// addressable by later tasks as ${<task>.output.<field>}.
 type TaskExecutor interface {
-    ExecuteTask(task Task, workflow *Workflow) error
-}
-
-// DefaultTaskExecutor implements TaskExecutor
-type DefaultTaskExecutor struct{}
-
-func (e *DefaultTaskExecutor) ExecuteTask(task Task, workflow *Workflow) error {
-    switch task.TaskType {
-    case "HTTP":
-        return e.executeHTTPTask(task)
-    case "LAMBDA":
-        return e.executeLambdaTask(task)
-    case "SIMPLE":
-        return e.executeSimpleTask(task)
-    case "FORK_JOIN":
-        return e.executeForkJoinTask(task, workflow)
-    default:
-        return fmt.Errorf("unsupported task type: %s", task.TaskType)
-    }
+    // ExecuteTask stops and returns an error once ctx is done
+    ExecuteTask(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error)
+    // ValidateTask rejects unknown task types and malformed input parameters
+    ValidateTask(task Task) error
 }
 
-func (e *DefaultTaskExecutor) executeHTTPTask(task Task) error {
-    // Implementation for HTTP tasks
-    log.Printf("Executing HTTP task: %s", task.Name)
-    return nil
-}
+func NewController(kubeClient kubernetes.Interface, dynamicClient dynamic.Interface, informerFactory dynamicinformer.DynamicSharedInformerFactory, taskExecutor TaskExecutor, metricsCollector *MetricsCollector, maxParallelTasks int) (*Controller, error) {
+    workflowInformer := informerFactory.ForResource(workflowGVR)
+    runInformer := informerFactory.ForResource(workflowRunGVR)
+    templateInformer := informerFactory.ForResource(workflowTemplateGVR)
+
+    eventBroadcaster := record.NewBroadcaster()
+    eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+
+    controller := &Controller{
+        kubeClient:      kubeClient,
+        dynamicClient:   dynamicClient,
+        workflowLister:  workflowInformer.Lister(),
+        workflowsSynced: workflowInformer.Informer().HasSynced,
+        runLister:       runInformer.Lister(),
+        runsSynced:      runInformer.Informer().HasSynced,
+        templateLister:  templateInformer.Lister(),
+        templateManager: NewTemplateManager(),
+        workqueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "WorkflowRuns"),
+        templateQueue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "WorkflowTemplates"),
+        taskExecutor:    taskExecutor,
+        scheduler:       NewScheduler(taskExecutor, maxParallelTasks),
+        outputStore:     NewOutputStore(kubeClient),
+        metricsCollector: metricsCollector,
+        recorder:        eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "workflow-controller"}),
+        running:         make(map[string]context.CancelFunc),
+    }
 
-func (e *DefaultTaskExecutor) executeLambdaTask(task Task) error {
-    // Implementation for Lambda tasks
-    log.Printf("Executing Lambda task: %s", task.Name)
-    return nil
+    // Every change to a WorkflowRun is reduced to its namespace/name key; the
+    // worker always reads the latest state back from the lister. Deleting a
+    // run also cancels its tasks right away.
+    runInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.enqueueRun,
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            if newObj.(metav1.Object).GetDeletionTimestamp() != nil {
+                controller.cancelRun(newObj)
+            }
+            controller.enqueueRun(newObj)
+        },
+        DeleteFunc: func(obj interface{}) {
+            controller.cancelRun(obj)
+            controller.enqueueRun(obj)
+        },
+    })
+
+    // Runs created before their definition wait for it to show up
+    workflowInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc: controller.workflowChanged,
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            controller.workflowChanged(newObj)
+        },
+    })
+
+    // Runs are only synced once every template has reached the
+    // TemplateManager, not merely the informer cache
+    templateRegistration, err := templateInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc:    controller.addTemplate,
+        UpdateFunc: controller.updateTemplate,
+        DeleteFunc: controller.deleteTemplate,
+    })
+    if err != nil {
+        return nil, err
+    }
+    controller.templatesSynced = templateRegistration.HasSynced
+
+    return controller, nil
 }
 
-func (e *DefaultTaskExecutor) executeSimpleTask(task Task) error {
-    // Implementation for Simple tasks
-    log.Printf("Executing Simple task: %s", task.Name)
-    return nil
+func (c *Controller) enqueueRun(obj interface{}) {
+    key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+    if err != nil {
+        log.Printf("Error computing key for workflow run: %v", err)
+        return
+    }
+    c.workqueue.Add(key)
 }
 
-func (e *DefaultTaskExecutor) executeForkJoinTask(task Task, workflow *Workflow) error {
-    // Implementation for Fork-Join tasks
-    log.Printf("Executing Fork-Join task: %s", task.Name)
-    return nil
+func (c *Controller) workflowChanged(obj interface{}) {
+    workflow, err := workflowFromObject(obj.(runtime.Object))
+    if err != nil {
+        return
+    }
+    c.enqueuePendingRuns(workflow.Namespace, func(run *WorkflowRun) bool {
+        return run.Spec.WorkflowRef.Name == workflow.Spec.Name
+    })
 }
 
-func NewController(kubeClient kubernetes.Interface) *Controller {
-    return &Controller{
-        kubeClient:   kubeClient,
-        workqueue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Workflows"),
-        workflows:    make(map[string]*Workflow),
-        taskExecutor: &DefaultTaskExecutor{},
+// enqueuePendingRuns enqueues the runs in namespace that haven't started and
+// match the filter
+func (c *Controller) enqueuePendingRuns(namespace string, filter func(run *WorkflowRun) bool) {
+    objs, err := c.runLister.ByNamespace(namespace).List(labels.Everything())
+    if err != nil {
+        log.Printf("Error listing workflow runs: %v", err)
+        return
+    }
+    for _, runObj := range objs {
+        run, err := runFromObject(runObj)
+        if err != nil || run.Status.Phase != "" || !filter(run) {
+            continue
+        }
+        c.enqueueRun(runObj)
     }
 }
 
 func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
     defer c.workqueue.ShutDown()
+    defer c.templateQueue.ShutDown()
 
     log.Print("Starting Workflow controller")
 
+    log.Print("Waiting for informer caches to sync")
+    if ok := cache.WaitForCacheSync(stopCh, c.workflowsSynced, c.runsSynced, c.templatesSynced); !ok {
+        return fmt.Errorf("failed to wait for caches to sync")
+    }
+
     for i := 0; i < threadiness; i++ {
         go wait.Until(c.runWorker, time.Second, stopCh)
     }
+    go wait.Until(c.runTemplateWorker, time.Second, stopCh)
 
     <-stopCh
     return nil
@@ -171,8 +292,8 @@ func (c *Controller) processNextWorkItem() bool {
         return true
     }
 
-    if err := c.syncWorkflow(key); err != nil {
-        log.Printf("Error syncing workflow %s: %v", key, err)
+    if err := c.syncWorkflowRun(key); err != nil {
+        log.Printf("Error syncing workflow run %s: %v", key, err)
         c.workqueue.AddRateLimited(key)
         return true
     }
@@ -181,24 +302,190 @@ func (c *Controller) processNextWorkItem() bool {
     return true
 }
 
-func (c *Controller) syncWorkflow(key string) error {
-    workflow, exists := c.workflows[key]
-    if !exists {
-        log.Printf("Workflow %s no longer exists", key)
+func (c *Controller) syncWorkflowRun(key string) error {
+    namespace, name, err := cache.SplitMetaNamespaceKey(key)
+    if err != nil {
+        log.Printf("Invalid workflow run key %s: %v", key, err)
         return nil
     }
 
-    // Process each task in the workflow
-    for _, task := range workflow.Spec.Tasks {
-        if err := c.taskExecutor.ExecuteTask(task, workflow); err != nil {
-            return fmt.Errorf("failed to execute task %s: %v", task.Name, err)
+    obj, err := c.runLister.ByNamespace(namespace).Get(name)
+    if errors.IsNotFound(err) {
+        log.Printf("Workflow run %s no longer exists", key)
+        c.releaseTemplates(key)
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to get workflow run %s: %v", key, err)
+    }
+
+    run, err := runFromObject(obj)
+    if err != nil {
+        // A malformed object will not parse any better on retry
+        log.Printf("Error decoding workflow run %s: %v", key, err)
+        return nil
+    }
+
+    // The run's own goroutine enqueues it again once it has returned;
+    // deleting the run cancels it
+    if c.isRunning(key) {
+        return nil
+    }
+
+    client := c.dynamicClient.Resource(workflowRunGVR).Namespace(namespace)
+    if run.DeletionTimestamp != nil {
+        return c.finalizeRun(client, key, run)
+    }
+
+    // Finished runs stay finished; resyncs and our own status writes must
+    // not run them again
+    switch run.Status.Phase {
+    case PhaseCompleted, PhaseFailed, PhaseTimedOut:
+        c.releaseTemplates(key)
+        return nil
+    }
+
+    workflow, err := c.resolveWorkflow(run)
+    if err != nil {
+        // The run is enqueued again when the definition is created
+        log.Printf("Workflow run %s is waiting for its definition: %v", key, err)
+        return nil
+    }
+    run.Workflow = workflow
+
+    checkpointer := newWorkflowCheckpointer(client, c.outputStore, run)
+
+    if workflow.Spec.TemplateRef != nil {
+        template, err := c.findTemplate(workflow.Spec.TemplateRef, run.Status.TemplateVersion)
+        if err == nil {
+            err = c.expandTemplate(workflow, template)
+        }
+        if _, missing := err.(*templateNotFoundError); missing {
+            // The run is enqueued again when a template is loaded
+            log.Printf("Workflow run %s is waiting for a template: %v", key, err)
+            return nil
         }
+        if err != nil {
+            log.Printf("Rejecting workflow run %s: %v", key, err)
+            return checkpointer.Reject("InvalidWorkflow", err)
+        }
+        if deprecated, ok := workflow.Annotations[deprecatedTemplatesAnnotation]; ok && run.Status.Phase == "" {
+            c.recorder.Eventf(obj, corev1.EventTypeWarning, "DeprecatedTemplate", "Workflow %s uses deprecated templates: %s", workflow.Spec.Name, deprecated)
+        }
+    }
+
+    // Neither a bad input nor an invalid task graph will get better on
+    // retry, so the run is failed right away
+    run.Input, err = validateRunInput(workflow.Spec.InputParameters, run.Spec.Input)
+    if err != nil {
+        log.Printf("Rejecting workflow run %s: %v", key, err)
+        return checkpointer.Reject("InvalidInput", err)
+    }
+
+    dag, err := BuildDAG(workflow.Spec.Tasks)
+    if err != nil {
+        log.Printf("Rejecting workflow run %s: %v", key, err)
+        return checkpointer.Reject("InvalidWorkflow", err)
+    }
+
+    for _, task := range dag.Tasks() {
+        if err := c.taskExecutor.ValidateTask(task); err != nil {
+            log.Printf("Rejecting workflow run %s: %v", key, err)
+            return checkpointer.Reject("InvalidWorkflow", err)
+        }
+    }
+
+    if err := c.ensureFinalizer(client, run); err != nil {
+        return fmt.Errorf("failed to add finalizer to workflow run %s: %v", key, err)
+    }
+    if err := checkpointer.Initialize(); err != nil {
+        return err
+    }
+    // Keep the templates this run was expanded from until it finishes
+    c.templateManager.Retain(key, workflow)
+
+    // Runs can take hours, so each executes in a goroutine of its own rather
+    // than holding up a worker
+    ctx, cancel, alerted := c.workflowContext(obj, run)
+    c.startRun(key, cancel)
+    go func() {
+        runErr := c.scheduler.Run(ctx, dag, run, checkpointer)
+        cancel()
+        err := c.runFinished(ctx, obj, run, checkpointer, alerted, runErr)
+        c.finishRun(key)
+
+        // Sync again to settle the outcome: release the templates of a
+        // finished run, restart a retried one or finalize a deleted one
+        if err != nil {
+            log.Printf("Error finishing workflow run %s: %v", key, err)
+            c.workqueue.AddRateLimited(key)
+            return
+        }
+        c.workqueue.Forget(key)
+        c.workqueue.Add(key)
+    }()
+    return nil
+}
+
+// runFinished records the outcome of a run once the scheduler has returned.
+// A returned error means progress could not be recorded and the run is
+// synced again from its last persisted state.
+func (c *Controller) runFinished(ctx context.Context, obj runtime.Object, run *WorkflowRun, checkpointer *workflowCheckpointer, alerted <-chan struct{}, runErr error) error {
+    key := run.Namespace + "/" + run.Name
+
+    select {
+    case <-alerted:
+        // ALERT_ONLY: remember the alert so a later sync doesn't raise it again
+        if err := checkpointer.RecordTimeout(); err != nil {
+            return err
+        }
+    default:
+    }
+    if ctx.Err() == context.DeadlineExceeded && run.Status.Phase != PhaseCompleted {
+        return c.handleTimeout(obj, run, checkpointer)
+    }
+
+    if _, ok := runErr.(*checkpointError); ok {
+        // Progress could not be recorded; retry from the last persisted state
+        return runErr
+    }
+    if runErr != nil {
+        log.Printf("Workflow run %s failed: %v", key, runErr)
     }
 
     return nil
 }
 
+// workflowFromObject converts a lister object into a typed Workflow. The lister
+// hands out shared cache objects, so the result is a deep copy.
+func workflowFromObject(obj runtime.Object) (*Workflow, error) {
+    u, ok := obj.(*unstructured.Unstructured)
+    if !ok {
+        return nil, fmt.Errorf("unexpected object type %T", obj)
+    }
+
+    workflow := &Workflow{}
+    if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.DeepCopy().UnstructuredContent(), workflow); err != nil {
+        return nil, err
+    }
+    return workflow, nil
+}
+
 func main() {
+    workers := flag.Int("workers", 2, "number of workflow runs synced at once; each run then executes in a goroutine of its own")
+    maxParallelTasks := flag.Int("max-parallel-tasks", 4, "maximum number of tasks of a single workflow running at once")
+    workerAPIAddr := flag.String("worker-api-addr", ":8081", "address the SIMPLE task worker API listens on")
+    workerLeaseSeconds := flag.Int("worker-lease-seconds", 60, "seconds a worker may hold a SIMPLE task without heartbeating")
+    workerTokenSecret := flag.String("worker-token-secret", "workflow-worker-token", "Secret whose token key holds the bearer token of the worker API")
+    workerTokenNamespace := flag.String("worker-token-namespace", "default", "namespace of the worker token Secret")
+    webhookAddr := flag.String("webhook-addr", ":9443", "address the admission webhook listens on; empty disables it")
+    webhookCertDir := flag.String("webhook-cert-dir", "/tmp/workflow-controller-webhook", "directory holding the webhook's tls.crt and tls.key")
+    webhookSelfSigned := flag.Bool("webhook-self-signed", false, "generate a self-signed webhook certificate and patch it into the webhook configuration")
+    webhookService := flag.String("webhook-service", "workflow-controller-webhook", "Service the API server reaches the webhook through")
+    webhookNamespace := flag.String("webhook-namespace", "default", "namespace of the webhook Service")
+    webhookConfig := flag.String("webhook-config", "workflow-controller-validation", "ValidatingWebhookConfiguration to patch with a self-signed CA")
+    flag.Parse()
+
     var config *rest.Config
     var err error
 
@@ -217,12 +504,57 @@ func main() {
         log.Fatalf("Error building kubernetes client: %s", err.Error())
     }
 
-    controller := NewController(kubeClient)
+    dynamicClient, err := dynamic.NewForConfig(config)
+    if err != nil {
+        log.Fatalf("Error building dynamic client: %s", err.Error())
+    }
+
+    workerToken, err := LoadWorkerToken(kubeClient, *workerTokenNamespace, *workerTokenSecret)
+    if err != nil {
+        log.Printf("Worker API disabled, SIMPLE tasks will stay queued: %s", err.Error())
+    }
+
+    informerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, time.Second*30)
+    metricsCollector := NewMetricsCollector()
+    taskExecutor, err := NewDefaultTaskExecutor(kubeClient, metricsCollector, time.Duration(*workerLeaseSeconds)*time.Second)
+    if err != nil {
+        log.Fatalf("Error building task executor: %s", err.Error())
+    }
+
+    controller, err := NewController(kubeClient, dynamicClient, informerFactory, taskExecutor, metricsCollector, *maxParallelTasks)
+    if err != nil {
+        log.Fatalf("Error building controller: %s", err.Error())
+    }
 
     stopCh := make(chan struct{})
     defer close(stopCh)
 
-    if err = controller.Run(2, stopCh); err != nil {
+    informerFactory.Start(stopCh)
+
+    go taskExecutor.WorkerQueue().Run(stopCh)
+    if workerToken != "" {
+        go func() {
+            if err := NewWorkerAPIServer(taskExecutor.WorkerQueue(), *workerAPIAddr, workerToken).Run(stopCh); err != nil {
+                log.Fatalf("Error running worker API: %s", err.Error())
+            }
+        }()
+    }
+
+    if *webhookAddr != "" {
+        if *webhookSelfSigned {
+            if err := bootstrapSelfSignedCert(kubeClient, *webhookCertDir, *webhookService, *webhookNamespace, *webhookConfig); err != nil {
+                log.Fatalf("Error bootstrapping webhook certificate: %s", err.Error())
+            }
+        }
+        validator := NewAdmissionValidator(taskExecutor.Registry(), controller.templateManager)
+        go func() {
+            if err := NewWebhookServer(validator, *webhookAddr, *webhookCertDir).Run(stopCh); err != nil {
+                log.Fatalf("Error running admission webhook: %s", err.Error())
+            }
+        }()
+    }
+
+    if err = controller.Run(*workers, stopCh); err != nil {
         log.Fatalf("Error running controller: %s", err.Error())
     }
 }
\ No newline at end of file
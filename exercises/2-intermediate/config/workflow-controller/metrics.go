@@ -13,6 +13,7 @@ type MetricsCollector struct {
     activeWorkflows     prometheus.Gauge
     taskQueueSize       *prometheus.GaugeVec
     taskRetries         *prometheus.CounterVec
+    workflowTimeouts    *prometheus.CounterVec
 }
 
 func NewMetricsCollector() *MetricsCollector {
@@ -73,6 +74,14 @@ func NewMetricsCollector() *MetricsCollector {
             },
             []string{"task_type", "workflow_name", "task_name"},
         ),
+
+        workflowTimeouts: promauto.NewCounterVec(
+            prometheus.CounterOpts{
+                Name: "workflow_timeouts_total",
+                Help: "Total number of workflow attempts that exceeded their timeout",
+            },
+            []string{"workflow_name", "policy"},
+        ),
     }
 }
 
@@ -99,4 +108,8 @@ func (mc *MetricsCollector) UpdateTaskQueueSize(taskType string, size float64) {
 
 func (mc *MetricsCollector) RecordTaskRetry(taskType, workflowName, taskName string) {
     mc.taskRetries.WithLabelValues(taskType, workflowName, taskName).Inc()
+}
+
+func (mc *MetricsCollector) RecordWorkflowTimeout(workflowName, policy string) {
+    mc.workflowTimeouts.WithLabelValues(workflowName, policy).Inc()
 }
\ No newline at end of file
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/json"
+    "fmt"
+    "strings"
+
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/kubernetes"
+)
+
+const (
+    // Outputs up to this size are kept inline in TaskStatus.Output
+    maxInlineOutputBytes = 4096
+
+    outputDataKey = "output.json"
+
+    // Length of the run name kept in an output object's name
+    maxOutputNamePrefix = 200
+
+    OutputKindConfigMap = "ConfigMap"
+    OutputKindSecret    = "Secret"
+)
+
+// OutputRef points at a task output stored outside the workflow status
+type OutputRef struct {
+    Kind string `json:"kind"`
+    Name string `json:"name"`
+    Key  string `json:"key"`
+}
+
+// OutputStore keeps task outputs small enough for the status inline and
+// moves the rest into a ConfigMap, or a Secret for tasks marked
+// sensitiveOutput, next to the workflow run
+type OutputStore struct {
+    kubeClient kubernetes.Interface
+}
+
+func NewOutputStore(kubeClient kubernetes.Interface) *OutputStore {
+    return &OutputStore{
+        kubeClient: kubeClient,
+    }
+}
+
+// Save returns either the output to inline in the status or a reference to
+// where it was stored
+func (s *OutputStore) Save(run *WorkflowRun, task Task, output map[string]interface{}) (map[string]interface{}, *OutputRef, error) {
+    if len(output) == 0 {
+        return nil, nil, nil
+    }
+
+    data, err := json.Marshal(output)
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to encode output of task %s: %v", task.Name, err)
+    }
+    if len(data) <= maxInlineOutputBytes && !task.SensitiveOutput {
+        return output, nil, nil
+    }
+
+    ref := &OutputRef{
+        Kind: OutputKindConfigMap,
+        Name: outputObjectName(run, task),
+        Key:  outputDataKey,
+    }
+    meta := metav1.ObjectMeta{
+        Name:            ref.Name,
+        Namespace:       run.Namespace,
+        OwnerReferences: []metav1.OwnerReference{runOwnerReference(run)},
+        Labels: map[string]string{
+            "workflow":     run.Workflow.Spec.Name,
+            "workflow-run": run.Name,
+            "task":         task.Name,
+        },
+    }
+
+    if task.SensitiveOutput {
+        ref.Kind = OutputKindSecret
+        err = s.saveSecret(&corev1.Secret{
+            ObjectMeta: meta,
+            Data:       map[string][]byte{ref.Key: data},
+        })
+    } else {
+        err = s.saveConfigMap(&corev1.ConfigMap{
+            ObjectMeta: meta,
+            Data:       map[string]string{ref.Key: string(data)},
+        })
+    }
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to store output of task %s: %v", task.Name, err)
+    }
+    return nil, ref, nil
+}
+
+// outputObjectName names the object holding a task's output. Task names
+// need not be valid object names, so the task is identified by a hash and
+// the object's task label instead.
+func outputObjectName(run *WorkflowRun, task Task) string {
+    prefix := run.Name
+    if len(prefix) > maxOutputNamePrefix {
+        prefix = strings.TrimRight(prefix[:maxOutputNamePrefix], "-.")
+    }
+    sum := sha256.Sum256([]byte(string(run.UID) + "/" + task.Name))
+    return fmt.Sprintf("%s-%x-output", prefix, sum[:8])
+}
+
+// Load reads back an output stored by Save
+func (s *OutputStore) Load(namespace string, ref *OutputRef) (map[string]interface{}, error) {
+    var data []byte
+    switch ref.Kind {
+    case OutputKindConfigMap:
+        configMap, err := s.kubeClient.CoreV1().ConfigMaps(namespace).Get(context.Background(), ref.Name, metav1.GetOptions{})
+        if err != nil {
+            return nil, err
+        }
+        data = []byte(configMap.Data[ref.Key])
+    case OutputKindSecret:
+        secret, err := s.kubeClient.CoreV1().Secrets(namespace).Get(context.Background(), ref.Name, metav1.GetOptions{})
+        if err != nil {
+            return nil, err
+        }
+        data = secret.Data[ref.Key]
+    default:
+        return nil, fmt.Errorf("unknown output kind %s", ref.Kind)
+    }
+
+    output := make(map[string]interface{})
+    if err := json.Unmarshal(data, &output); err != nil {
+        return nil, fmt.Errorf("failed to decode output %s/%s: %v", ref.Kind, ref.Name, err)
+    }
+    return output, nil
+}
+
+// A retried task overwrites the output of its previous attempt
+func (s *OutputStore) saveConfigMap(configMap *corev1.ConfigMap) error {
+    client := s.kubeClient.CoreV1().ConfigMaps(configMap.Namespace)
+    _, err := client.Create(context.Background(), configMap, metav1.CreateOptions{})
+    if errors.IsAlreadyExists(err) {
+        _, err = client.Update(context.Background(), configMap, metav1.UpdateOptions{})
+    }
+    return err
+}
+
+func (s *OutputStore) saveSecret(secret *corev1.Secret) error {
+    client := s.kubeClient.CoreV1().Secrets(secret.Namespace)
+    _, err := client.Create(context.Background(), secret, metav1.CreateOptions{})
+    if errors.IsAlreadyExists(err) {
+        _, err = client.Update(context.Background(), secret, metav1.UpdateOptions{})
+    }
+    return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "strings"
+    "testing"
+
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestOutputObjectName(t *testing.T) {
+    tests := []struct {
+        name    string
+        runName string
+        task    string
+    }{
+        {"short", "encode-1", "transcode"},
+        {"task name not a valid object name", "encode-1", "Transcode_4K"},
+        {"long run name", strings.Repeat("a", 240) + "-b", strings.Repeat("t", 100)},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            run := &WorkflowRun{ObjectMeta: metav1.ObjectMeta{Name: tt.runName, UID: "uid-1"}}
+            name := outputObjectName(run, Task{Name: tt.task})
+            if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+                t.Errorf("outputObjectName() = %q is invalid: %v", name, errs)
+            }
+            if name != outputObjectName(run, Task{Name: tt.task}) {
+                t.Errorf("outputObjectName() is not stable")
+            }
+            if name == outputObjectName(run, Task{Name: tt.task + "x"}) {
+                t.Errorf("outputObjectName() is the same for different tasks")
+            }
+        })
+    }
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// TaskHandler executes every task of one task type. Handlers are registered
+// with a TaskRegistry, so new task types (e.g. a Kafka publisher) can be added
+// without touching the executor. Execute must give up once ctx is done, which
+// happens when the task or its workflow times out:
+//
+//     executor.Registry().Register("KAFKA_PUBLISH", NewTaskHandler(kafkaSchema, publishToKafka))
+type TaskHandler interface {
+    // Schema describes the input parameters the handler accepts; nil skips validation
+    Schema() *ParameterSchema
+    Execute(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error)
+}
+
+type funcTaskHandler struct {
+    schema  *ParameterSchema
+    execute func(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error)
+}
+
+func (h *funcTaskHandler) Schema() *ParameterSchema {
+    return h.schema
+}
+
+func (h *funcTaskHandler) Execute(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+    return h.execute(ctx, task, run)
+}
+
+// NewTaskHandler builds a TaskHandler from a schema and an execute function
+func NewTaskHandler(schema *ParameterSchema, execute func(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error)) TaskHandler {
+    return &funcTaskHandler{
+        schema:  schema,
+        execute: execute,
+    }
+}
+
+// Parameter field types understood by ParameterSchema
+const (
+    FieldTypeString = "string"
+    FieldTypeNumber = "number"
+    FieldTypeBool   = "bool"
+    FieldTypeObject = "object"
+    FieldTypeArray  = "array"
+)
+
+// ParameterField describes one entry of a task's inputParameters
+type ParameterField struct {
+    Path     string // dot separated, e.g. "http.uri"
+    Type     string // one of the FieldType constants; empty accepts any value
+    Required bool
+    Enum     []string
+}
+
+// ParameterSchema is the set of fields a handler checks before execution
+type ParameterSchema struct {
+    Fields []ParameterField
+}
+
+// FieldProblem is one schema violation; Path is the field's ParameterField.Path
+type FieldProblem struct {
+    Path   string
+    Reason string
+}
+
+// Validate checks params against the schema and reports every violation.
+// Values that are still ${...} expressions are only checked for presence,
+// since their type is not known until they are resolved.
+func (s *ParameterSchema) Validate(params map[string]interface{}) error {
+    problems := s.Check(params)
+    if len(problems) == 0 {
+        return nil
+    }
+    msgs := make([]string, len(problems))
+    for i, problem := range problems {
+        msgs[i] = fmt.Sprintf("%s %s", problem.Path, problem.Reason)
+    }
+    return fmt.Errorf("invalid input parameters: %s", strings.Join(msgs, "; "))
+}
+
+// Check returns every violation of the schema, as Validate does, one per field
+func (s *ParameterSchema) Check(params map[string]interface{}) []FieldProblem {
+    if s == nil {
+        return nil
+    }
+
+    var problems []FieldProblem
+    for _, field := range s.Fields {
+        value, err := lookupPath(params, strings.Split(field.Path, "."))
+        if err != nil || value == nil {
+            if field.Required {
+                problems = append(problems, FieldProblem{Path: field.Path, Reason: "is required"})
+            }
+            continue
+        }
+
+        if str, ok := value.(string); ok && strings.Contains(str, "${") {
+            continue
+        }
+
+        if field.Type != "" && !matchesFieldType(value, field.Type) {
+            problems = append(problems, FieldProblem{Path: field.Path, Reason: fmt.Sprintf("must be of type %s", field.Type)})
+            continue
+        }
+
+        if len(field.Enum) > 0 {
+            str, _ := value.(string)
+            allowed := false
+            for _, option := range field.Enum {
+                if str == option {
+                    allowed = true
+                    break
+                }
+            }
+            if !allowed {
+                problems = append(problems, FieldProblem{Path: field.Path, Reason: fmt.Sprintf("must be one of %s", strings.Join(field.Enum, ", "))})
+            }
+        }
+    }
+    return problems
+}
+
+func matchesFieldType(value interface{}, fieldType string) bool {
+    switch value.(type) {
+    case string:
+        return fieldType == FieldTypeString
+    case bool:
+        return fieldType == FieldTypeBool
+    case int, int32, int64, float32, float64:
+        return fieldType == FieldTypeNumber
+    case map[string]interface{}:
+        return fieldType == FieldTypeObject
+    case []interface{}:
+        return fieldType == FieldTypeArray
+    }
+    return false
+}
+
+// TaskRegistry maps task types to their handlers
+type TaskRegistry struct {
+    handlers map[string]TaskHandler
+    mutex    sync.RWMutex
+}
+
+func NewTaskRegistry() *TaskRegistry {
+    return &TaskRegistry{
+        handlers: make(map[string]TaskHandler),
+    }
+}
+
+func (r *TaskRegistry) Register(taskType string, handler TaskHandler) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    if _, exists := r.handlers[taskType]; exists {
+        return fmt.Errorf("handler for task type %s already registered", taskType)
+    }
+    r.handlers[taskType] = handler
+    return nil
+}
+
+func (r *TaskRegistry) Handler(taskType string) (TaskHandler, error) {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+
+    handler, exists := r.handlers[taskType]
+    if !exists {
+        return nil, fmt.Errorf("unsupported task type: %s", taskType)
+    }
+    return handler, nil
+}
+
+// TaskTypes lists the registered task types
+func (r *TaskRegistry) TaskTypes() []string {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+
+    types := make([]string, 0, len(r.handlers))
+    for taskType := range r.handlers {
+        types = append(types, taskType)
+    }
+    sort.Strings(types)
+    return types
+}
+
+// Validate checks that the task type is registered and that the task's
+// input parameters satisfy the handler's schema
+func (r *TaskRegistry) Validate(task Task) error {
+    handler, err := r.Handler(task.TaskType)
+    if err != nil {
+        return err
+    }
+    if err := handler.Schema().Validate(task.InputParameters); err != nil {
+        return fmt.Errorf("task %s: %v", task.Name, err)
+    }
+    return nil
+}
@@ -16,23 +16,37 @@ const (
     ConditionTypeStarted    = "Started"
     ConditionTypeCompleted  = "Completed"
     ConditionTypeFailed    = "Failed"
+    ConditionTypeTimedOut  = "TimedOut"
+
+    TimeoutPolicyTimeOut   = "TIME_OUT"   // cancel running tasks and fail the workflow
+    TimeoutPolicyAlertOnly = "ALERT_ONLY" // report the timeout and keep going
+    TimeoutPolicyRetry     = "RETRY"      // cancel running tasks and start over
+
+    // A RETRY workflow still timing out after this many restarts fails as
+    // if its policy were TIME_OUT
+    maxTimeoutRetries = 3
 )
 
+// StatusManager maintains the status of a workflow run. Spec lookups go to
+// the run's resolved Workflow definition.
 type StatusManager struct {
-    workflow *Workflow
+    run *WorkflowRun
 }
 
-func NewStatusManager(workflow *Workflow) *StatusManager {
+func NewStatusManager(run *WorkflowRun) *StatusManager {
     return &StatusManager{
-        workflow: workflow,
+        run: run,
     }
 }
 
 func (sm *StatusManager) InitializeWorkflow() {
     now := metav1.Now()
-    sm.workflow.Status = WorkflowStatus{
+    sm.run.Status = WorkflowStatus{
         Phase:     PhaseInitializing,
         StartTime: now,
+        Attempt:   1,
+        // Later syncs keep running this version even if a newer one appears
+        WorkflowVersion: sm.run.Workflow.Spec.Version,
         Tasks:     make([]TaskStatus, 0),
         Conditions: []Condition{
             {
@@ -44,29 +58,72 @@ func (sm *StatusManager) InitializeWorkflow() {
             },
         },
     }
+    if ref := sm.run.Workflow.Spec.TemplateRef; ref != nil {
+        sm.run.Status.TemplateVersion = ref.Version
+    }
 }
 
 func (sm *StatusManager) StartTask(task Task) {
     now := metav1.Now()
+    sm.run.Status.Phase = PhaseRunning
+
+    // A task that already has an entry was interrupted (controller restart or
+    // lost status write) and is being attempted again
+    if taskStatus := sm.taskStatus(task.Name); taskStatus != nil {
+        taskStatus.Phase = PhaseRunning
+        taskStatus.StartTime = now
+        taskStatus.FinishTime = metav1.Time{}
+        taskStatus.Error = ""
+        taskStatus.Output = nil
+        taskStatus.OutputRef = nil
+        taskStatus.Retries++
+        return
+    }
+
     taskStatus := TaskStatus{
         Name:      task.Name,
-        Phase:     "Running",
+        Phase:     PhaseRunning,
         StartTime: now,
+        Parent:    task.Parent,
     }
-    sm.workflow.Status.Tasks = append(sm.workflow.Status.Tasks, taskStatus)
-    sm.workflow.Status.Phase = PhaseRunning
+    sm.run.Status.Tasks = append(sm.run.Status.Tasks, taskStatus)
+}
+
+func (sm *StatusManager) taskStatus(name string) *TaskStatus {
+    for i := range sm.run.Status.Tasks {
+        if sm.run.Status.Tasks[i].Name == name {
+            return &sm.run.Status.Tasks[i]
+        }
+    }
+    return nil
+}
+
+// SetTaskOutput records a task's output, either inline or as a reference
+func (sm *StatusManager) SetTaskOutput(taskName string, output map[string]interface{}, ref *OutputRef) {
+    if taskStatus := sm.taskStatus(taskName); taskStatus != nil {
+        taskStatus.Output = output
+        taskStatus.OutputRef = ref
+    }
+}
+
+// TaskPhase returns the recorded phase of a task, or "" if it never started
+func (sm *StatusManager) TaskPhase(name string) string {
+    if taskStatus := sm.taskStatus(name); taskStatus != nil {
+        return taskStatus.Phase
+    }
+    return ""
 }
 
 func (sm *StatusManager) CompleteTask(taskName string, err error) {
     now := metav1.Now()
-    for i, task := range sm.workflow.Status.Tasks {
+    for i, task := range sm.run.Status.Tasks {
         if task.Name == taskName {
-            sm.workflow.Status.Tasks[i].FinishTime = now
+            sm.run.Status.Tasks[i].FinishTime = now
             if err != nil {
-                sm.workflow.Status.Tasks[i].Phase = "Failed"
-                sm.workflow.Status.Tasks[i].Error = err.Error()
+                sm.run.Status.Tasks[i].Phase = PhaseFailed
+                sm.run.Status.Tasks[i].Error = err.Error()
             } else {
-                sm.workflow.Status.Tasks[i].Phase = "Completed"
+                sm.run.Status.Tasks[i].Phase = PhaseCompleted
             }
             break
         }
@@ -77,74 +134,163 @@ func (sm *StatusManager) CompleteTask(taskName string, err error) {
 }
 
 func (sm *StatusManager) updateWorkflowStatus() {
-    // Check if all tasks are completed
+    // The workflow is complete once every task in the spec has completed;
+    // failures of optional tasks don't count against it
     allCompleted := true
     anyFailed := false
 
-    for _, task := range sm.workflow.Status.Tasks {
-        if task.Phase == "Failed" {
-            anyFailed = true
-            break
-        }
-        if task.Phase != "Completed" {
+    for _, task := range sm.run.Workflow.Spec.Tasks {
+        switch sm.TaskPhase(task.Name) {
+        case PhaseCompleted:
+        case PhaseFailed:
+            if !task.Optional {
+                anyFailed = true
+            }
+        default:
             allCompleted = false
         }
     }
 
-    now := metav1.Now()
     if anyFailed {
-        sm.workflow.Status.Phase = PhaseFailed
-        sm.workflow.Status.Conditions = append(sm.workflow.Status.Conditions, Condition{
-            Type:               ConditionTypeFailed,
-            Status:            "True",
-            LastTransitionTime: now,
-            Reason:            "TaskFailed",
-            Message:           "One or more tasks failed",
+        sm.run.Status.Phase = PhaseFailed
+        sm.setCondition(Condition{
+            Type:    ConditionTypeFailed,
+            Status:  "True",
+            Reason:  "TaskFailed",
+            Message: "One or more tasks failed",
         })
     } else if allCompleted {
-        sm.workflow.Status.Phase = PhaseCompleted
-        sm.workflow.Status.Conditions = append(sm.workflow.Status.Conditions, Condition{
-            Type:               ConditionTypeCompleted,
-            Status:            "True",
-            LastTransitionTime: now,
-            Reason:            "WorkflowCompleted",
-            Message:           "All tasks completed successfully",
+        sm.run.Status.Phase = PhaseCompleted
+        sm.setCondition(Condition{
+            Type:    ConditionTypeCompleted,
+            Status:  "True",
+            Reason:  "WorkflowCompleted",
+            Message: "All tasks completed successfully",
         })
     }
 }
 
+// Reject fails a run that cannot be started, e.g. because its input does not
+// match the definition's inputParameters
+func (sm *StatusManager) Reject(reason string, err error) {
+    sm.run.Status.Phase = PhaseFailed
+    sm.setCondition(Condition{
+        Type:    ConditionTypeFailed,
+        Status:  "True",
+        Reason:  reason,
+        Message: err.Error(),
+    })
+}
+
+// setCondition adds the condition or updates the existing one of the same
+// type, only moving LastTransitionTime when the status actually changes
+func (sm *StatusManager) setCondition(condition Condition) {
+    for i, existing := range sm.run.Status.Conditions {
+        if existing.Type != condition.Type {
+            continue
+        }
+        if existing.Status == condition.Status {
+            condition.LastTransitionTime = existing.LastTransitionTime
+        } else {
+            condition.LastTransitionTime = metav1.Now()
+        }
+        sm.run.Status.Conditions[i] = condition
+        return
+    }
+
+    condition.LastTransitionTime = metav1.Now()
+    sm.run.Status.Conditions = append(sm.run.Status.Conditions, condition)
+}
+
+// Deadline returns when the current attempt of the workflow times out, or
+// false if it has no timeout or hasn't started
+func (sm *StatusManager) Deadline() (time.Time, bool) {
+    if sm.run.Workflow.Spec.TimeoutSeconds == 0 || sm.run.Status.StartTime.IsZero() {
+        return time.Time{}, false
+    }
+    timeout := time.Duration(sm.run.Workflow.Spec.TimeoutSeconds) * time.Second
+    return sm.run.Status.StartTime.Add(timeout), true
+}
+
+// CheckTimeout reports whether the current attempt has run past its deadline
 func (sm *StatusManager) CheckTimeout() bool {
-    if sm.workflow.Spec.TimeoutSeconds == 0 {
-        return false
-    }
-
-    elapsed := time.Since(sm.workflow.Status.StartTime.Time)
-    if int(elapsed.Seconds()) > sm.workflow.Spec.TimeoutSeconds {
-        now := metav1.Now()
-        sm.workflow.Status.Phase = PhaseTimedOut
-        sm.workflow.Status.Conditions = append(sm.workflow.Status.Conditions, Condition{
-            Type:               ConditionTypeFailed,
-            Status:            "True",
-            LastTransitionTime: now,
-            Reason:            "WorkflowTimeout",
-            Message:           fmt.Sprintf("Workflow exceeded timeout of %d seconds", sm.workflow.Spec.TimeoutSeconds),
-        })
-        return true
+    deadline, ok := sm.Deadline()
+    return ok && !time.Now().Before(deadline)
+}
+
+// TimeoutPolicy returns the workflow's timeoutPolicy, defaulting like the CRD
+func (sm *StatusManager) TimeoutPolicy() string {
+    if sm.run.Workflow.Spec.TimeoutPolicy == "" {
+        return TimeoutPolicyAlertOnly
+    }
+    return sm.run.Workflow.Spec.TimeoutPolicy
+}
+
+// TimeoutAlerted reports whether an ALERT_ONLY timeout was already raised
+// for the current attempt
+func (sm *StatusManager) TimeoutAlerted() bool {
+    for _, condition := range sm.run.Status.Conditions {
+        if condition.Type == ConditionTypeTimedOut && condition.Status == "True" {
+            return true
+        }
     }
     return false
 }
 
+// HandleTimeout records a timeout according to the workflow's timeoutPolicy.
+// Cancelling the running tasks is up to the caller. It returns an error only
+// when the workflow fails as a result.
 func (sm *StatusManager) HandleTimeout() error {
-    switch sm.workflow.Spec.TimeoutPolicy {
-    case "TIME_OUT":
-        return fmt.Errorf("workflow timed out after %d seconds", sm.workflow.Spec.TimeoutSeconds)
-    case "ALERT_ONLY":
-        // In a real implementation, this would send alerts to monitoring systems
+    message := fmt.Sprintf("Attempt %d exceeded timeout of %d seconds", sm.run.Status.Attempt, sm.run.Workflow.Spec.TimeoutSeconds)
+
+    switch sm.TimeoutPolicy() {
+    case TimeoutPolicyTimeOut:
+        return sm.timedOut("WorkflowTimeout", message)
+    case TimeoutPolicyAlertOnly:
+        sm.setCondition(Condition{
+            Type:    ConditionTypeTimedOut,
+            Status:  "True",
+            Reason:  "TimeoutAlert",
+            Message: message,
+        })
         return nil
-    case "RETRY":
-        sm.InitializeWorkflow() // Reset the workflow for retry
+    case TimeoutPolicyRetry:
+        // Start over with a clean status; only the attempt count carries over
+        attempt := sm.run.Status.Attempt
+        if attempt < 1 {
+            attempt = 1
+        }
+        if attempt > maxTimeoutRetries {
+            return sm.timedOut("RetriesExhausted", fmt.Sprintf("%s, giving up after %d restarts", message, maxTimeoutRetries))
+        }
+        sm.InitializeWorkflow()
+        sm.run.Status.Attempt = attempt + 1
+        sm.setCondition(Condition{
+            Type:    ConditionTypeTimedOut,
+            Status:  "False",
+            Reason:  "WorkflowRetried",
+            Message: message + ", restarted",
+        })
         return nil
     default:
-        return fmt.Errorf("unknown timeout policy: %s", sm.workflow.Spec.TimeoutPolicy)
+        return fmt.Errorf("unknown timeout policy: %s", sm.run.Workflow.Spec.TimeoutPolicy)
     }
+}
+
+// timedOut fails the workflow for exceeding its timeout
+func (sm *StatusManager) timedOut(reason, message string) error {
+    sm.run.Status.Phase = PhaseTimedOut
+    sm.setCondition(Condition{
+        Type:    ConditionTypeTimedOut,
+        Status:  "True",
+        Reason:  reason,
+        Message: message,
+    })
+    sm.setCondition(Condition{
+        Type:    ConditionTypeFailed,
+        Status:  "True",
+        Reason:  reason,
+        Message: message,
+    })
+    return fmt.Errorf("workflow timed out after %d seconds", sm.run.Workflow.Spec.TimeoutSeconds)
 }
\ No newline at end of file
@@ -0,0 +1,42 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestHandleTimeoutRetry(t *testing.T) {
+    tests := []struct {
+        name        string
+        attempt     int
+        wantErr     bool
+        wantPhase   string
+        wantAttempt int
+    }{
+        {name: "first attempt", attempt: 0, wantPhase: PhaseInitializing, wantAttempt: 2},
+        {name: "last restart", attempt: maxTimeoutRetries, wantPhase: PhaseInitializing, wantAttempt: maxTimeoutRetries + 1},
+        {name: "retries exhausted", attempt: maxTimeoutRetries + 1, wantErr: true, wantPhase: PhaseTimedOut, wantAttempt: maxTimeoutRetries + 1},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            run := &WorkflowRun{Workflow: &Workflow{Spec: WorkflowSpec{TimeoutPolicy: TimeoutPolicyRetry, TimeoutSeconds: 60}}}
+            run.Status.Phase = PhaseRunning
+            run.Status.Attempt = tt.attempt
+            sm := NewStatusManager(run)
+
+            err := sm.HandleTimeout()
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("HandleTimeout() error = %v, wantErr %v", err, tt.wantErr)
+            }
+            if run.Status.Phase != tt.wantPhase {
+                t.Errorf("phase = %s, want %s", run.Status.Phase, tt.wantPhase)
+            }
+            if run.Status.Attempt != tt.wantAttempt {
+                t.Errorf("attempt = %d, want %d", run.Status.Attempt, tt.wantAttempt)
+            }
+            if tt.wantErr && !sm.TimeoutAlerted() {
+                t.Errorf("no TimedOut condition after giving up")
+            }
+        })
+    }
+}
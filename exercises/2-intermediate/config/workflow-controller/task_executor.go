@@ -5,16 +5,21 @@ import (
     "context"
     "encoding/json"
     "fmt"
+    "io"
+    "log"
+    "math/rand"
     "net/http"
-    "sync"
     "time"
 
+    "github.com/aws/aws-sdk-go-v2/aws"
     "github.com/aws/aws-sdk-go-v2/config"
     "github.com/aws/aws-sdk-go-v2/service/lambda"
     "k8s.io/client-go/kubernetes"
     batchv1 "k8s.io/api/batch/v1"
     corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/errors"
     metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/watch"
     "k8s.io/utils/pointer"
 )
 
@@ -23,107 +28,196 @@ type DefaultTaskExecutor struct {
     lambdaClient  *lambda.Client
     kubeClient    kubernetes.Interface
     metricsCollector *MetricsCollector
+    registry      *TaskRegistry
+    workerQueue   *WorkerTaskQueue
 }
 
-func NewDefaultTaskExecutor(kubeClient kubernetes.Interface) (*DefaultTaskExecutor, error) {
+var httpParameterSchema = &ParameterSchema{
+    Fields: []ParameterField{
+        {Path: "http", Type: FieldTypeObject, Required: true},
+        {Path: "http.uri", Type: FieldTypeString, Required: true},
+        {Path: "http.method", Type: FieldTypeString, Required: true, Enum: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"}},
+        {Path: "http.contentType", Type: FieldTypeString},
+    },
+}
+
+var forkJoinParameterSchema = &ParameterSchema{
+    Fields: []ParameterField{
+        {Path: "forkTasks", Type: FieldTypeArray, Required: true},
+        {Path: "joinPolicy", Type: FieldTypeString, Enum: []string{JoinAll, JoinAllRequired, JoinAny, JoinNOfM}},
+        {Path: "joinCount", Type: FieldTypeNumber},
+    },
+}
+
+var subWorkflowParameterSchema = &ParameterSchema{
+    Fields: []ParameterField{
+        {Path: "subWorkflow", Type: FieldTypeObject, Required: true},
+        {Path: "subWorkflow.name", Type: FieldTypeString, Required: true},
+        {Path: "outputs", Type: FieldTypeObject},
+    },
+}
+
+var kubernetesJobParameterSchema = &ParameterSchema{
+    Fields: []ParameterField{
+        {Path: "job", Type: FieldTypeObject, Required: true},
+        {Path: "job.image", Type: FieldTypeString, Required: true},
+        {Path: "job.command", Type: FieldTypeArray},
+        {Path: "job.env", Type: FieldTypeObject},
+    },
+}
+
+func NewDefaultTaskExecutor(kubeClient kubernetes.Interface, metricsCollector *MetricsCollector, workerLeaseDuration time.Duration) (*DefaultTaskExecutor, error) {
     // Configure AWS Lambda client
     cfg, err := config.LoadDefaultConfig(context.Background())
     if err != nil {
         return nil, fmt.Errorf("unable to load AWS config: %v", err)
     }
 
-    return &DefaultTaskExecutor{
+    e := &DefaultTaskExecutor{
         httpClient: &http.Client{
             Timeout: time.Second * 30,
         },
         lambdaClient: lambda.NewFromConfig(cfg),
         kubeClient: kubeClient,
-        metricsCollector: NewMetricsCollector(),
-    }, nil
+        metricsCollector: metricsCollector,
+        registry: NewTaskRegistry(),
+        workerQueue: NewWorkerTaskQueue(workerLeaseDuration, metricsCollector),
+    }
+
+    builtins := map[string]TaskHandler{
+        "HTTP": NewTaskHandler(httpParameterSchema, func(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+            return e.executeHTTPTask(ctx, task)
+        }),
+        "LAMBDA": NewTaskHandler(nil, func(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+            return e.executeLambdaTask(ctx, task)
+        }),
+        "SIMPLE":         NewTaskHandler(nil, e.executeSimpleTask),
+        "FORK_JOIN":      NewTaskHandler(forkJoinParameterSchema, e.executeForkJoinTask),
+        "KUBERNETES_JOB": NewTaskHandler(kubernetesJobParameterSchema, e.executeKubernetesJob),
+        "DYNAMIC":        NewTaskHandler(dynamicParameterSchema, e.executeDynamicTask),
+        "DYNAMIC_FORK":   NewTaskHandler(dynamicForkParameterSchema, e.executeForkJoinTask),
+        "SUB_WORKFLOW":   NewTaskHandler(subWorkflowParameterSchema, e.executeSubWorkflowTask),
+    }
+    for taskType, handler := range builtins {
+        if err := e.registry.Register(taskType, handler); err != nil {
+            return nil, err
+        }
+    }
+
+    return e, nil
 }
 
-func (e *DefaultTaskExecutor) ExecuteTask(task Task, workflow *Workflow) error {
-    startTime := time.Now()
-    var err error
+// WorkerQueue is the queue external workers poll for SIMPLE tasks
+func (e *DefaultTaskExecutor) WorkerQueue() *WorkerTaskQueue {
+    return e.workerQueue
+}
 
-    switch task.TaskType {
-    case "KUBERNETES_JOB":
-        err = e.executeKubernetesJob(task, workflow)
-    case "HTTP":
-        err = e.executeHTTPTask(task)
-    case "LAMBDA":
-        err = e.executeLambdaTask(task)
-    case "SIMPLE":
-        err = e.executeSimpleTask(task)
-    case "FORK_JOIN":
-        err = e.executeForkJoinTask(task, workflow)
-    default:
-        err = fmt.Errorf("unsupported task type: %s", task.TaskType)
+// Registry exposes the task type registry so additional handlers can be
+// registered before the controller starts
+func (e *DefaultTaskExecutor) Registry() *TaskRegistry {
+    return e.registry
+}
+
+// ValidateTask checks a task against its handler before it is scheduled
+func (e *DefaultTaskExecutor) ValidateTask(task Task) error {
+    return e.registry.Validate(task)
+}
+
+func (e *DefaultTaskExecutor) ExecuteTask(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+    startTime := time.Now()
+    var output map[string]interface{}
+
+    // Parameters are validated again now that expressions are resolved
+    err := e.registry.Validate(task)
+    if err == nil {
+        var handler TaskHandler
+        handler, err = e.registry.Handler(task.TaskType)
+        if err == nil {
+            output, err = handler.Execute(ctx, task, run)
+        }
     }
 
     duration := time.Since(startTime).Seconds()
     status := "success"
-    if err != nil {
+    if ctx.Err() != nil {
+        status = "cancelled"
+    } else if err != nil {
         status = "failed"
-        e.metricsCollector.RecordError("task_execution_error")
+        e.metricsCollector.RecordError("task_execution_error", run.Workflow.Spec.Name)
     }
-    e.metricsCollector.RecordTaskExecution(task.TaskType, status, duration)
-    return err
+    e.metricsCollector.RecordTaskExecution(task.TaskType, status, duration, run.Workflow.Spec.Name, task.Name)
+    return output, err
 }
 
-func (e *DefaultTaskExecutor) executeHTTPTask(task Task) error {
+func (e *DefaultTaskExecutor) executeHTTPTask(ctx context.Context, task Task) (map[string]interface{}, error) {
     params, ok := task.InputParameters["http"].(map[string]interface{})
     if !ok {
-        return fmt.Errorf("invalid HTTP parameters for task %s", task.Name)
+        return nil, fmt.Errorf("invalid HTTP parameters for task %s", task.Name)
     }
 
     // Extract HTTP parameters
     uri := params["uri"].(string)
     method := params["method"].(string)
-    contentType := params["contentType"].(string)
+    contentType, ok := params["contentType"].(string)
+    if !ok {
+        contentType = "application/json"
+    }
 
     var body []byte
     if params["body"] != nil {
         body, _ = json.Marshal(params["body"])
     }
 
-    // Create and execute request
-    req, err := http.NewRequest(method, uri, bytes.NewBuffer(body))
-    if err != nil {
-        return fmt.Errorf("failed to create HTTP request: %v", err)
-    }
-
-    req.Header.Set("Content-Type", contentType)
-
-    // Execute with retry logic
+    // Execute with retry logic; the request is rebuilt on every attempt
+    // because sending it consumes the body
     var resp *http.Response
+    var err error
     for retries := 0; retries <= task.RetryCount; retries++ {
+        req, reqErr := http.NewRequestWithContext(ctx, method, uri, bytes.NewBuffer(body))
+        if reqErr != nil {
+            return nil, fmt.Errorf("failed to create HTTP request: %v", reqErr)
+        }
+        req.Header.Set("Content-Type", contentType)
+
         resp, err = e.httpClient.Do(req)
         if err == nil && resp.StatusCode < 500 {
             break
         }
         
         if retries < task.RetryCount {
-            delay := e.calculateRetryDelay(task, retries)
-            time.Sleep(delay)
+            if err == nil {
+                resp.Body.Close()
+            }
+            if sleepErr := sleepContext(ctx, e.calculateRetryDelay(task, retries)); sleepErr != nil {
+                return nil, sleepErr
+            }
         }
     }
 
     if err != nil {
-        return fmt.Errorf("HTTP request failed after %d retries: %v", task.RetryCount, err)
+        return nil, fmt.Errorf("HTTP request failed after %d retries: %v", task.RetryCount, err)
     }
+    defer resp.Body.Close()
 
     if resp.StatusCode >= 400 {
-        return fmt.Errorf("HTTP request failed with status %d", resp.StatusCode)
+        return nil, fmt.Errorf("HTTP request failed with status %d", resp.StatusCode)
     }
 
-    return nil
+    respBody, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read HTTP response: %v", err)
+    }
+
+    return map[string]interface{}{
+        "statusCode": int64(resp.StatusCode),
+        "body":       decodePayload(respBody),
+    }, nil
 }
 
-func (e *DefaultTaskExecutor) executeLambdaTask(task Task) error {
+func (e *DefaultTaskExecutor) executeLambdaTask(ctx context.Context, task Task) (map[string]interface{}, error) {
     params, err := json.Marshal(task.InputParameters)
     if err != nil {
-        return fmt.Errorf("failed to marshal Lambda parameters: %v", err)
+        return nil, fmt.Errorf("failed to marshal Lambda parameters: %v", err)
     }
 
     input := &lambda.InvokeInput{
@@ -134,95 +228,77 @@ func (e *DefaultTaskExecutor) executeLambdaTask(task Task) error {
     // Execute with retry logic
     var output *lambda.InvokeOutput
     for retries := 0; retries <= task.RetryCount; retries++ {
-        output, err = e.lambdaClient.Invoke(context.Background(), input)
+        output, err = e.lambdaClient.Invoke(ctx, input)
         if err == nil && output.FunctionError == nil {
             break
         }
         
         if retries < task.RetryCount {
-            delay := e.calculateRetryDelay(task, retries)
-            time.Sleep(delay)
+            if sleepErr := sleepContext(ctx, e.calculateRetryDelay(task, retries)); sleepErr != nil {
+                return nil, sleepErr
+            }
         }
     }
 
     if err != nil {
-        return fmt.Errorf("Lambda invocation failed after %d retries: %v", task.RetryCount, err)
+        return nil, fmt.Errorf("Lambda invocation failed after %d retries: %v", task.RetryCount, err)
     }
 
     if output.FunctionError != nil {
-        return fmt.Errorf("Lambda function returned error: %s", *output.FunctionError)
+        return nil, fmt.Errorf("Lambda function returned error: %s", *output.FunctionError)
     }
 
-    return nil
+    return map[string]interface{}{
+        "statusCode": int64(output.StatusCode),
+        "payload":    decodePayload(output.Payload),
+    }, nil
 }
 
-func (e *DefaultTaskExecutor) executeSimpleTask(task Task) error {
-    // Simple tasks are implemented by the user and registered with the controller
-    // Here we'll just log and succeed
-    log.Printf("Executing simple task: %s with parameters: %v", task.Name, task.InputParameters)
-    return nil
+func (e *DefaultTaskExecutor) executeSimpleTask(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+    // Simple tasks are implemented by external workers polling the worker API;
+    // this blocks until one of them completes the task
+    log.Printf("Queuing simple task: %s with parameters: %v", task.Name, task.InputParameters)
+    return e.workerQueue.Execute(ctx, task, run)
 }
 
-func (e *DefaultTaskExecutor) executeForkJoinTask(task Task, workflow *Workflow) error {
-    forkTasks, ok := task.InputParameters["forkTasks"].([]interface{})
-    if !ok {
-        return fmt.Errorf("invalid fork tasks configuration")
-    }
-
-    var wg sync.WaitGroup
-    errors := make(chan error, len(forkTasks))
-
-    for _, t := range forkTasks {
-        wg.Add(1)
-        go func(taskData interface{}) {
-            defer wg.Done()
-
-            // Convert task data to Task struct
-            taskBytes, _ := json.Marshal(taskData)
-            var subTask Task
-            if err := json.Unmarshal(taskBytes, &subTask); err != nil {
-                errors <- fmt.Errorf("failed to parse fork task: %v", err)
-                return
-            }
-
-            // Execute the subtask
-            if err := e.ExecuteTask(subTask, workflow); err != nil {
-                errors <- fmt.Errorf("fork task %s failed: %v", subTask.Name, err)
-            }
-        }(t)
-    }
-
-    // Wait for all tasks to complete
-    wg.Wait()
-    close(errors)
-
-    // Collect any errors
-    var errs []string
-    for err := range errors {
-        errs = append(errs, err.Error())
-    }
+func (e *DefaultTaskExecutor) executeForkJoinTask(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+    // Fork branches are expanded into the workflow's DAG and joined by the
+    // scheduler; the handler is only registered for parameter validation
+    return nil, fmt.Errorf("fork task %s must be run by the scheduler", task.Name)
+}
 
-    if len(errs) > 0 {
-        return fmt.Errorf("fork-join task errors: %v", errs)
+// executeSubWorkflowTask completes a sub-workflow once its inlined tasks
+// have finished, passing on their outputs
+func (e *DefaultTaskExecutor) executeSubWorkflowTask(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+    // The TemplateManager inlines sub-workflows and fills in outputs
+    outputs, ok := task.InputParameters["outputs"].(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("sub-workflow task %s was not expanded; SUB_WORKFLOW tasks are only supported in WorkflowTemplates", task.Name)
     }
-
-    return nil
+    return outputs, nil
 }
 
-func (e *DefaultTaskExecutor) executeKubernetesJob(task Task, workflow *Workflow) error {
+func (e *DefaultTaskExecutor) executeKubernetesJob(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
     params, ok := task.InputParameters["job"].(map[string]interface{})
     if !ok {
-        return fmt.Errorf("invalid Kubernetes Job parameters for task %s", task.Name)
+        return nil, fmt.Errorf("invalid Kubernetes Job parameters for task %s", task.Name)
     }
 
-    // Create the Job object
+    // command and env are optional; the schema guarantees their types
+    command, _ := params["command"].([]interface{})
+    env, _ := params["env"].(map[string]interface{})
+
+    // Create the Job object. Each attempt gets a fresh name, since the Job of
+    // a cancelled attempt may still be terminating.
     job := &batchv1.Job{
         ObjectMeta: metav1.ObjectMeta{
-            Name:      fmt.Sprintf("%s-%s", workflow.Name, task.Name),
-            Namespace: workflow.Namespace,
+            GenerateName:    fmt.Sprintf("%s-%s-", run.Name, task.Name),
+            Namespace:       run.Namespace,
+            OwnerReferences: []metav1.OwnerReference{runOwnerReference(run)},
             Labels: map[string]string{
-                "workflow": workflow.Name,
-                "task":    task.Name,
+                "workflow":     run.Workflow.Spec.Name,
+                "workflow-run": run.Name,
+                "task":         task.Name,
             },
         },
         Spec: batchv1.JobSpec{
@@ -233,68 +309,206 @@ func (e *DefaultTaskExecutor) executeKubernetesJob(task Task, workflow *Workflow
                         {
                             Name:    task.Name,
                             Image:   params["image"].(string),
-                            Command: interfaceSliceToStringSlice(params["command"].([]interface{})),
-                            Env:     createEnvVarsFromMap(params["env"].(map[string]interface{})),
+                            Command: interfaceSliceToStringSlice(command),
+                            Env:     createEnvVarsFromMap(env),
+                            // The job reports its output by writing JSON to
+                            // /dev/termination-log
+                            TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
                         },
                     },
                 },
             },
-            BackoffLimit: pointer.Int32Ptr(task.RetryCount),
+            BackoffLimit: pointer.Int32Ptr(int32(task.RetryCount)),
         },
     }
 
     // Create the job
-    createdJob, err := e.kubeClient.BatchV1().Jobs(workflow.Namespace).Create(
-        context.Background(),
+    createdJob, err := e.kubeClient.BatchV1().Jobs(run.Namespace).Create(
+        ctx,
         job,
         metav1.CreateOptions{},
     )
     if err != nil {
-        return fmt.Errorf("failed to create job: %v", err)
+        return nil, fmt.Errorf("failed to create job: %v", err)
     }
 
     // Watch job completion
-    return e.waitForJobCompletion(createdJob.Namespace, createdJob.Name, task)
+    if err := e.waitForJobCompletion(ctx, createdJob.Namespace, createdJob.Name, createdJob.ResourceVersion); err != nil {
+        if ctx.Err() != nil {
+            e.deleteJob(createdJob.Namespace, createdJob.Name)
+        }
+        return nil, err
+    }
+
+    return e.readJobResult(ctx, createdJob.Namespace, createdJob.Name)
 }
 
-func (e *DefaultTaskExecutor) waitForJobCompletion(namespace, name string, task Task) error {
-    watch, err := e.kubeClient.BatchV1().Jobs(namespace).Watch(
+// deleteJob removes the Job of a cancelled task together with its pods. It
+// runs after the task's context is done, so it uses its own.
+func (e *DefaultTaskExecutor) deleteJob(namespace, name string) {
+    propagation := metav1.DeletePropagationBackground
+    err := e.kubeClient.BatchV1().Jobs(namespace).Delete(
         context.Background(),
+        name,
+        metav1.DeleteOptions{PropagationPolicy: &propagation},
+    )
+    if err != nil && !errors.IsNotFound(err) {
+        log.Printf("Error deleting job %s/%s of cancelled task: %v", namespace, name, err)
+    }
+}
+
+// readJobResult returns the termination message of the job's succeeded pod
+func (e *DefaultTaskExecutor) readJobResult(ctx context.Context, namespace, name string) (map[string]interface{}, error) {
+    pods, err := e.kubeClient.CoreV1().Pods(namespace).List(
+        ctx,
+        metav1.ListOptions{
+            LabelSelector: fmt.Sprintf("job-name=%s", name),
+        },
+    )
+    if err != nil {
+        return nil, fmt.Errorf("failed to list pods of job %s: %v", name, err)
+    }
+
+    output := map[string]interface{}{
+        "jobName": name,
+    }
+    for _, pod := range pods.Items {
+        if pod.Status.Phase != corev1.PodSucceeded {
+            continue
+        }
+        for _, status := range pod.Status.ContainerStatuses {
+            if status.State.Terminated != nil && status.State.Terminated.Message != "" {
+                output["result"] = decodePayload([]byte(status.State.Terminated.Message))
+                return output, nil
+            }
+        }
+    }
+    return output, nil
+}
+
+// decodePayload returns JSON payloads as structured values and anything
+// else as a plain string
+func decodePayload(data []byte) interface{} {
+    if len(bytes.TrimSpace(data)) == 0 {
+        return nil
+    }
+    var value interface{}
+    if err := json.Unmarshal(data, &value); err != nil {
+        return string(data)
+    }
+    return value
+}
+
+// waitForJobCompletion watches the job, starting at resourceVersion, until it
+// completes or fails. A watch that closes or breaks off is picked up again
+// from the job's current state, so only the job itself can fail the task.
+// The task timeout is carried by ctx.
+func (e *DefaultTaskExecutor) waitForJobCompletion(ctx context.Context, namespace, name, resourceVersion string) error {
+    for {
+        finished, err := e.watchJob(ctx, namespace, name, &resourceVersion)
+        if finished {
+            return err
+        }
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        if err != nil {
+            log.Printf("Watch of job %s/%s broke off, re-reading it: %v", namespace, name, err)
+        }
+
+        // Events may have been missed, or resourceVersion may be too old to
+        // watch from
+        job, err := e.kubeClient.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+        switch {
+        case err == nil:
+            if finished, err := jobFinished(job); finished {
+                return err
+            }
+            resourceVersion = job.ResourceVersion
+            continue
+        case errors.IsNotFound(err):
+            return fmt.Errorf("job %s was deleted", name)
+        case ctx.Err() == nil:
+            log.Printf("Error getting job %s/%s: %v", namespace, name, err)
+        }
+        select {
+        case <-time.After(jobWatchRetryInterval):
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+// jobWatchRetryInterval spaces out attempts to read a job the API server
+// doesn't return
+const jobWatchRetryInterval = 5 * time.Second
+
+// watchJob follows the job until it finishes, the watch ends or ctx is done,
+// keeping resourceVersion at the last version seen. err is set when the job
+// failed or the watch broke off.
+func (e *DefaultTaskExecutor) watchJob(ctx context.Context, namespace, name string, resourceVersion *string) (bool, error) {
+    watcher, err := e.kubeClient.BatchV1().Jobs(namespace).Watch(
+        ctx,
         metav1.ListOptions{
-            FieldSelector: fmt.Sprintf("metadata.name=%s", name),
+            FieldSelector:       fmt.Sprintf("metadata.name=%s", name),
+            ResourceVersion:     *resourceVersion,
+            AllowWatchBookmarks: true,
         },
     )
     if err != nil {
-        return fmt.Errorf("failed to watch job: %v", err)
+        return false, fmt.Errorf("failed to watch job: %v", err)
     }
-    defer watch.Stop()
+    defer watcher.Stop()
 
-    timeout := time.After(time.Duration(task.TimeoutSeconds) * time.Second)
     for {
         select {
-        case event := <-watch.ResultChan():
+        case event, ok := <-watcher.ResultChan():
+            if !ok {
+                return false, nil
+            }
+            if event.Type == watch.Error {
+                return false, errors.FromObject(event.Object)
+            }
             job, ok := event.Object.(*batchv1.Job)
             if !ok {
                 continue
             }
+            *resourceVersion = job.ResourceVersion
 
-            if job.Status.Succeeded > 0 {
-                return nil
+            if event.Type == watch.Deleted {
+                return true, fmt.Errorf("job %s was deleted", name)
             }
-            if job.Status.Failed > 0 {
-                return fmt.Errorf("job failed")
+            if finished, err := jobFinished(job); finished {
+                return true, err
             }
 
-        case <-timeout:
-            return fmt.Errorf("job timed out")
+        case <-ctx.Done():
+            return false, ctx.Err()
         }
     }
 }
 
+// jobFinished reports whether the job has completed or, having run out of
+// retries, failed
+func jobFinished(job *batchv1.Job) (bool, error) {
+    for _, condition := range job.Status.Conditions {
+        if condition.Status != corev1.ConditionTrue {
+            continue
+        }
+        switch condition.Type {
+        case batchv1.JobComplete:
+            return true, nil
+        case batchv1.JobFailed:
+            return true, fmt.Errorf("job failed: %s: %s", condition.Reason, condition.Message)
+        }
+    }
+    return false, nil
+}
+
 func interfaceSliceToStringSlice(slice []interface{}) []string {
     result := make([]string, len(slice))
     for i, v := range slice {
-        result[i] = v.(string)
+        result[i] = fmt.Sprintf("%v", v)
     }
     return result
 }
@@ -310,6 +524,19 @@ func createEnvVarsFromMap(envMap map[string]interface{}) []corev1.EnvVar {
     return envVars
 }
 
+// sleepContext waits for d, returning early with the context's error if ctx
+// is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+    timer := time.NewTimer(d)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
 func (e *DefaultTaskExecutor) calculateRetryDelay(task Task, attempt int) time.Duration {
     baseDelay := time.Second
 
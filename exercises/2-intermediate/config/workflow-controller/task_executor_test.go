@@ -0,0 +1,96 @@
+package main
+
+import (
+    "context"
+    "strings"
+    "testing"
+    "time"
+
+    batchv1 "k8s.io/api/batch/v1"
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/watch"
+    "k8s.io/client-go/kubernetes/fake"
+    k8stesting "k8s.io/client-go/testing"
+)
+
+func jobWithCondition(conditionType batchv1.JobConditionType, failed int32) *batchv1.Job {
+    job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "encode", Namespace: "media", ResourceVersion: "2"}}
+    job.Status.Failed = failed
+    if conditionType != "" {
+        job.Status.Conditions = []batchv1.JobCondition{{Type: conditionType, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded"}}
+    }
+    return job
+}
+
+func TestWaitForJobCompletion(t *testing.T) {
+    tests := []struct {
+        name    string
+        // events are sent on successive watches, each closed after its events
+        events  [][]*batchv1.Job
+        wantErr string
+    }{
+        {
+            name:   "completes after the watch closes",
+            events: [][]*batchv1.Job{{jobWithCondition("", 0)}, {jobWithCondition(batchv1.JobComplete, 0)}},
+        },
+        {
+            name:   "failed pods are retried by the job",
+            events: [][]*batchv1.Job{{jobWithCondition("", 1)}, {}, {jobWithCondition("", 2), jobWithCondition(batchv1.JobComplete, 2)}},
+        },
+        {
+            name:    "fails once the job does",
+            events:  [][]*batchv1.Job{{}, {jobWithCondition(batchv1.JobFailed, 3)}},
+            wantErr: "job failed: BackoffLimitExceeded",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client := fake.NewSimpleClientset(jobWithCondition("", 0))
+            watches := 0
+            client.PrependWatchReactor("jobs", func(action k8stesting.Action) (bool, watch.Interface, error) {
+                watcher := watch.NewFake()
+                if watches < len(tt.events) {
+                    events := tt.events[watches]
+                    go func() {
+                        for _, job := range events {
+                            watcher.Modify(job)
+                        }
+                        watcher.Stop()
+                    }()
+                }
+                watches++
+                return true, watcher, nil
+            })
+
+            ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+            defer cancel()
+            executor := &DefaultTaskExecutor{kubeClient: client}
+            err := executor.waitForJobCompletion(ctx, "media", "encode", "1")
+            switch {
+            case tt.wantErr == "" && err != nil:
+                t.Fatalf("unexpected error: %v", err)
+            case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+                t.Fatalf("got error %v, want %q", err, tt.wantErr)
+            }
+            if watches != len(tt.events) {
+                t.Errorf("watched %d times, want %d", watches, len(tt.events))
+            }
+        })
+    }
+}
+
+func TestWaitForJobCompletionCancelled(t *testing.T) {
+    client := fake.NewSimpleClientset(jobWithCondition("", 0))
+    client.PrependWatchReactor("jobs", func(action k8stesting.Action) (bool, watch.Interface, error) {
+        return true, watch.NewFake(), nil
+    })
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    executor := &DefaultTaskExecutor{kubeClient: client}
+    if err := executor.waitForJobCompletion(ctx, "media", "encode", "1"); err != context.DeadlineExceeded {
+        t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+    }
+}
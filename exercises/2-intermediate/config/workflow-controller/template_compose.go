@@ -0,0 +1,470 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Templates are composed in two ways.
+//
+// extends inherits the parameters and tasks of a base template. A parameter
+// or task of the same name replaces the inherited one in place; new ones are
+// added after the base's. Parameters set in extends become the defaults of
+// the base's parameters:
+//
+//     spec:
+//       name: nightly-pipeline
+//       version: 1
+//       extends:
+//         name: data-processing-pipeline
+//         version: 1
+//         parameters:
+//           processingImage: "data-processor:2.3"
+//
+// A SUB_WORKFLOW task includes another template. Its tasks are inlined as
+// <task>-<subtask>; those without dependencies inherit the SUB_WORKFLOW
+// task's dependsOn, and the SUB_WORKFLOW task itself completes once they
+// have all finished, with their outputs keyed by subtask name:
+//
+//     - name: notify
+//       taskType: SUB_WORKFLOW
+//       dependsOn: ["process-data"]
+//       subWorkflow:
+//         name: pipeline-notifications
+//         parameters:
+//           channel: "${notifyChannel}"
+//
+// Downstream tasks read ${notify.output.<subtask>.<field>}. Sub-workflow
+// parameters are resolved against the including template's parameters.
+
+const (
+    templateLabelPrefix = "template.conductor.netflix.com/"
+    // deprecatedTemplatesAnnotation lists the deprecated templates a
+    // generated workflow uses
+    deprecatedTemplatesAnnotation = "conductor.netflix.com/deprecated-templates"
+)
+
+// composition tracks the templates visited while resolving one template, to
+// detect cycles and to record the versions used
+type composition struct {
+    stack      []*WorkflowTemplate
+    versions   map[string]map[int]bool
+    deprecated []string
+}
+
+func newComposition(root *WorkflowTemplate) *composition {
+    c := &composition{versions: make(map[string]map[int]bool)}
+    c.enter(root)
+    return c
+}
+
+// enter pushes a template, failing if it is already being resolved
+func (c *composition) enter(template *WorkflowTemplate) error {
+    for i, visiting := range c.stack {
+        if visiting.Spec.Name != template.Spec.Name || visiting.Spec.Version != template.Spec.Version {
+            continue
+        }
+        var cycle []string
+        for _, t := range append(c.stack[i:], template) {
+            cycle = append(cycle, fmt.Sprintf("%s v%d", t.Spec.Name, t.Spec.Version))
+        }
+        return fmt.Errorf("template composition cycle: %s", strings.Join(cycle, " -> "))
+    }
+
+    c.stack = append(c.stack, template)
+    if c.versions[template.Spec.Name] == nil {
+        c.versions[template.Spec.Name] = make(map[int]bool)
+    }
+    if !c.versions[template.Spec.Name][template.Spec.Version] && template.deprecated() {
+        note := fmt.Sprintf("%s v%d", template.Spec.Name, template.Spec.Version)
+        if template.Lifecycle.Message != "" {
+            note += " (" + template.Lifecycle.Message + ")"
+        }
+        c.deprecated = append(c.deprecated, note)
+    }
+    c.versions[template.Spec.Name][template.Spec.Version] = true
+    return nil
+}
+
+func (c *composition) leave() {
+    c.stack = c.stack[:len(c.stack)-1]
+}
+
+// labels records every template version used, as
+// template.conductor.netflix.com/<name>: "<version>". A template used at
+// several versions lists them all, e.g. "1_2".
+func (c *composition) labels() map[string]string {
+    labels := make(map[string]string, len(c.versions))
+    for name, versions := range c.versions {
+        var sorted []int
+        for version := range versions {
+            sorted = append(sorted, version)
+        }
+        sort.Ints(sorted)
+        values := make([]string, len(sorted))
+        for i, version := range sorted {
+            values[i] = strconv.Itoa(version)
+        }
+        labels[templateLabelPrefix+name] = strings.Join(values, "_")
+    }
+    return labels
+}
+
+// templateVersionsFromLabels reads back the versions recorded by labels
+func templateVersionsFromLabels(labels map[string]string) map[string][]int {
+    versions := make(map[string][]int)
+    for key, value := range labels {
+        if !strings.HasPrefix(key, templateLabelPrefix) {
+            continue
+        }
+        name := strings.TrimPrefix(key, templateLabelPrefix)
+        for _, v := range strings.Split(value, "_") {
+            if version, err := strconv.Atoi(v); err == nil {
+                versions[name] = append(versions[name], version)
+            }
+        }
+    }
+    return versions
+}
+
+// composedRefs lists the templates a template extends or includes
+func composedRefs(template *WorkflowTemplate) []*TemplateRef {
+    var refs []*TemplateRef
+    if template.Spec.Extends != nil {
+        refs = append(refs, template.Spec.Extends)
+    }
+    for _, taskTemplate := range template.Spec.Tasks {
+        if taskTemplate.TaskType == "SUB_WORKFLOW" && taskTemplate.SubWorkflow != nil {
+            refs = append(refs, taskTemplate.SubWorkflow)
+        }
+    }
+    return refs
+}
+
+// checkCyclesLocked follows extends and includes through the loaded
+// templates. Templates that aren't loaded yet are skipped; expansion checks
+// again once they are.
+func (tm *TemplateManager) checkCyclesLocked(template *WorkflowTemplate, c *composition) error {
+    for _, ref := range composedRefs(template) {
+        next, err := tm.findLocked(ref, false)
+        if err != nil {
+            continue
+        }
+        if err := c.enter(next); err != nil {
+            return err
+        }
+        err = tm.checkCyclesLocked(next, c)
+        c.leave()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// resolveExtendsLocked returns the template's spec with everything it
+// inherits merged in. The merged spec is validated as a whole, since tasks
+// and parameter references may span the inheritance chain.
+func (tm *TemplateManager) resolveExtendsLocked(template *WorkflowTemplate, c *composition) (WorkflowTemplateSpec, error) {
+    spec := template.Spec
+    if spec.Extends == nil {
+        return spec, nil
+    }
+
+    base, err := tm.findLocked(spec.Extends, false)
+    if err != nil {
+        return spec, err
+    }
+    if err := c.enter(base); err != nil {
+        return spec, err
+    }
+    baseSpec, err := tm.resolveExtendsLocked(base, c)
+    c.leave()
+    if err != nil {
+        return spec, err
+    }
+
+    merged := spec
+    merged.Extends = nil
+    merged.Parameters = mergeParameters(baseSpec.Parameters, spec.Parameters)
+    merged.Tasks = mergeTaskTemplates(baseSpec.Tasks, spec.Tasks)
+
+    for _, name := range sortedKeys(spec.Extends.Parameters) {
+        found := false
+        for i := range merged.Parameters {
+            if merged.Parameters[i].Name == name {
+                merged.Parameters[i].Default = spec.Extends.Parameters[name]
+                found = true
+            }
+        }
+        if !found {
+            return spec, fmt.Errorf("template %s version %d extends %s with unknown parameter %s", spec.Name, spec.Version, base.Spec.Name, name)
+        }
+    }
+
+    if err := validateTemplateTasks(merged); err != nil {
+        return spec, err
+    }
+    if err := validateParameterDeclarations(&WorkflowTemplate{Spec: merged}); err != nil {
+        return spec, err
+    }
+    return merged, nil
+}
+
+// ResolvedSpec returns a template's spec with everything it inherits merged in
+func (tm *TemplateManager) ResolvedSpec(template *WorkflowTemplate) (WorkflowTemplateSpec, error) {
+    tm.mutex.RLock()
+    defer tm.mutex.RUnlock()
+
+    return tm.resolveExtendsLocked(template, newComposition(template))
+}
+
+func mergeParameters(base, own []Parameter) []Parameter {
+    merged := append([]Parameter{}, base...)
+    for _, param := range own {
+        replaced := false
+        for i := range merged {
+            if merged[i].Name == param.Name {
+                merged[i] = param
+                replaced = true
+            }
+        }
+        if !replaced {
+            merged = append(merged, param)
+        }
+    }
+    return merged
+}
+
+func mergeTaskTemplates(base, own []TaskTemplate) []TaskTemplate {
+    merged := append([]TaskTemplate{}, base...)
+    for _, taskTemplate := range own {
+        replaced := false
+        for i := range merged {
+            if merged[i].Name == taskTemplate.Name {
+                merged[i] = taskTemplate
+                replaced = true
+            }
+        }
+        if !replaced {
+            merged = append(merged, taskTemplate)
+        }
+    }
+    return merged
+}
+
+// expandTasksLocked turns a resolved template spec into workflow tasks,
+// inlining SUB_WORKFLOW tasks recursively
+func (tm *TemplateManager) expandTasksLocked(spec WorkflowTemplateSpec, params map[string]interface{}, c *composition) ([]Task, error) {
+    values, err := validateParameterValues(&WorkflowTemplate{Spec: spec}, params)
+    if err != nil {
+        return nil, err
+    }
+
+    var tasks []Task
+    for i, taskTemplate := range spec.Tasks {
+        if taskTemplate.TaskType == "SUB_WORKFLOW" {
+            included, err := tm.includeLocked(taskTemplate, values, fmt.Sprintf("spec.tasks[%d]", i), c)
+            if err != nil {
+                return nil, err
+            }
+            tasks = append(tasks, included...)
+            continue
+        }
+
+        inputParameters, err := tm.resolveInputParameters(taskTemplate.InputTemplate, values, fmt.Sprintf("spec.tasks[%d].inputTemplate", i))
+        if err != nil {
+            return nil, err
+        }
+        tasks = append(tasks, Task{
+            Name:            taskTemplate.Name,
+            TaskType:        taskTemplate.TaskType,
+            RetryCount:      taskTemplate.RetryCount,
+            RetryLogic:      taskTemplate.RetryLogic,
+            TimeoutSeconds:  taskTemplate.TimeoutSeconds,
+            Optional:        taskTemplate.Optional,
+            DependsOn:       taskTemplate.DependsOn,
+            InputParameters: inputParameters,
+        })
+    }
+    return tasks, nil
+}
+
+// includeLocked expands the template a SUB_WORKFLOW task includes and
+// returns its tasks, renamed into the including template, followed by the
+// SUB_WORKFLOW task that gathers their outputs
+func (tm *TemplateManager) includeLocked(taskTemplate TaskTemplate, values map[string]interface{}, path string, c *composition) ([]Task, error) {
+    ref := taskTemplate.SubWorkflow
+    if ref == nil {
+        return nil, fmt.Errorf("sub-workflow task %s has no subWorkflow", taskTemplate.Name)
+    }
+
+    params, err := tm.resolveInputParameters(ref.Parameters, values, path+".subWorkflow.parameters")
+    if err != nil {
+        return nil, err
+    }
+
+    included, err := tm.findLocked(ref, false)
+    if err != nil {
+        // Left unwrapped so the caller can tell a missing template apart
+        return nil, err
+    }
+    if err := c.enter(included); err != nil {
+        return nil, err
+    }
+    defer c.leave()
+
+    spec, err := tm.resolveExtendsLocked(included, c)
+    if err != nil {
+        return nil, err
+    }
+    tasks, err := tm.expandTasksLocked(spec, params, c)
+    if _, missing := err.(*templateNotFoundError); missing {
+        return nil, err
+    }
+    if err != nil {
+        return nil, fmt.Errorf("sub-workflow task %s: %v", taskTemplate.Name, err)
+    }
+
+    // Rename every task, fork branches included, so the same template can be
+    // included more than once
+    renames := make(map[string]string)
+    for _, task := range tasks {
+        collectTaskNames(task, taskTemplate.Name+"-", renames)
+    }
+
+    outputs := make(map[string]interface{})
+    node := Task{
+        Name:     taskTemplate.Name,
+        TaskType: "SUB_WORKFLOW",
+        Optional: taskTemplate.Optional,
+    }
+    for i, task := range tasks {
+        var dependsOn []string
+        for _, dep := range task.DependsOn {
+            if renamed, ok := renames[dep]; ok {
+                dep = renamed
+            }
+            dependsOn = append(dependsOn, dep)
+        }
+        if len(dependsOn) == 0 {
+            dependsOn = append(dependsOn, taskTemplate.DependsOn...)
+        }
+
+        renamed, _ := renameTaskReferences(task.InputParameters, renames).(map[string]interface{})
+        if task.TaskType == "FORK_JOIN" {
+            renameForkBranches(renamed, renames)
+        }
+        if !task.Optional {
+            outputs[task.Name] = "${" + renames[task.Name] + ".output}"
+        }
+
+        task.Name = renames[task.Name]
+        task.DependsOn = dependsOn
+        task.InputParameters = renamed
+        // An optional sub-workflow can't fail the including workflow
+        task.Optional = task.Optional || taskTemplate.Optional
+        tasks[i] = task
+        node.DependsOn = append(node.DependsOn, task.Name)
+    }
+
+    node.InputParameters = map[string]interface{}{
+        "subWorkflow": map[string]interface{}{
+            "name":    included.Spec.Name,
+            "version": int64(included.Spec.Version),
+        },
+        "outputs": outputs,
+    }
+    return append(tasks, node), nil
+}
+
+// collectTaskNames maps the names of a task and its fork branches to their
+// prefixed names
+func collectTaskNames(task Task, prefix string, renames map[string]string) {
+    renames[task.Name] = prefix + task.Name
+    if task.TaskType != "FORK_JOIN" {
+        return
+    }
+    branches, err := parseForkBranches(task)
+    if err != nil {
+        // Reported when the workflow's DAG is built
+        return
+    }
+    for _, branch := range branches {
+        collectTaskNames(branch, prefix, renames)
+    }
+}
+
+// renameForkBranches renames the forkTasks of a FORK_JOIN, recursively
+func renameForkBranches(inputParameters map[string]interface{}, renames map[string]string) {
+    forkTasks, _ := inputParameters["forkTasks"].([]interface{})
+    for _, forkTask := range forkTasks {
+        branch, ok := forkTask.(map[string]interface{})
+        if !ok {
+            continue
+        }
+        if name, ok := branch["name"].(string); ok && renames[name] != "" {
+            branch["name"] = renames[name]
+        }
+        if branchParams, ok := branch["inputParameters"].(map[string]interface{}); ok && branch["taskType"] == "FORK_JOIN" {
+            renameForkBranches(branchParams, renames)
+        }
+    }
+}
+
+// renameTaskReferences returns a copy of value with ${<task>.output...}
+// references pointed at renamed tasks. Other references are left alone.
+func renameTaskReferences(value interface{}, renames map[string]string) interface{} {
+    switch val := value.(type) {
+    case map[string]interface{}:
+        renamed := make(map[string]interface{}, len(val))
+        for k, v := range val {
+            renamed[k] = renameTaskReferences(v, renames)
+        }
+        return renamed
+    case []interface{}:
+        renamed := make([]interface{}, len(val))
+        for i, item := range val {
+            renamed[i] = renameTaskReferences(item, renames)
+        }
+        return renamed
+    case string:
+        exprs, err := splitExpressions(val)
+        if err != nil {
+            return val
+        }
+        var b strings.Builder
+        last := 0
+        for _, expr := range exprs {
+            if expr.escaped {
+                continue
+            }
+            ref, err := parseReference(expr.text)
+            if err != nil || ref.Kind != RefTaskOutput || renames[ref.Task] == "" {
+                continue
+            }
+            b.WriteString(val[last:expr.start])
+            b.WriteString("${" + strings.Join(append([]string{renames[ref.Task], "output"}, ref.Path...), ".") + "}")
+            last = expr.end
+        }
+        b.WriteString(val[last:])
+        return b.String()
+    default:
+        return value
+    }
+}
+
+// validateTemplateTasks rejects a broken dependency graph before any
+// workflow is created from the template
+func validateTemplateTasks(spec WorkflowTemplateSpec) error {
+    tasks := make([]Task, len(spec.Tasks))
+    for i, taskTemplate := range spec.Tasks {
+        tasks[i] = Task{Name: taskTemplate.Name, DependsOn: taskTemplate.DependsOn}
+    }
+    if _, err := BuildDAG(tasks); err != nil {
+        return fmt.Errorf("template %s version %d: %v", spec.Name, spec.Version, err)
+    }
+    return nil
+}
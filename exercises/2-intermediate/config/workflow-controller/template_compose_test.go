@@ -0,0 +1,283 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// composeManager loads templates without the checks AddTemplate runs, so
+// tests can set up compositions AddTemplate would refuse
+func composeManager(templates ...*WorkflowTemplate) *TemplateManager {
+    tm := NewTemplateManager()
+    for _, template := range templates {
+        if tm.templates[template.Spec.Name] == nil {
+            tm.templates[template.Spec.Name] = make(map[int]*WorkflowTemplate)
+        }
+        tm.templates[template.Spec.Name][template.Spec.Version] = template
+    }
+    return tm
+}
+
+func TestRenameTaskReferences(t *testing.T) {
+    renames := map[string]string{"prepare": "notify-prepare"}
+
+    tests := []struct {
+        name  string
+        value interface{}
+        want  interface{}
+    }{
+        {"task output", "${prepare.output}", "${notify-prepare.output}"},
+        {"output path", "id=${prepare.output.ids[0]}!", "id=${notify-prepare.output.ids[0]}!"},
+        {"other task", "${publish.output}", "${publish.output}"},
+        {"parameter", "${prepare}", "${prepare}"},
+        {"workflow input", "${workflow.input.prepare}", "${workflow.input.prepare}"},
+        {"escaped", "$${prepare.output} ${prepare.output}", "$${prepare.output} ${notify-prepare.output}"},
+        {"not a string", int64(3), int64(3)},
+        {
+            "nested",
+            map[string]interface{}{"ids": []interface{}{"${prepare.output.id}", true}},
+            map[string]interface{}{"ids": []interface{}{"${notify-prepare.output.id}", true}},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := renameTaskReferences(tt.value, renames)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("renameTaskReferences(%v) = %v, want %v", tt.value, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestIncludeTemplate(t *testing.T) {
+    notify := &WorkflowTemplate{Spec: WorkflowTemplateSpec{
+        Name:       "notify",
+        Version:    1,
+        Parameters: []Parameter{{Name: "channel", Required: true}},
+        Tasks: []TaskTemplate{
+            {Name: "prepare", TaskType: "SIMPLE", InputTemplate: map[string]interface{}{"channel": "${channel}"}},
+            {Name: "fan", TaskType: "FORK_JOIN", DependsOn: []string{"prepare"}, InputTemplate: map[string]interface{}{
+                "forkTasks": []interface{}{
+                    map[string]interface{}{"name": "email", "taskType": "SIMPLE"},
+                    map[string]interface{}{"name": "sms", "taskType": "SIMPLE"},
+                },
+            }},
+            {Name: "send", TaskType: "SIMPLE", DependsOn: []string{"fan"}, InputTemplate: map[string]interface{}{
+                "id":      "${prepare.output.id}",
+                "email":   "${email.output}",
+                "literal": "$${prepare.output.id}",
+            }},
+        },
+    }}
+    pipeline := &WorkflowTemplate{Spec: WorkflowTemplateSpec{
+        Name:       "pipeline",
+        Version:    1,
+        Parameters: []Parameter{{Name: "notifyChannel", Default: "ops"}},
+        Tasks: []TaskTemplate{
+            {Name: "process", TaskType: "SIMPLE"},
+            {Name: "notify", TaskType: "SUB_WORKFLOW", DependsOn: []string{"process"}, SubWorkflow: &TemplateRef{
+                Name:       "notify",
+                Parameters: map[string]interface{}{"channel": "${notifyChannel}"},
+            }},
+        },
+    }}
+
+    workflow, err := composeManager(notify, pipeline).CreateWorkflowFromTemplate(pipeline, nil)
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+
+    tasks := make(map[string]Task)
+    var order []string
+    for _, task := range workflow.Spec.Tasks {
+        tasks[task.Name] = task
+        order = append(order, task.Name)
+    }
+    wantOrder := []string{"process", "notify-prepare", "notify-fan", "notify-send", "notify"}
+    if !reflect.DeepEqual(order, wantOrder) {
+        t.Fatalf("tasks = %v, want %v", order, wantOrder)
+    }
+
+    dependsOn := map[string][]string{
+        // tasks without dependencies inherit the SUB_WORKFLOW task's
+        "notify-prepare": {"process"},
+        "notify-fan":     {"notify-prepare"},
+        "notify-send":    {"notify-fan"},
+        "notify":         {"notify-prepare", "notify-fan", "notify-send"},
+    }
+    for name, want := range dependsOn {
+        if got := tasks[name].DependsOn; !reflect.DeepEqual(got, want) {
+            t.Errorf("%s depends on %v, want %v", name, got, want)
+        }
+    }
+
+    if got := tasks["notify-prepare"].InputParameters["channel"]; got != "ops" {
+        t.Errorf("channel = %v, want ops", got)
+    }
+
+    branches, err := parseForkBranches(tasks["notify-fan"])
+    if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+    }
+    if len(branches) != 2 || branches[0].Name != "notify-email" || branches[1].Name != "notify-sms" {
+        t.Errorf("fork branches = %+v, want notify-email and notify-sms", branches)
+    }
+
+    wantInput := map[string]interface{}{
+        "id":      "${notify-prepare.output.id}",
+        "email":   "${notify-email.output}",
+        "literal": "$${prepare.output.id}",
+    }
+    if got := tasks["notify-send"].InputParameters; !reflect.DeepEqual(got, wantInput) {
+        t.Errorf("notify-send input = %v, want %v", got, wantInput)
+    }
+
+    wantOutputs := map[string]interface{}{
+        "prepare": "${notify-prepare.output}",
+        "fan":     "${notify-fan.output}",
+        "send":    "${notify-send.output}",
+    }
+    if got := tasks["notify"].InputParameters["outputs"]; !reflect.DeepEqual(got, wantOutputs) {
+        t.Errorf("notify outputs = %v, want %v", got, wantOutputs)
+    }
+
+    if got := workflow.Labels[templateLabelPrefix+"notify"]; got != "1" {
+        t.Errorf("notify version label = %q, want 1", got)
+    }
+}
+
+func TestResolveExtends(t *testing.T) {
+    base := &WorkflowTemplate{Spec: WorkflowTemplateSpec{
+        Name:    "base",
+        Version: 1,
+        Parameters: []Parameter{
+            {Name: "image", Required: true},
+            {Name: "replicas", Type: ParamTypeInt},
+        },
+        Tasks: []TaskTemplate{
+            {Name: "extract", TaskType: "SIMPLE"},
+            {Name: "process", TaskType: "SIMPLE", DependsOn: []string{"extract"}, InputTemplate: map[string]interface{}{"image": "${image}"}},
+        },
+    }}
+
+    tests := []struct {
+        name       string
+        spec       WorkflowTemplateSpec
+        tasks      []string
+        parameters []Parameter
+        wantErr    string
+    }{
+        {
+            name: "replaces in place and appends",
+            spec: WorkflowTemplateSpec{
+                Name:    "nightly",
+                Version: 1,
+                Extends: &TemplateRef{Name: "base", Parameters: map[string]interface{}{"image": "processor:2"}},
+                Parameters: []Parameter{
+                    {Name: "replicas", Type: ParamTypeInt, Default: float64(2)},
+                    {Name: "channel"},
+                },
+                Tasks: []TaskTemplate{
+                    {Name: "notify", TaskType: "SIMPLE", DependsOn: []string{"process"}, InputTemplate: map[string]interface{}{"channel": "${channel}"}},
+                    {Name: "extract", TaskType: "HTTP"},
+                },
+            },
+            tasks: []string{"extract", "process", "notify"},
+            parameters: []Parameter{
+                {Name: "image", Required: true, Default: "processor:2"},
+                {Name: "replicas", Type: ParamTypeInt, Default: float64(2)},
+                {Name: "channel"},
+            },
+        },
+        {
+            name: "unknown parameter",
+            spec: WorkflowTemplateSpec{
+                Name:    "nightly",
+                Version: 1,
+                Extends: &TemplateRef{Name: "base", Parameters: map[string]interface{}{"imge": "processor:2"}},
+            },
+            wantErr: "template nightly version 1 extends base with unknown parameter imge",
+        },
+        {
+            name: "dependency on a missing inherited task",
+            spec: WorkflowTemplateSpec{
+                Name:    "nightly",
+                Version: 1,
+                Extends: &TemplateRef{Name: "base"},
+                Tasks:   []TaskTemplate{{Name: "notify", TaskType: "SIMPLE", DependsOn: []string{"publish"}}},
+            },
+            wantErr: "task notify depends on unknown task publish",
+        },
+        {
+            name: "missing base",
+            spec: WorkflowTemplateSpec{
+                Name:    "nightly",
+                Version: 1,
+                Extends: &TemplateRef{Name: "base", Version: 2},
+            },
+            wantErr: "version 2 not found for template base",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            template := &WorkflowTemplate{Spec: tt.spec}
+            spec, err := composeManager(base, template).ResolvedSpec(template)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+
+            var tasks []string
+            for _, taskTemplate := range spec.Tasks {
+                tasks = append(tasks, taskTemplate.Name)
+            }
+            if !reflect.DeepEqual(tasks, tt.tasks) {
+                t.Errorf("tasks = %v, want %v", tasks, tt.tasks)
+            }
+            if !reflect.DeepEqual(spec.Parameters, tt.parameters) {
+                t.Errorf("parameters = %+v, want %+v", spec.Parameters, tt.parameters)
+            }
+            if spec.Extends != nil {
+                t.Errorf("resolved spec still extends %s", spec.Extends.Name)
+            }
+        })
+    }
+}
+
+func TestCompositionCycle(t *testing.T) {
+    // a includes b, which extends a again
+    a := &WorkflowTemplate{Spec: WorkflowTemplateSpec{
+        Name:    "a",
+        Version: 1,
+        Tasks: []TaskTemplate{
+            {Name: "sub", TaskType: "SUB_WORKFLOW", SubWorkflow: &TemplateRef{Name: "b"}},
+        },
+    }}
+    b := &WorkflowTemplate{Spec: WorkflowTemplateSpec{
+        Name:    "b",
+        Version: 1,
+        Extends: &TemplateRef{Name: "a"},
+    }}
+    tm := composeManager(a, b)
+
+    want := "template composition cycle: a v1 -> b v1 -> a v1"
+    _, err := tm.CreateWorkflowFromTemplate(a, nil)
+    if err == nil || !strings.Contains(err.Error(), want) {
+        t.Errorf("CreateWorkflowFromTemplate() error = %v, want %q", err, want)
+    }
+
+    tm.mutex.RLock()
+    err = tm.checkCyclesLocked(a, newComposition(a))
+    tm.mutex.RUnlock()
+    if err == nil || !strings.Contains(err.Error(), want) {
+        t.Errorf("checkCyclesLocked() error = %v, want %q", err, want)
+    }
+}
@@ -2,31 +2,45 @@ package main
 
 import (
     "fmt"
+    "reflect"
+    "strings"
     "sync"
 
     metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// WorkflowTemplate defines the structure for workflow templates
+// WorkflowTemplate defines the structure for workflow templates. Templates
+// are identified by spec.name and spec.version; each version is a separate,
+// immutable object.
 type WorkflowTemplate struct {
     metav1.TypeMeta   `json:",inline"`
     metav1.ObjectMeta `json:"metadata,omitempty"`
     Spec             WorkflowTemplateSpec `json:"spec"`
+    Lifecycle        TemplateLifecycle    `json:"lifecycle,omitempty"`
 }
 
 type WorkflowTemplateSpec struct {
+    Name        string       `json:"name"`
     Version     int          `json:"version"`
     Description string       `json:"description,omitempty"`
+    // Extends inherits the parameters and tasks of a base template
+    Extends     *TemplateRef `json:"extends,omitempty"`
     Parameters  []Parameter  `json:"parameters,omitempty"`
-    Tasks       []TaskTemplate `json:"tasks"`
+    Tasks       []TaskTemplate `json:"tasks,omitempty"`
 }
 
+// Parameter declares one template parameter. Type is one of the ParamType
+// constants and defaults to string.
 type Parameter struct {
-    Name        string `json:"name"`
-    Description string `json:"description,omitempty"`
-    Type        string `json:"type"`
-    Required    bool   `json:"required"`
-    Default     string `json:"default,omitempty"`
+    Name        string      `json:"name"`
+    Description string      `json:"description,omitempty"`
+    Type        string      `json:"type,omitempty"`
+    Required    bool        `json:"required"`
+    Default     interface{} `json:"default,omitempty"`
+    // Enum lists the allowed values of an enum parameter
+    Enum        []string    `json:"enum,omitempty"`
+    // Pattern is a regular expression a string value must match in full
+    Pattern     string      `json:"pattern,omitempty"`
 }
 
 type TaskTemplate struct {
@@ -38,17 +52,31 @@ type TaskTemplate struct {
     InputTemplate   map[string]interface{} `json:"inputTemplate,omitempty"`
     Optional        bool                  `json:"optional,omitempty"`
     DependsOn      []string              `json:"dependsOn,omitempty"`
+    // SubWorkflow is the template a SUB_WORKFLOW task includes
+    SubWorkflow    *TemplateRef          `json:"subWorkflow,omitempty"`
+}
+
+// TemplateRef builds a workflow's tasks from a WorkflowTemplate
+type TemplateRef struct {
+    Name       string            `json:"name"`
+    // Version pins an exact version. Without it VersionConstraint selects
+    // one, and without either the latest version that isn't retired is used.
+    Version    int               `json:"version,omitempty"`
+    VersionConstraint string     `json:"versionConstraint,omitempty"`
+    Parameters map[string]interface{} `json:"parameters,omitempty"`
 }
 
 // TemplateManager handles workflow template operations
 type TemplateManager struct {
     templates     map[string]map[int]*WorkflowTemplate // name -> version -> template
+    users         map[string]map[int]map[string]bool   // name -> version -> workflow runs using it
     mutex         sync.RWMutex
 }
 
 func NewTemplateManager() *TemplateManager {
     return &TemplateManager{
         templates: make(map[string]map[int]*WorkflowTemplate),
+        users:     make(map[string]map[int]map[string]bool),
     }
 }
 
@@ -56,9 +84,24 @@ func (tm *TemplateManager) AddTemplate(template *WorkflowTemplate) error {
     tm.mutex.Lock()
     defer tm.mutex.Unlock()
 
-    name := template.Name
+    return tm.addTemplateLocked(template)
+}
+
+func (tm *TemplateManager) addTemplateLocked(template *WorkflowTemplate) error {
+    name := template.Spec.Name
     version := template.Spec.Version
 
+    // A template that extends another can depend on inherited tasks; its
+    // graph is checked once the base is merged in
+    if template.Spec.Extends == nil {
+        if err := validateTemplateTasks(template.Spec); err != nil {
+            return err
+        }
+    }
+    if err := validateParameterDeclarations(template); err != nil {
+        return err
+    }
+
     // Initialize version map if needed
     if _, exists := tm.templates[name]; !exists {
         tm.templates[name] = make(map[int]*WorkflowTemplate)
@@ -70,9 +113,64 @@ func (tm *TemplateManager) AddTemplate(template *WorkflowTemplate) error {
     }
 
     tm.templates[name][version] = template
+
+    if err := tm.checkCyclesLocked(template, newComposition(template)); err != nil {
+        delete(tm.templates[name], version)
+        if len(tm.templates[name]) == 0 {
+            delete(tm.templates, name)
+        }
+        return err
+    }
     return nil
 }
 
+// UpdateTemplate accepts an update to a template object only if its spec is
+// unchanged; a published template version never changes
+func (tm *TemplateManager) UpdateTemplate(template *WorkflowTemplate) error {
+    tm.mutex.Lock()
+    defer tm.mutex.Unlock()
+
+    existing, exists := tm.lookupByUID(template)
+    if !exists {
+        // An earlier version of the object may have been rejected
+        return tm.addTemplateLocked(template)
+    }
+    if !reflect.DeepEqual(existing.Spec, template.Spec) {
+        return fmt.Errorf("template %s version %d is immutable; publish a new version instead", existing.Spec.Name, existing.Spec.Version)
+    }
+    tm.templates[existing.Spec.Name][existing.Spec.Version] = template
+    return nil
+}
+
+// RemoveTemplate forgets the template version held by the given object. A
+// rejected duplicate of the same name and version leaves the original alone.
+func (tm *TemplateManager) RemoveTemplate(template *WorkflowTemplate) {
+    tm.mutex.Lock()
+    defer tm.mutex.Unlock()
+
+    existing, exists := tm.lookupByUID(template)
+    if !exists {
+        return
+    }
+    versions := tm.templates[existing.Spec.Name]
+    delete(versions, existing.Spec.Version)
+    if len(versions) == 0 {
+        delete(tm.templates, existing.Spec.Name)
+    }
+}
+
+// lookupByUID finds the stored template that came from the same object
+func (tm *TemplateManager) lookupByUID(template *WorkflowTemplate) (*WorkflowTemplate, bool) {
+    for _, versions := range tm.templates {
+        for _, existing := range versions {
+            if existing.UID == template.UID {
+                return existing, true
+            }
+        }
+    }
+    return nil, false
+}
+
 func (tm *TemplateManager) GetTemplate(name string, version int) (*WorkflowTemplate, error) {
     tm.mutex.RLock()
     defer tm.mutex.RUnlock()
@@ -86,88 +184,75 @@ func (tm *TemplateManager) GetTemplate(name string, version int) (*WorkflowTempl
     return nil, fmt.Errorf("template %s not found", name)
 }
 
+// GetLatestVersion returns the highest version that isn't retired
 func (tm *TemplateManager) GetLatestVersion(name string) (*WorkflowTemplate, error) {
+    return tm.FindTemplate(name, ConstraintLatest)
+}
+
+// CreateWorkflowFromTemplate builds a workflow from the template, resolving
+// what it extends and includes. Invalid parameters are reported together as
+// a *ParameterValidationError; a template that isn't loaded yet as a
+// *templateNotFoundError. The versions of every template used are recorded
+// in the workflow's labels.
+func (tm *TemplateManager) CreateWorkflowFromTemplate(template *WorkflowTemplate, params map[string]interface{}) (*Workflow, error) {
     tm.mutex.RLock()
     defer tm.mutex.RUnlock()
 
-    if versions, exists := tm.templates[name]; exists {
-        var latestVersion int
-        for v := range versions {
-            if v > latestVersion {
-                latestVersion = v
-            }
-        }
-        return versions[latestVersion], nil
+    c := newComposition(template)
+    spec, err := tm.resolveExtendsLocked(template, c)
+    if err != nil {
+        return nil, err
+    }
+    tasks, err := tm.expandTasksLocked(spec, params, c)
+    if err != nil {
+        return nil, err
     }
-    return nil, fmt.Errorf("template %s not found", name)
-}
 
-func (tm *TemplateManager) CreateWorkflowFromTemplate(template *WorkflowTemplate, params map[string]string) (*Workflow, error) {
-    // Validate required parameters
-    for _, param := range template.Spec.Parameters {
-        if param.Required {
-            if _, exists := params[param.Name]; !exists {
-                if param.Default == "" {
-                    return nil, fmt.Errorf("required parameter %s not provided", param.Name)
-                }
-                params[param.Name] = param.Default
-            }
-        }
+    labels := c.labels()
+    labels["template"] = template.Spec.Name
+    labels["templateVersion"] = fmt.Sprintf("%d", template.Spec.Version)
+    var annotations map[string]string
+    if len(c.deprecated) > 0 {
+        annotations = map[string]string{deprecatedTemplatesAnnotation: strings.Join(c.deprecated, "; ")}
     }
 
     // Create new workflow from template
     workflow := &Workflow{
         TypeMeta: metav1.TypeMeta{
-            APIVersion: "netflix.com/v1",
+            APIVersion: "conductor.netflix.com/v1",
             Kind:       "Workflow",
         },
         ObjectMeta: metav1.ObjectMeta{
-            GenerateName: template.Name + "-",
-            Labels: map[string]string{
-                "template":        template.Name,
-                "templateVersion": fmt.Sprintf("%d", template.Spec.Version),
-            },
+            GenerateName: template.Spec.Name + "-",
+            Labels:       labels,
+            Annotations:  annotations,
         },
         Spec: WorkflowSpec{
-            Name:           template.Name,
+            Name:           template.Spec.Name,
             Version:        template.Spec.Version,
             TimeoutPolicy:  "TIME_OUT", // Default timeout policy
             TimeoutSeconds: 3600,       // Default timeout
-            Tasks:         make([]Task, len(template.Spec.Tasks)),
+            Tasks:          tasks,
         },
     }
 
-    // Convert task templates to tasks
-    for i, taskTemplate := range template.Spec.Tasks {
-        workflow.Spec.Tasks[i] = Task{
-            Name:           taskTemplate.Name,
-            TaskType:       taskTemplate.TaskType,
-            RetryCount:    taskTemplate.RetryCount,
-            RetryLogic:    taskTemplate.RetryLogic,
-            TimeoutSeconds: taskTemplate.TimeoutSeconds,
-            Optional:      taskTemplate.Optional,
-            InputParameters: tm.resolveInputParameters(taskTemplate.InputTemplate, params),
-        }
-    }
-
     return workflow, nil
 }
 
-func (tm *TemplateManager) resolveInputParameters(inputTemplate map[string]interface{}, params map[string]string) map[string]interface{} {
-    resolved := make(map[string]interface{})
-    for k, v := range inputTemplate {
-        switch val := v.(type) {
-        case string:
-            if param, exists := params[val]; exists {
-                resolved[k] = param
-            } else {
-                resolved[k] = val
-            }
-        default:
-            resolved[k] = v
-        }
-    }
-    return resolved
+// resolveInputParameters substitutes ${parameter} references anywhere in the
+// input template; a reference that makes up a whole value keeps the
+// parameter's type. Workflow inputs and task outputs are only known once the
+// workflow runs, so those references, and escaped $${...} text, are carried
+// over unchanged.
+func (tm *TemplateManager) resolveInputParameters(inputTemplate map[string]interface{}, params map[string]interface{}, path string) (map[string]interface{}, error) {
+    return ResolveExpressions(inputTemplate, ExpressionContext{
+        Parameters: params,
+        Defer: map[string]bool{
+            RefWorkflowInput: true,
+            RefTaskOutput:    true,
+        },
+        KeepEscapes: true,
+    }, path)
 }
 
 func (tm *TemplateManager) ListTemplates() []WorkflowTemplate {
@@ -183,12 +268,16 @@ func (tm *TemplateManager) ListTemplates() []WorkflowTemplate {
     return templates
 }
 
+// DeleteTemplate removes a template version, unless workflow runs still use it
 func (tm *TemplateManager) DeleteTemplate(name string, version int) error {
     tm.mutex.Lock()
     defer tm.mutex.Unlock()
 
     if versions, exists := tm.templates[name]; exists {
         if _, exists := versions[version]; exists {
+            if users := tm.usersLocked(name, version); len(users) > 0 {
+                return fmt.Errorf("template %s version %d is still used by workflow runs %s", name, version, strings.Join(users, ", "))
+            }
             delete(versions, version)
             if len(versions) == 0 {
                 delete(tm.templates, name)
@@ -0,0 +1,236 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// Template parameter types
+const (
+    ParamTypeString = "string"
+    ParamTypeInt    = "int"
+    ParamTypeBool   = "bool"
+    ParamTypeList   = "list"
+    ParamTypeObject = "object"
+    ParamTypeEnum   = "enum" // a string from Parameter.Enum
+)
+
+// ParameterError describes one template parameter that failed validation
+type ParameterError struct {
+    Parameter string
+    Reason    string
+}
+
+// ParameterValidationError collects every problem found with the parameters
+// passed to, or declared by, a template
+type ParameterValidationError struct {
+    Template string
+    Version  int
+    Errors   []ParameterError
+}
+
+func (e *ParameterValidationError) Error() string {
+    msgs := make([]string, len(e.Errors))
+    for i, paramErr := range e.Errors {
+        msgs[i] = fmt.Sprintf("%s: %s", paramErr.Parameter, paramErr.Reason)
+    }
+    return fmt.Sprintf("invalid parameters for template %s version %d: %s", e.Template, e.Version, strings.Join(msgs, "; "))
+}
+
+type parameterValidator struct {
+    errors []ParameterError
+}
+
+func (v *parameterValidator) fail(param, format string, args ...interface{}) {
+    v.errors = append(v.errors, ParameterError{Parameter: param, Reason: fmt.Sprintf(format, args...)})
+}
+
+func (v *parameterValidator) result(template *WorkflowTemplate) error {
+    if len(v.errors) == 0 {
+        return nil
+    }
+    return &ParameterValidationError{
+        Template: template.Spec.Name,
+        Version:  template.Spec.Version,
+        Errors:   v.errors,
+    }
+}
+
+// validateParameterDeclarations checks a template's parameters before it is
+// accepted: known types, usable enums and patterns, defaults of the declared
+// type, and no ${...} references to parameters that aren't declared. The
+// references of a template that extends another are checked after merging.
+func validateParameterDeclarations(template *WorkflowTemplate) error {
+    v := &parameterValidator{}
+    declared := make(map[string]bool, len(template.Spec.Parameters))
+
+    for _, param := range template.Spec.Parameters {
+        if declared[param.Name] {
+            v.fail(param.Name, "declared more than once")
+            continue
+        }
+        declared[param.Name] = true
+
+        switch param.paramType() {
+        case ParamTypeString, ParamTypeInt, ParamTypeBool, ParamTypeList, ParamTypeObject:
+        case ParamTypeEnum:
+            if len(param.Enum) == 0 {
+                v.fail(param.Name, "enum parameters need a list of allowed values")
+            }
+        default:
+            v.fail(param.Name, "unknown type %s", param.Type)
+            continue
+        }
+        if param.Pattern != "" {
+            if param.paramType() != ParamTypeString {
+                v.fail(param.Name, "pattern only applies to string parameters")
+            } else if _, err := compilePattern(param.Pattern); err != nil {
+                v.fail(param.Name, "invalid pattern: %v", err)
+            }
+        }
+        if param.Default != nil {
+            if reason := param.check(param.Default); reason != "" {
+                v.fail(param.Name, "default %s", reason)
+            }
+        }
+    }
+
+    if template.Spec.Extends != nil {
+        return v.result(template)
+    }
+    for i, taskTemplate := range template.Spec.Tasks {
+        inputs := map[string]interface{}{"inputTemplate": taskTemplate.InputTemplate}
+        if taskTemplate.SubWorkflow != nil {
+            inputs["subWorkflow"] = map[string]interface{}{"parameters": taskTemplate.SubWorkflow.Parameters}
+        }
+        refs, err := FindReferences(inputs, fmt.Sprintf("spec.tasks[%d]", i))
+        if err != nil {
+            v.fail(taskTemplate.Name, "%v", err)
+            continue
+        }
+        for _, path := range sortedReferencePaths(refs) {
+            for _, ref := range refs[path] {
+                if ref.Kind == RefParameter && !declared[ref.Name] {
+                    v.fail(ref.Name, "referenced at %s but not declared", path)
+                }
+            }
+        }
+    }
+
+    return v.result(template)
+}
+
+// validateParameterValues checks the values given for a template's
+// parameters and returns them with defaults filled in. The caller's map is
+// left untouched. Every problem is reported, not just the first.
+func validateParameterValues(template *WorkflowTemplate, values map[string]interface{}) (map[string]interface{}, error) {
+    v := &parameterValidator{}
+    resolved := make(map[string]interface{}, len(template.Spec.Parameters))
+    declared := make(map[string]bool, len(template.Spec.Parameters))
+
+    for _, param := range template.Spec.Parameters {
+        declared[param.Name] = true
+
+        value, provided := values[param.Name]
+        if !provided || value == nil {
+            switch {
+            case param.Default != nil:
+                resolved[param.Name] = param.Default
+            case param.Required:
+                v.fail(param.Name, "is required")
+            }
+            continue
+        }
+
+        if reason := param.check(value); reason != "" {
+            v.fail(param.Name, "%s", reason)
+            continue
+        }
+        resolved[param.Name] = value
+    }
+
+    var unknown []string
+    for name := range values {
+        if !declared[name] {
+            unknown = append(unknown, name)
+        }
+    }
+    sort.Strings(unknown)
+    for _, name := range unknown {
+        v.fail(name, "is not a parameter of this template")
+    }
+
+    if err := v.result(template); err != nil {
+        return nil, err
+    }
+    return resolved, nil
+}
+
+// paramType returns the declared type; untyped parameters are strings
+func (p Parameter) paramType() string {
+    if p.Type == "" {
+        return ParamTypeString
+    }
+    return p.Type
+}
+
+// check returns why value is not acceptable for the parameter, or ""
+func (p Parameter) check(value interface{}) string {
+    switch p.paramType() {
+    case ParamTypeString:
+        str, ok := value.(string)
+        if !ok {
+            return "must be a string"
+        }
+        if p.Pattern != "" {
+            pattern, err := compilePattern(p.Pattern)
+            if err != nil || !pattern.MatchString(str) {
+                return fmt.Sprintf("must match %s", p.Pattern)
+            }
+        }
+    case ParamTypeInt:
+        if !isInteger(value) {
+            return "must be an integer"
+        }
+    case ParamTypeBool:
+        if _, ok := value.(bool); !ok {
+            return "must be a bool"
+        }
+    case ParamTypeList:
+        if _, ok := value.([]interface{}); !ok {
+            return "must be a list"
+        }
+    case ParamTypeObject:
+        if _, ok := value.(map[string]interface{}); !ok {
+            return "must be an object"
+        }
+    case ParamTypeEnum:
+        str, _ := value.(string)
+        for _, option := range p.Enum {
+            if str == option {
+                return ""
+            }
+        }
+        return fmt.Sprintf("must be one of %s", strings.Join(p.Enum, ", "))
+    }
+    return ""
+}
+
+// compilePattern anchors the pattern so it has to match the whole value
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+    return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// isInteger accepts whole numbers, including the float64s JSON decodes to
+func isInteger(value interface{}) bool {
+    switch n := value.(type) {
+    case int, int32, int64:
+        return true
+    case float64:
+        return !math.IsInf(n, 0) && !math.IsNaN(n) && n == math.Trunc(n)
+    }
+    return false
+}
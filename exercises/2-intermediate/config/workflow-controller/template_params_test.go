@@ -0,0 +1,153 @@
+package main
+
+import (
+    "math"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestValidateParameterValues(t *testing.T) {
+    template := &WorkflowTemplate{Spec: WorkflowTemplateSpec{
+        Name:    "encode",
+        Version: 1,
+        Parameters: []Parameter{
+            {Name: "title", Required: true},
+            {Name: "codec", Pattern: "h26[45]"},
+            {Name: "bitrate", Type: ParamTypeInt, Default: float64(3000)},
+            {Name: "hdr", Type: ParamTypeBool},
+            {Name: "tracks", Type: ParamTypeList},
+            {Name: "metadata", Type: ParamTypeObject},
+            {Name: "tier", Type: ParamTypeEnum, Enum: []string{"basic", "premium"}},
+        },
+    }}
+
+    tests := []struct {
+        name    string
+        values  map[string]interface{}
+        want    map[string]interface{}
+        wantErr []string
+    }{
+        {
+            name:   "defaults filled in",
+            values: map[string]interface{}{"title": "movie"},
+            want:   map[string]interface{}{"title": "movie", "bitrate": float64(3000)},
+        },
+        {
+            name: "all types",
+            values: map[string]interface{}{
+                "title":    "movie",
+                "codec":    "h265",
+                "bitrate":  int64(6000),
+                "hdr":      true,
+                "tracks":   []interface{}{"en"},
+                "metadata": map[string]interface{}{"year": float64(2020)},
+                "tier":     "premium",
+            },
+            want: map[string]interface{}{
+                "title":    "movie",
+                "codec":    "h265",
+                "bitrate":  int64(6000),
+                "hdr":      true,
+                "tracks":   []interface{}{"en"},
+                "metadata": map[string]interface{}{"year": float64(2020)},
+                "tier":     "premium",
+            },
+        },
+        {
+            name:   "null uses the default",
+            values: map[string]interface{}{"title": "movie", "bitrate": nil},
+            want:   map[string]interface{}{"title": "movie", "bitrate": float64(3000)},
+        },
+        {
+            name:    "missing required",
+            values:  map[string]interface{}{},
+            wantErr: []string{"title: is required"},
+        },
+        {
+            name:    "pattern is anchored",
+            values:  map[string]interface{}{"title": "movie", "codec": "xh264x"},
+            wantErr: []string{"codec: must match h26[45]"},
+        },
+        {
+            name:    "enum",
+            values:  map[string]interface{}{"title": "movie", "tier": "gold"},
+            wantErr: []string{"tier: must be one of basic, premium"},
+        },
+        {
+            name: "wrong types",
+            values: map[string]interface{}{
+                "title":    float64(1),
+                "bitrate":  1.5,
+                "hdr":      "yes",
+                "tracks":   "en",
+                "metadata": []interface{}{},
+            },
+            wantErr: []string{
+                "title: must be a string",
+                "bitrate: must be an integer",
+                "hdr: must be a bool",
+                "tracks: must be a list",
+                "metadata: must be an object",
+            },
+        },
+        {
+            name:    "infinite integer",
+            values:  map[string]interface{}{"title": "movie", "bitrate": math.Inf(1)},
+            wantErr: []string{"bitrate: must be an integer"},
+        },
+        {
+            name:    "unknown parameters",
+            values:  map[string]interface{}{"title": "movie", "zeta": 1, "alpha": 2},
+            wantErr: []string{"alpha: is not a parameter", "zeta: is not a parameter"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := validateParameterValues(template, tt.values)
+            if len(tt.wantErr) > 0 {
+                if err == nil {
+                    t.Fatalf("expected an error, got %v", got)
+                }
+                for _, want := range tt.wantErr {
+                    if !strings.Contains(err.Error(), want) {
+                        t.Errorf("error %q does not contain %q", err, want)
+                    }
+                }
+                if paramErr, ok := err.(*ParameterValidationError); !ok || len(paramErr.Errors) != len(tt.wantErr) {
+                    t.Errorf("error %v does not report exactly %d problems", err, len(tt.wantErr))
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("validateParameterValues() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestIsInteger(t *testing.T) {
+    tests := []struct {
+        value interface{}
+        want  bool
+    }{
+        {3, true},
+        {int64(-3), true},
+        {float64(3), true},
+        {3.5, false},
+        {math.Inf(1), false},
+        {math.Inf(-1), false},
+        {math.NaN(), false},
+        {"3", false},
+    }
+
+    for _, tt := range tests {
+        if got := isInteger(tt.value); got != tt.want {
+            t.Errorf("isInteger(%v) = %v, want %v", tt.value, got, tt.want)
+        }
+    }
+}
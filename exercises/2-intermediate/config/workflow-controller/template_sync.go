@@ -0,0 +1,298 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/labels"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/client-go/tools/cache"
+    "k8s.io/client-go/util/retry"
+)
+
+// workflowTemplateGVR identifies the cluster-scoped WorkflowTemplate CRD
+// served by 05-3-netflix-workflowtemplate-crd.yaml
+var workflowTemplateGVR = schema.GroupVersionResource{
+    Group:    "conductor.netflix.com",
+    Version:  "v1",
+    Resource: "workflowtemplates",
+}
+
+// templateFromObject converts an informer object into a typed WorkflowTemplate
+func templateFromObject(obj interface{}) (*WorkflowTemplate, error) {
+    if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+        obj = tombstone.Obj
+    }
+    u, ok := obj.(*unstructured.Unstructured)
+    if !ok {
+        return nil, fmt.Errorf("unexpected object type %T", obj)
+    }
+
+    template := &WorkflowTemplate{}
+    if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.DeepCopy().UnstructuredContent(), template); err != nil {
+        return nil, err
+    }
+    return template, nil
+}
+
+// templateFinalizer keeps a deleted template version loaded until no
+// workflow run uses it any more, since a run may need to expand it again
+// when it resumes or retries. New runs can no longer select a version once
+// it is being deleted.
+const templateFinalizer = "conductor.netflix.com/template-in-use"
+
+// templateRecheckInterval is how soon a deleted template still held by
+// runs that haven't resumed since a restart is looked at again
+const templateRecheckInterval = 30 * time.Second
+
+// The template informer keeps the TemplateManager in step with the cluster.
+// Templates the manager refuses, such as a second object claiming an
+// existing name and version or an edit to a published version, are reported
+// with an Event on the offending object and otherwise ignored.
+
+func (c *Controller) addTemplate(obj interface{}) {
+    template, err := templateFromObject(obj)
+    if err != nil {
+        log.Printf("Error decoding workflow template: %v", err)
+        return
+    }
+    if err := c.templateManager.AddTemplate(template); err != nil {
+        c.rejectTemplate(obj, template, err)
+        return
+    }
+    log.Printf("Loaded workflow template %s version %d", template.Spec.Name, template.Spec.Version)
+    c.enqueueTemplate(obj)
+    c.enqueuePendingRuns(metav1.NamespaceAll, func(run *WorkflowRun) bool { return true })
+}
+
+func (c *Controller) updateTemplate(oldObj, newObj interface{}) {
+    template, err := templateFromObject(newObj)
+    if err != nil {
+        log.Printf("Error decoding workflow template: %v", err)
+        return
+    }
+    if err := c.templateManager.UpdateTemplate(template); err != nil {
+        c.rejectTemplate(newObj, template, err)
+        return
+    }
+    c.enqueueTemplate(newObj)
+}
+
+func (c *Controller) deleteTemplate(obj interface{}) {
+    template, err := templateFromObject(obj)
+    if err != nil {
+        log.Printf("Error decoding workflow template: %v", err)
+        return
+    }
+    // Only a template whose finalizer was removed by hand gets here while in use
+    if users := c.templateManager.Users(template.Spec.Name, template.Spec.Version); len(users) > 0 {
+        log.Printf("Workflow template %s version %d was deleted while workflow runs %s still use it", template.Spec.Name, template.Spec.Version, strings.Join(users, ", "))
+    }
+    c.templateManager.RemoveTemplate(template)
+    log.Printf("Removed workflow template %s version %d", template.Spec.Name, template.Spec.Version)
+}
+
+func (c *Controller) enqueueTemplate(obj interface{}) {
+    key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+    if err != nil {
+        log.Printf("Error computing key for workflow template: %v", err)
+        return
+    }
+    c.templateQueue.Add(key)
+}
+
+// releaseTemplates lets go of the templates a run retained and rechecks the
+// templates waiting to be deleted
+func (c *Controller) releaseTemplates(runKey string) {
+    c.templateManager.Release(runKey)
+
+    objs, err := c.templateLister.List(labels.Everything())
+    if err != nil {
+        log.Printf("Error listing workflow templates: %v", err)
+        return
+    }
+    for _, obj := range objs {
+        if accessor, ok := obj.(metav1.Object); ok && accessor.GetDeletionTimestamp() != nil {
+            c.enqueueTemplate(obj)
+        }
+    }
+}
+
+func (c *Controller) runTemplateWorker() {
+    for c.processNextTemplate() {
+    }
+}
+
+func (c *Controller) processNextTemplate() bool {
+    obj, shutdown := c.templateQueue.Get()
+    if shutdown {
+        return false
+    }
+    defer c.templateQueue.Done(obj)
+
+    key, ok := obj.(string)
+    if !ok {
+        c.templateQueue.Forget(obj)
+        return true
+    }
+    if err := c.syncTemplateFinalizer(key); err != nil {
+        log.Printf("Error syncing workflow template %s: %v", key, err)
+        c.templateQueue.AddRateLimited(key)
+        return true
+    }
+    c.templateQueue.Forget(obj)
+    return true
+}
+
+// syncTemplateFinalizer adds templateFinalizer to a loaded template, and
+// removes it from a deleted one once no run uses it
+func (c *Controller) syncTemplateFinalizer(key string) error {
+    obj, err := c.templateLister.Get(key)
+    if errors.IsNotFound(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    template, err := templateFromObject(obj)
+    if err != nil {
+        log.Printf("Error decoding workflow template %s: %v", key, err)
+        return nil
+    }
+    // Rejected templates were never loaded, so nothing can be using them
+    loaded, err := c.templateManager.GetTemplate(template.Spec.Name, template.Spec.Version)
+    if err != nil || loaded.UID != template.UID {
+        return c.setTemplateFinalizer(key, false)
+    }
+
+    if template.DeletionTimestamp == nil {
+        return c.setTemplateFinalizer(key, true)
+    }
+    if users := c.templateManager.Users(template.Spec.Name, template.Spec.Version); len(users) > 0 {
+        log.Printf("Workflow template %s version %d is kept until workflow runs %s finish", template.Spec.Name, template.Spec.Version, strings.Join(users, ", "))
+        return nil
+    }
+    if pending := c.unresumedRuns(); len(pending) > 0 {
+        // Their templates are only known once they are synced again
+        log.Printf("Workflow template %s version %d is kept until workflow runs %s resume", template.Spec.Name, template.Spec.Version, strings.Join(pending, ", "))
+        c.templateQueue.AddAfter(key, templateRecheckInterval)
+        return nil
+    }
+    return c.setTemplateFinalizer(key, false)
+}
+
+// unresumedRuns lists the runs that have started but aren't executing in
+// this process, as after a controller restart
+func (c *Controller) unresumedRuns() []string {
+    objs, err := c.runLister.List(labels.Everything())
+    if err != nil {
+        log.Printf("Error listing workflow runs: %v", err)
+        return nil
+    }
+    var pending []string
+    for _, obj := range objs {
+        run, err := runFromObject(obj)
+        if err != nil {
+            continue
+        }
+        switch run.Status.Phase {
+        case "", PhaseCompleted, PhaseFailed, PhaseTimedOut:
+            continue
+        }
+        key := run.Namespace + "/" + run.Name
+        if !c.isRunning(key) {
+            pending = append(pending, key)
+        }
+    }
+    return pending
+}
+
+// setTemplateFinalizer adds or removes templateFinalizer
+func (c *Controller) setTemplateFinalizer(name string, present bool) error {
+    client := c.dynamicClient.Resource(workflowTemplateGVR)
+    return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+        latest, err := client.Get(context.TODO(), name, metav1.GetOptions{})
+        if errors.IsNotFound(err) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        var finalizers []string
+        found := false
+        for _, finalizer := range latest.GetFinalizers() {
+            if finalizer == templateFinalizer {
+                found = true
+                continue
+            }
+            finalizers = append(finalizers, finalizer)
+        }
+        if found == present {
+            return nil
+        }
+        if present {
+            finalizers = append(finalizers, templateFinalizer)
+        }
+        latest.SetFinalizers(finalizers)
+        _, err = client.Update(context.TODO(), latest, metav1.UpdateOptions{})
+        return err
+    })
+}
+
+func (c *Controller) rejectTemplate(obj interface{}, template *WorkflowTemplate, err error) {
+    log.Printf("Rejecting workflow template %s: %v", template.Name, err)
+    if runtimeObj, ok := obj.(runtime.Object); ok {
+        c.recorder.Eventf(runtimeObj, corev1.EventTypeWarning, "TemplateRejected", "%v", err)
+    }
+}
+
+// findTemplate returns the template a templateRef points at. A non-zero
+// version overrides the ref; runs use it to stay on the template version
+// they started with, even once it is deprecated or retired.
+func (c *Controller) findTemplate(ref *TemplateRef, version int) (*WorkflowTemplate, error) {
+    if version == 0 {
+        return c.templateManager.ResolveTemplate(ref)
+    }
+    template, err := c.templateManager.GetTemplate(ref.Name, version)
+    if err != nil {
+        return nil, &templateNotFoundError{Name: ref.Name, Version: version}
+    }
+    return template, nil
+}
+
+// expandTemplate fills in the tasks of a workflow built from the template
+// and records the template versions it used
+func (c *Controller) expandTemplate(workflow *Workflow, template *WorkflowTemplate) error {
+    if len(workflow.Spec.Tasks) > 0 {
+        return fmt.Errorf("workflow %s sets both tasks and templateRef", workflow.Spec.Name)
+    }
+
+    expanded, err := c.templateManager.CreateWorkflowFromTemplate(template, workflow.Spec.TemplateRef.Parameters)
+    if err != nil {
+        return err
+    }
+    workflow.Spec.Tasks = expanded.Spec.Tasks
+    workflow.Spec.TemplateRef.Version = template.Spec.Version
+    if workflow.Labels == nil {
+        workflow.Labels = make(map[string]string)
+    }
+    for k, v := range expanded.Labels {
+        workflow.Labels[k] = v
+    }
+    if deprecated, ok := expanded.Annotations[deprecatedTemplatesAnnotation]; ok {
+        if workflow.Annotations == nil {
+            workflow.Annotations = make(map[string]string)
+        }
+        workflow.Annotations[deprecatedTemplatesAnnotation] = deprecated
+    }
+    return nil
+}
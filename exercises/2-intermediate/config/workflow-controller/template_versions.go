@@ -0,0 +1,247 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// TemplateLifecycle marks a published template version as deprecated or
+// retired. It sits outside the immutable spec so it can change after the
+// version is published:
+//
+//     lifecycle:
+//       deprecated: true
+//       message: "use version 2, which notifies the team"
+//
+// Deprecated versions still run but are skipped by "stable" lookups, and
+// runs using them get a Warning Event. Retired versions are no longer picked
+// for new runs; runs that already started on one finish on it.
+type TemplateLifecycle struct {
+    Deprecated bool   `json:"deprecated,omitempty"`
+    Retired    bool   `json:"retired,omitempty"`
+    Message    string `json:"message,omitempty"`
+}
+
+// deprecated reports whether new runs should move off this version; a
+// retired version is deprecated as well
+func (t *WorkflowTemplate) deprecated() bool {
+    return t.Lifecycle.Deprecated || t.Lifecycle.Retired
+}
+
+// Version constraint keywords
+const (
+    ConstraintLatest = "latest" // any version that isn't retired
+    ConstraintStable = "stable" // only versions that aren't deprecated
+)
+
+// VersionConstraint selects template versions. It is written as
+// comma-separated terms that must all hold: the keywords latest and stable,
+// or a comparison against the version number (>=3, >3, <=3, <3, =3, !=3).
+// The highest version satisfying every term is used, e.g. ">=3,<5,stable".
+type VersionConstraint struct {
+    Stable bool
+    bounds []versionBound
+}
+
+type versionBound struct {
+    op      string
+    version int
+}
+
+func ParseVersionConstraint(s string) (VersionConstraint, error) {
+    var constraint VersionConstraint
+    for _, term := range strings.Split(s, ",") {
+        term = strings.TrimSpace(term)
+        switch term {
+        case "", ConstraintLatest:
+            continue
+        case ConstraintStable:
+            constraint.Stable = true
+            continue
+        }
+
+        op := strings.TrimRight(term, "0123456789 ")
+        switch op {
+        case ">=", ">", "<=", "<", "=", "!=":
+        case "":
+            op = "="
+        default:
+            return constraint, fmt.Errorf("invalid version constraint %q", term)
+        }
+        version, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(term, op)))
+        if err != nil {
+            return constraint, fmt.Errorf("invalid version constraint %q", term)
+        }
+        constraint.bounds = append(constraint.bounds, versionBound{op: op, version: version})
+    }
+    return constraint, nil
+}
+
+// Matches reports whether a template satisfies the constraint. Retired
+// versions never do.
+func (vc VersionConstraint) Matches(template *WorkflowTemplate) bool {
+    if template.Lifecycle.Retired || (vc.Stable && template.deprecated()) {
+        return false
+    }
+    version := template.Spec.Version
+    for _, bound := range vc.bounds {
+        var ok bool
+        switch bound.op {
+        case ">=":
+            ok = version >= bound.version
+        case ">":
+            ok = version > bound.version
+        case "<=":
+            ok = version <= bound.version
+        case "<":
+            ok = version < bound.version
+        case "=":
+            ok = version == bound.version
+        case "!=":
+            ok = version != bound.version
+        }
+        if !ok {
+            return false
+        }
+    }
+    return true
+}
+
+// templateNotFoundError reports that no loaded template satisfies a
+// reference (yet)
+type templateNotFoundError struct {
+    Name       string
+    Version    int
+    Constraint string
+}
+
+func (e *templateNotFoundError) Error() string {
+    switch {
+    case e.Version != 0:
+        return fmt.Sprintf("version %d not found for template %s", e.Version, e.Name)
+    case e.Constraint != "":
+        return fmt.Sprintf("no version of template %s satisfies %q", e.Name, e.Constraint)
+    }
+    return fmt.Sprintf("template %s not found", e.Name)
+}
+
+// findLocked resolves a reference to a loaded template for new use. An exact
+// version is refused once retired; a constraint picks the highest version
+// that satisfies it, and no constraint the latest version not retired.
+// skipDeleting also passes over versions being deleted, which are only kept
+// loaded for the runs already using them.
+func (tm *TemplateManager) findLocked(ref *TemplateRef, skipDeleting bool) (*WorkflowTemplate, error) {
+    if ref.Version != 0 {
+        if ref.VersionConstraint != "" {
+            return nil, fmt.Errorf("reference to template %s sets both version and versionConstraint", ref.Name)
+        }
+        template, exists := tm.templates[ref.Name][ref.Version]
+        if !exists {
+            return nil, &templateNotFoundError{Name: ref.Name, Version: ref.Version}
+        }
+        if skipDeleting && template.DeletionTimestamp != nil {
+            return nil, fmt.Errorf("template %s version %d is being deleted", ref.Name, ref.Version)
+        }
+        if template.Lifecycle.Retired {
+            if template.Lifecycle.Message != "" {
+                return nil, fmt.Errorf("template %s version %d is retired: %s", ref.Name, ref.Version, template.Lifecycle.Message)
+            }
+            return nil, fmt.Errorf("template %s version %d is retired", ref.Name, ref.Version)
+        }
+        return template, nil
+    }
+
+    constraint, err := ParseVersionConstraint(ref.VersionConstraint)
+    if err != nil {
+        return nil, fmt.Errorf("template %s: %v", ref.Name, err)
+    }
+    var found *WorkflowTemplate
+    for _, template := range tm.templates[ref.Name] {
+        if skipDeleting && template.DeletionTimestamp != nil || !constraint.Matches(template) {
+            continue
+        }
+        if found == nil || template.Spec.Version > found.Spec.Version {
+            found = template
+        }
+    }
+    if found == nil {
+        return nil, &templateNotFoundError{Name: ref.Name, Constraint: ref.VersionConstraint}
+    }
+    return found, nil
+}
+
+// ResolveTemplate returns the template a reference selects for a new run.
+// A *templateNotFoundError means a matching version may still be loaded.
+func (tm *TemplateManager) ResolveTemplate(ref *TemplateRef) (*WorkflowTemplate, error) {
+    tm.mutex.RLock()
+    defer tm.mutex.RUnlock()
+
+    return tm.findLocked(ref, true)
+}
+
+// FindTemplate returns the highest version of a template satisfying the
+// constraint, e.g. "latest", "stable" or ">=3"
+func (tm *TemplateManager) FindTemplate(name, constraint string) (*WorkflowTemplate, error) {
+    return tm.ResolveTemplate(&TemplateRef{Name: name, VersionConstraint: constraint})
+}
+
+// The TemplateManager counts which workflow runs use which template
+// versions, so a version isn't deleted from under a run that may still need
+// to expand it again. Runs retain the versions of every template they were
+// expanded from and release them once finished or deleted.
+
+// Retain records that user, a workflow run key, uses the templates the
+// workflow was expanded from
+func (tm *TemplateManager) Retain(user string, workflow *Workflow) {
+    tm.mutex.Lock()
+    defer tm.mutex.Unlock()
+
+    for name, versions := range templateVersionsFromLabels(workflow.Labels) {
+        for _, version := range versions {
+            if tm.users[name] == nil {
+                tm.users[name] = make(map[int]map[string]bool)
+            }
+            if tm.users[name][version] == nil {
+                tm.users[name][version] = make(map[string]bool)
+            }
+            tm.users[name][version][user] = true
+        }
+    }
+}
+
+// Release forgets every template version user retained
+func (tm *TemplateManager) Release(user string) {
+    tm.mutex.Lock()
+    defer tm.mutex.Unlock()
+
+    for name, versions := range tm.users {
+        for version, users := range versions {
+            delete(users, user)
+            if len(users) == 0 {
+                delete(versions, version)
+            }
+        }
+        if len(versions) == 0 {
+            delete(tm.users, name)
+        }
+    }
+}
+
+// Users lists the workflow runs still using a template version
+func (tm *TemplateManager) Users(name string, version int) []string {
+    tm.mutex.RLock()
+    defer tm.mutex.RUnlock()
+
+    return tm.usersLocked(name, version)
+}
+
+func (tm *TemplateManager) usersLocked(name string, version int) []string {
+    var users []string
+    for user := range tm.users[name][version] {
+        users = append(users, user)
+    }
+    sort.Strings(users)
+    return users
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+    "strings"
+    "testing"
+
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func versionedTemplate(version int, lifecycle TemplateLifecycle) *WorkflowTemplate {
+    return &WorkflowTemplate{
+        Spec:      WorkflowTemplateSpec{Name: "encode", Version: version},
+        Lifecycle: lifecycle,
+    }
+}
+
+func TestVersionConstraint(t *testing.T) {
+    tests := []struct {
+        name       string
+        constraint string
+        matches    []int
+        wantErr    string
+    }{
+        {name: "empty", constraint: "", matches: []int{1, 2, 3, 4, 5}},
+        {name: "latest", constraint: "latest", matches: []int{1, 2, 3, 4, 5}},
+        {name: "bare version", constraint: "3", matches: []int{3}},
+        {name: "equals", constraint: "=3", matches: []int{3}},
+        {name: "not equal", constraint: "!=3", matches: []int{1, 2, 4, 5}},
+        {name: "range", constraint: ">=3,<5", matches: []int{3, 4}},
+        {name: "exclusive range", constraint: "> 1, <= 3", matches: []int{2, 3}},
+        {name: "stable range", constraint: ">=3,<5,stable", matches: []int{3}},
+        {name: "stable", constraint: "stable", matches: []int{1, 2, 3, 5}},
+        {name: "unknown operator", constraint: "~3", wantErr: `invalid version constraint "~3"`},
+        {name: "missing version", constraint: ">=", wantErr: `invalid version constraint ">="`},
+        {name: "unknown keyword", constraint: "newest", wantErr: `invalid version constraint "newest"`},
+    }
+
+    // Version 4 is deprecated and version 6 retired
+    templates := []*WorkflowTemplate{
+        versionedTemplate(1, TemplateLifecycle{}),
+        versionedTemplate(2, TemplateLifecycle{}),
+        versionedTemplate(3, TemplateLifecycle{}),
+        versionedTemplate(4, TemplateLifecycle{Deprecated: true}),
+        versionedTemplate(5, TemplateLifecycle{}),
+        versionedTemplate(6, TemplateLifecycle{Retired: true}),
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            constraint, err := ParseVersionConstraint(tt.constraint)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+
+            var matches []int
+            for _, template := range templates {
+                if constraint.Matches(template) {
+                    matches = append(matches, template.Spec.Version)
+                }
+            }
+            if len(matches) != len(tt.matches) {
+                t.Fatalf("%q matches versions %v, want %v", tt.constraint, matches, tt.matches)
+            }
+            for i := range matches {
+                if matches[i] != tt.matches[i] {
+                    t.Fatalf("%q matches versions %v, want %v", tt.constraint, matches, tt.matches)
+                }
+            }
+        })
+    }
+}
+
+func TestResolveTemplate(t *testing.T) {
+    deleting := versionedTemplate(5, TemplateLifecycle{})
+    deleting.DeletionTimestamp = &metav1.Time{}
+
+    tm := NewTemplateManager()
+    tm.templates["encode"] = map[int]*WorkflowTemplate{
+        1: versionedTemplate(1, TemplateLifecycle{}),
+        2: versionedTemplate(2, TemplateLifecycle{Deprecated: true}),
+        3: versionedTemplate(3, TemplateLifecycle{Retired: true, Message: "use version 1"}),
+        5: deleting,
+    }
+
+    tests := []struct {
+        name    string
+        ref     TemplateRef
+        version int
+        wantErr string
+    }{
+        {name: "latest skips retired and deleting", ref: TemplateRef{Name: "encode"}, version: 2},
+        {name: "stable skips deprecated", ref: TemplateRef{Name: "encode", VersionConstraint: "stable"}, version: 1},
+        {name: "exact deprecated version", ref: TemplateRef{Name: "encode", Version: 2}, version: 2},
+        {
+            name:    "exact retired version",
+            ref:     TemplateRef{Name: "encode", Version: 3},
+            wantErr: "template encode version 3 is retired: use version 1",
+        },
+        {
+            name:    "exact deleting version",
+            ref:     TemplateRef{Name: "encode", Version: 5},
+            wantErr: "template encode version 5 is being deleted",
+        },
+        {
+            name:    "missing version",
+            ref:     TemplateRef{Name: "encode", Version: 4},
+            wantErr: "version 4 not found for template encode",
+        },
+        {
+            name:    "unsatisfiable constraint",
+            ref:     TemplateRef{Name: "encode", VersionConstraint: ">=3"},
+            wantErr: `no version of template encode satisfies ">=3"`,
+        },
+        {
+            name:    "version and constraint",
+            ref:     TemplateRef{Name: "encode", Version: 1, VersionConstraint: "stable"},
+            wantErr: "reference to template encode sets both version and versionConstraint",
+        },
+        {
+            name:    "invalid constraint",
+            ref:     TemplateRef{Name: "encode", VersionConstraint: "=>1"},
+            wantErr: `template encode: invalid version constraint "=>1"`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            ref := tt.ref
+            template, err := tm.ResolveTemplate(&ref)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            if template.Spec.Version != tt.version {
+                t.Errorf("resolved version %d, want %d", template.Spec.Version, tt.version)
+            }
+        })
+    }
+
+    // Composition still sees a version being deleted
+    tm.mutex.RLock()
+    template, err := tm.findLocked(&TemplateRef{Name: "encode"}, false)
+    tm.mutex.RUnlock()
+    if err != nil || template.Spec.Version != 5 {
+        t.Errorf("findLocked() without skipDeleting = %v, %v, want version 5", template, err)
+    }
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "context"
+    "log"
+    "time"
+
+    corev1 "k8s.io/api/core/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/runtime"
+)
+
+// workflowContext returns the context the workflow's tasks run under. With
+// TIME_OUT and RETRY it expires at the workflow deadline, which cancels every
+// running task. ALERT_ONLY never cancels anything; instead an alert is raised
+// when the deadline passes and the returned channel is closed.
+func (c *Controller) workflowContext(obj runtime.Object, run *WorkflowRun) (context.Context, context.CancelFunc, <-chan struct{}) {
+    alerted := make(chan struct{})
+    statusManager := NewStatusManager(run)
+
+    deadline, ok := statusManager.Deadline()
+    if !ok {
+        ctx, cancel := context.WithCancel(context.Background())
+        return ctx, cancel, alerted
+    }
+
+    if statusManager.TimeoutPolicy() != TimeoutPolicyAlertOnly {
+        ctx, cancel := context.WithDeadline(context.Background(), deadline)
+        return ctx, cancel, alerted
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    if statusManager.TimeoutAlerted() {
+        return ctx, cancel, alerted
+    }
+    timer := time.AfterFunc(time.Until(deadline), func() {
+        c.reportTimeout(obj, run, TimeoutPolicyAlertOnly)
+        close(alerted)
+    })
+    return ctx, func() {
+        timer.Stop()
+        cancel()
+    }, alerted
+}
+
+// handleTimeout applies the TIME_OUT or RETRY policy once the scheduler has
+// cancelled and drained the run's tasks
+func (c *Controller) handleTimeout(obj runtime.Object, run *WorkflowRun, checkpointer *workflowCheckpointer) error {
+    c.reportTimeout(obj, run, NewStatusManager(run).TimeoutPolicy())
+
+    // Cancelled tasks delete their own Jobs; this also catches Jobs left
+    // behind by an earlier controller process
+    c.deleteRunJobs(run)
+
+    err := checkpointer.RecordTimeout()
+    if _, ok := err.(*checkpointError); ok {
+        return err
+    }
+    if err != nil {
+        log.Printf("Workflow run %s/%s failed: %v", run.Namespace, run.Name, err)
+    }
+    return nil
+}
+
+// reportTimeout emits the Event and metric for a timed out attempt
+func (c *Controller) reportTimeout(obj runtime.Object, run *WorkflowRun, policy string) {
+    log.Printf("Workflow run %s/%s exceeded its timeout of %d seconds (policy %s)",
+        run.Namespace, run.Name, run.Workflow.Spec.TimeoutSeconds, policy)
+    c.metricsCollector.RecordWorkflowTimeout(run.Workflow.Spec.Name, policy)
+    c.recorder.Eventf(obj, corev1.EventTypeWarning, "WorkflowTimeout",
+        "Workflow exceeded its timeout of %d seconds (timeoutPolicy %s)", run.Workflow.Spec.TimeoutSeconds, policy)
+}
+
+// deleteRunJobs removes every Job spawned for the run
+func (c *Controller) deleteRunJobs(run *WorkflowRun) {
+    propagation := metav1.DeletePropagationBackground
+    err := c.kubeClient.BatchV1().Jobs(run.Namespace).DeleteCollection(
+        context.Background(),
+        metav1.DeleteOptions{PropagationPolicy: &propagation},
+        metav1.ListOptions{LabelSelector: "workflow-run=" + run.Name},
+    )
+    if err != nil {
+        log.Printf("Error deleting jobs of workflow run %s/%s: %v", run.Namespace, run.Name, err)
+    }
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "log"
+    "math/big"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    admissionv1 "k8s.io/api/admission/v1"
+    "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/kubernetes"
+    "k8s.io/client-go/util/retry"
+)
+
+// The validating webhook is registered by 05-3-netflix-workflow-webhook.yaml
+// for Workflows and WorkflowTemplates. The API server sends an AdmissionReview
+// to /validate for every create and update, and for template deletes, which
+// are refused while workflow runs still use the template.
+
+// WebhookServer serves admission reviews over TLS
+type WebhookServer struct {
+    validator *AdmissionValidator
+    addr      string
+    certDir   string
+}
+
+func NewWebhookServer(validator *AdmissionValidator, addr, certDir string) *WebhookServer {
+    return &WebhookServer{
+        validator: validator,
+        addr:      addr,
+        certDir:   certDir,
+    }
+}
+
+func (s *WebhookServer) Run(stopCh <-chan struct{}) error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/validate", s.handleValidate)
+
+    server := &http.Server{
+        Addr:      s.addr,
+        Handler:   mux,
+        TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+    }
+    go func() {
+        <-stopCh
+        server.Close()
+    }()
+
+    log.Printf("Serving admission webhook on %s", s.addr)
+    err := server.ListenAndServeTLS(filepath.Join(s.certDir, "tls.crt"), filepath.Join(s.certDir, "tls.key"))
+    if err != nil && err != http.ErrServerClosed {
+        return err
+    }
+    return nil
+}
+
+func (s *WebhookServer) handleValidate(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var review admissionv1.AdmissionReview
+    if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+        http.Error(w, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+        return
+    }
+    if review.Request == nil {
+        http.Error(w, "admission review has no request", http.StatusBadRequest)
+        return
+    }
+
+    response := s.review(review.Request)
+    response.UID = review.Request.UID
+    writeJSON(w, http.StatusOK, admissionv1.AdmissionReview{
+        TypeMeta: review.TypeMeta,
+        Response: response,
+    })
+}
+
+// review validates the object in an admission request
+func (s *WebhookServer) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+    var result *AdmissionResult
+    switch req.Kind.Kind {
+    case "Workflow":
+        workflow := &Workflow{}
+        if err := json.Unmarshal(req.Object.Raw, workflow); err != nil {
+            return denyRequest(req, &AdmissionResult{Errors: []FieldError{{Message: fmt.Sprintf("cannot decode workflow: %v", err)}}})
+        }
+        result = s.validator.ValidateWorkflow(workflow)
+    case "WorkflowTemplate":
+        template := &WorkflowTemplate{}
+        raw := req.Object.Raw
+        if req.Operation == admissionv1.Delete {
+            raw = req.OldObject.Raw
+        }
+        if err := json.Unmarshal(raw, template); err != nil {
+            return denyRequest(req, &AdmissionResult{Errors: []FieldError{{Message: fmt.Sprintf("cannot decode workflow template: %v", err)}}})
+        }
+        if req.Operation == admissionv1.Delete {
+            result = s.validator.ValidateTemplateDelete(template)
+        } else {
+            result = s.validator.ValidateTemplate(template)
+        }
+    default:
+        return &admissionv1.AdmissionResponse{Allowed: true}
+    }
+
+    if len(result.Errors) > 0 {
+        log.Printf("Denied %s of %s %s: %d problems", req.Operation, req.Kind.Kind, req.Name, len(result.Errors))
+        return denyRequest(req, result)
+    }
+    return &admissionv1.AdmissionResponse{Allowed: true, Warnings: result.Warnings}
+}
+
+// denyRequest reports every error as a cause with its field path, the way
+// the API server reports schema violations
+func denyRequest(req *admissionv1.AdmissionRequest, result *AdmissionResult) *admissionv1.AdmissionResponse {
+    msgs := make([]string, len(result.Errors))
+    causes := make([]metav1.StatusCause, len(result.Errors))
+    for i, fieldErr := range result.Errors {
+        msgs[i] = fieldErr.Error()
+        causes[i] = metav1.StatusCause{
+            Type:    metav1.CauseTypeFieldValueInvalid,
+            Message: fieldErr.Message,
+            Field:   fieldErr.Path,
+        }
+    }
+
+    return &admissionv1.AdmissionResponse{
+        Allowed:  false,
+        Warnings: result.Warnings,
+        Result: &metav1.Status{
+            Status:  metav1.StatusFailure,
+            Code:    http.StatusUnprocessableEntity,
+            Reason:  metav1.StatusReasonInvalid,
+            Message: fmt.Sprintf("%s %s is invalid: %s", req.Kind.Kind, req.Name, strings.Join(msgs, "; ")),
+            Details: &metav1.StatusDetails{
+                Name:   req.Name,
+                Group:  req.Kind.Group,
+                Kind:   req.Kind.Kind,
+                Causes: causes,
+            },
+        },
+    }
+}
+
+// bootstrapSelfSignedCert prepares certDir for local clusters, where no
+// certificate issuer is installed. Unless certDir already holds a
+// certificate, it generates a CA and a serving certificate for the webhook
+// Service, then writes the CA into the caBundle of the
+// ValidatingWebhookConfiguration so the API server trusts it.
+func bootstrapSelfSignedCert(kubeClient kubernetes.Interface, certDir, service, namespace, webhookConfig string) error {
+    caFile := filepath.Join(certDir, "ca.crt")
+    caPEM, err := os.ReadFile(caFile)
+    if os.IsNotExist(err) {
+        caPEM, err = generateServingCert(certDir, service, namespace)
+        if err != nil {
+            return fmt.Errorf("failed to generate webhook certificate: %v", err)
+        }
+        log.Printf("Generated self-signed webhook certificate in %s", certDir)
+    } else if err != nil {
+        return err
+    }
+
+    return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+        webhooks := kubeClient.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+        config, err := webhooks.Get(context.TODO(), webhookConfig, metav1.GetOptions{})
+        if errors.IsNotFound(err) {
+            // Applied later, the configuration needs its caBundle set by hand
+            log.Printf("ValidatingWebhookConfiguration %s not found; set its caBundle from %s", webhookConfig, caFile)
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        for i := range config.Webhooks {
+            config.Webhooks[i].ClientConfig.CABundle = caPEM
+        }
+        _, err = webhooks.Update(context.TODO(), config, metav1.UpdateOptions{})
+        return err
+    })
+}
+
+// generateServingCert writes ca.crt, tls.crt and tls.key to certDir and
+// returns the CA certificate
+func generateServingCert(certDir, service, namespace string) ([]byte, error) {
+    if err := os.MkdirAll(certDir, 0700); err != nil {
+        return nil, err
+    }
+
+    notBefore := time.Now().Add(-time.Hour)
+    notAfter := notBefore.Add(365 * 24 * time.Hour)
+
+    caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    caTemplate := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "workflow-controller-webhook-ca"},
+        NotBefore:             notBefore,
+        NotAfter:              notAfter,
+        KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+    if err != nil {
+        return nil, err
+    }
+    caCert, err := x509.ParseCertificate(caDER)
+    if err != nil {
+        return nil, err
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    serviceHost := fmt.Sprintf("%s.%s.svc", service, namespace)
+    certTemplate := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject:      pkix.Name{CommonName: serviceHost},
+        DNSNames: []string{
+            service,
+            fmt.Sprintf("%s.%s", service, namespace),
+            serviceHost,
+            serviceHost + ".cluster.local",
+            "localhost",
+        },
+        IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+        NotBefore:   notBefore,
+        NotAfter:    notAfter,
+        KeyUsage:    x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    certDER, err := x509.CreateCertificate(rand.Reader, certTemplate, caCert, &key.PublicKey, caKey)
+    if err != nil {
+        return nil, err
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return nil, err
+    }
+
+    caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+    files := []struct {
+        name string
+        data []byte
+        mode os.FileMode
+    }{
+        {"tls.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600},
+        {"tls.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644},
+        // Written last: its presence marks the bootstrap as complete
+        {"ca.crt", caPEM, 0644},
+    }
+    for _, file := range files {
+        if err := os.WriteFile(filepath.Join(certDir, file.name), file.data, file.mode); err != nil {
+            return nil, err
+        }
+    }
+    return caPEM, nil
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+    "context"
+    "crypto/subtle"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/util/uuid"
+    "k8s.io/apimachinery/pkg/util/wait"
+    "k8s.io/client-go/kubernetes"
+)
+
+// SIMPLE tasks are executed by external workers. The controller queues them
+// by task name and workers drive them through a small HTTP API:
+//
+//     GET  /api/v1/tasks/poll/{taskName}?workerId=w1   lease the next queued task (204 if none)
+//     POST /api/v1/tasks/{taskId}/heartbeat             {"workerId": "w1"} extends the lease
+//     POST /api/v1/tasks/{taskId}/complete              {"workerId": "w1", "output": {...}}
+//     POST /api/v1/tasks/{taskId}/fail                  {"workerId": "w1", "reason": "..."}
+//
+// Every request must carry "Authorization: Bearer <token>", where the token
+// is the "token" key of the Secret named by --worker-token-secret in
+// --worker-token-namespace. It is read once at startup, so restart the
+// controller after rotating it:
+//
+//     kubectl create secret generic workflow-worker-token --from-literal=token=$(openssl rand -hex 32)
+//
+// Without the Secret the controller still starts, but logs a warning and
+// serves no worker API, so SIMPLE tasks stay queued until their workflow
+// times out.
+//
+// A lease that expires without a heartbeat puts the task back on the queue.
+// Expired leases and reported failures both count as attempts against the
+// task's retryCount.
+//
+// The queue and its leases exist only in the controller's memory. A
+// controller restart loses every queued and leased SIMPLE task: workers'
+// updates for them fail with 404, and the tasks are queued afresh, with new
+// IDs, when their workflow runs resume.
+
+type workerTaskResult struct {
+    output map[string]interface{}
+    err    error
+}
+
+// workerTask is one queued execution of a SIMPLE task
+type workerTask struct {
+    ID                string
+    TaskName          string
+    WorkflowName      string
+    WorkflowRun       string
+    WorkflowNamespace string
+    InputParameters   map[string]interface{}
+
+    retryCount  int
+    attempts    int
+    workerID    string
+    leaseExpiry time.Time
+    done        chan workerTaskResult
+}
+
+// WorkerTaskQueue holds SIMPLE tasks until a worker completes them
+type WorkerTaskQueue struct {
+    leaseDuration    time.Duration
+    metricsCollector *MetricsCollector
+
+    pending map[string][]*workerTask // task name -> tasks waiting for a worker
+    tasks   map[string]*workerTask   // task ID -> queued or leased task
+    mutex   sync.Mutex
+}
+
+func NewWorkerTaskQueue(leaseDuration time.Duration, metricsCollector *MetricsCollector) *WorkerTaskQueue {
+    return &WorkerTaskQueue{
+        leaseDuration:    leaseDuration,
+        metricsCollector: metricsCollector,
+        pending:          make(map[string][]*workerTask),
+        tasks:            make(map[string]*workerTask),
+    }
+}
+
+// Execute queues the task and blocks until a worker completes it, it runs out
+// of attempts or ctx is done. A cancelled task is withdrawn from the queue and
+// its worker's next update fails with 404.
+func (q *WorkerTaskQueue) Execute(ctx context.Context, task Task, run *WorkflowRun) (map[string]interface{}, error) {
+    wt := &workerTask{
+        ID:                string(uuid.NewUUID()),
+        TaskName:          task.Name,
+        WorkflowName:      run.Workflow.Spec.Name,
+        WorkflowRun:       run.Name,
+        WorkflowNamespace: run.Namespace,
+        InputParameters:   task.InputParameters,
+        retryCount:        task.RetryCount,
+        done:              make(chan workerTaskResult, 1),
+    }
+
+    q.mutex.Lock()
+    q.tasks[wt.ID] = wt
+    q.enqueueLocked(wt)
+    q.mutex.Unlock()
+
+    select {
+    case result := <-wt.done:
+        return result.output, result.err
+    case <-ctx.Done():
+        q.withdraw(wt)
+        return nil, ctx.Err()
+    }
+}
+
+// withdraw removes a task that is no longer wanted, whether it is queued or
+// leased
+func (q *WorkerTaskQueue) withdraw(wt *workerTask) {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    delete(q.tasks, wt.ID)
+    queued := q.pending[wt.TaskName]
+    for i, pending := range queued {
+        if pending == wt {
+            q.pending[wt.TaskName] = append(queued[:i:i], queued[i+1:]...)
+            break
+        }
+    }
+    q.metricsCollector.UpdateTaskQueueSize("SIMPLE", float64(q.pendingCountLocked()))
+}
+
+func (q *WorkerTaskQueue) enqueueLocked(wt *workerTask) {
+    wt.workerID = ""
+    wt.leaseExpiry = time.Time{}
+    q.pending[wt.TaskName] = append(q.pending[wt.TaskName], wt)
+    q.metricsCollector.UpdateTaskQueueSize("SIMPLE", float64(q.pendingCountLocked()))
+}
+
+func (q *WorkerTaskQueue) pendingCountLocked() int {
+    count := 0
+    for _, tasks := range q.pending {
+        count += len(tasks)
+    }
+    return count
+}
+
+// Poll leases the oldest queued task with the given name to the worker.
+// The response is built under the lock since the lease fields keep
+// changing once it is released.
+func (q *WorkerTaskQueue) Poll(taskName, workerID string) (workerTaskResponse, bool) {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    queued := q.pending[taskName]
+    if len(queued) == 0 {
+        return workerTaskResponse{}, false
+    }
+    wt := queued[0]
+    q.pending[taskName] = queued[1:]
+    q.metricsCollector.UpdateTaskQueueSize("SIMPLE", float64(q.pendingCountLocked()))
+
+    wt.attempts++
+    wt.workerID = workerID
+    wt.leaseExpiry = time.Now().Add(q.leaseDuration)
+    return workerTaskResponse{
+        TaskID:            wt.ID,
+        TaskName:          wt.TaskName,
+        WorkflowName:      wt.WorkflowName,
+        WorkflowRun:       wt.WorkflowRun,
+        WorkflowNamespace: wt.WorkflowNamespace,
+        InputParameters:   wt.InputParameters,
+        Attempt:           wt.attempts,
+        LeaseExpiresAt:    metav1.NewTime(wt.leaseExpiry),
+    }, true
+}
+
+// leasedTaskLocked returns the task if the worker currently holds its lease
+func (q *WorkerTaskQueue) leasedTaskLocked(taskID, workerID string) (*workerTask, error) {
+    wt, exists := q.tasks[taskID]
+    if !exists {
+        return nil, errTaskNotFound
+    }
+    if wt.workerID == "" || wt.workerID != workerID {
+        return nil, errLeaseNotHeld
+    }
+    return wt, nil
+}
+
+func (q *WorkerTaskQueue) Heartbeat(taskID, workerID string) (time.Time, error) {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    wt, err := q.leasedTaskLocked(taskID, workerID)
+    if err != nil {
+        return time.Time{}, err
+    }
+    wt.leaseExpiry = time.Now().Add(q.leaseDuration)
+    return wt.leaseExpiry, nil
+}
+
+func (q *WorkerTaskQueue) Complete(taskID, workerID string, output map[string]interface{}) error {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    wt, err := q.leasedTaskLocked(taskID, workerID)
+    if err != nil {
+        return err
+    }
+    q.finishLocked(wt, workerTaskResult{output: output})
+    return nil
+}
+
+func (q *WorkerTaskQueue) Fail(taskID, workerID, reason string) error {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    wt, err := q.leasedTaskLocked(taskID, workerID)
+    if err != nil {
+        return err
+    }
+    q.retryOrFailLocked(wt, fmt.Sprintf("worker %s reported failure: %s", workerID, reason))
+    return nil
+}
+
+// retryOrFailLocked re-queues the task if it has attempts left
+func (q *WorkerTaskQueue) retryOrFailLocked(wt *workerTask, reason string) {
+    if wt.attempts <= wt.retryCount {
+        log.Printf("Re-queuing task %s of workflow run %s/%s (attempt %d of %d): %s",
+            wt.TaskName, wt.WorkflowNamespace, wt.WorkflowRun, wt.attempts, wt.retryCount+1, reason)
+        q.metricsCollector.RecordTaskRetry("SIMPLE", wt.WorkflowName, wt.TaskName)
+        q.enqueueLocked(wt)
+        return
+    }
+    q.finishLocked(wt, workerTaskResult{
+        err: fmt.Errorf("task failed after %d attempts: %s", wt.attempts, reason),
+    })
+}
+
+func (q *WorkerTaskQueue) finishLocked(wt *workerTask, result workerTaskResult) {
+    delete(q.tasks, wt.ID)
+    wt.done <- result
+}
+
+// expireLeases re-queues tasks whose worker stopped heartbeating
+func (q *WorkerTaskQueue) expireLeases() {
+    q.mutex.Lock()
+    defer q.mutex.Unlock()
+
+    now := time.Now()
+    for _, wt := range q.tasks {
+        if wt.workerID != "" && now.After(wt.leaseExpiry) {
+            q.retryOrFailLocked(wt, fmt.Sprintf("lease held by worker %s expired", wt.workerID))
+        }
+    }
+}
+
+// Run checks for expired leases until stopCh is closed
+func (q *WorkerTaskQueue) Run(stopCh <-chan struct{}) {
+    wait.Until(q.expireLeases, time.Second, stopCh)
+}
+
+var (
+    errTaskNotFound = fmt.Errorf("task not found")
+    errLeaseNotHeld = fmt.Errorf("lease not held by this worker")
+)
+
+// workerTokenKey is the key of the worker token in its Secret
+const workerTokenKey = "token"
+
+// LoadWorkerToken reads the bearer token workers authenticate with
+func LoadWorkerToken(kubeClient kubernetes.Interface, namespace, name string) (string, error) {
+    secret, err := kubeClient.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+    if err != nil {
+        return "", fmt.Errorf("failed to get worker token secret %s/%s: %v", namespace, name, err)
+    }
+    token := strings.TrimSpace(string(secret.Data[workerTokenKey]))
+    if token == "" {
+        return "", fmt.Errorf("worker token secret %s/%s has no %s", namespace, name, workerTokenKey)
+    }
+    return token, nil
+}
+
+// WorkerAPIServer serves the worker protocol over HTTP
+type WorkerAPIServer struct {
+    queue *WorkerTaskQueue
+    addr  string
+    token string
+}
+
+func NewWorkerAPIServer(queue *WorkerTaskQueue, addr, token string) *WorkerAPIServer {
+    return &WorkerAPIServer{
+        queue: queue,
+        addr:  addr,
+        token: token,
+    }
+}
+
+type workerTaskResponse struct {
+    TaskID            string                 `json:"taskId"`
+    TaskName          string                 `json:"taskName"`
+    WorkflowName      string                 `json:"workflowName"`
+    WorkflowRun       string                 `json:"workflowRun"`
+    WorkflowNamespace string                 `json:"workflowNamespace"`
+    InputParameters   map[string]interface{} `json:"inputParameters,omitempty"`
+    Attempt           int                    `json:"attempt"`
+    LeaseExpiresAt    metav1.Time            `json:"leaseExpiresAt"`
+}
+
+type workerUpdateRequest struct {
+    WorkerID string                 `json:"workerId"`
+    Output   map[string]interface{} `json:"output,omitempty"`
+    Reason   string                 `json:"reason,omitempty"`
+}
+
+func (s *WorkerAPIServer) Run(stopCh <-chan struct{}) error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/api/v1/tasks/poll/", s.handlePoll)
+    mux.HandleFunc("/api/v1/tasks/", s.handleTaskUpdate)
+
+    server := &http.Server{Addr: s.addr, Handler: s.authenticate(mux)}
+    go func() {
+        <-stopCh
+        server.Close()
+    }()
+
+    log.Printf("Serving worker API on %s", s.addr)
+    if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+        return err
+    }
+    return nil
+}
+
+// authenticate rejects requests without the worker bearer token
+func (s *WorkerAPIServer) authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func (s *WorkerAPIServer) handlePoll(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    taskName := strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/poll/")
+    workerID := r.URL.Query().Get("workerId")
+    if taskName == "" || workerID == "" {
+        http.Error(w, "task name and workerId are required", http.StatusBadRequest)
+        return
+    }
+
+    task, ok := s.queue.Poll(taskName, workerID)
+    if !ok {
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    writeJSON(w, http.StatusOK, task)
+}
+
+// handleTaskUpdate serves /api/v1/tasks/{taskId}/{heartbeat|complete|fail}
+func (s *WorkerAPIServer) handleTaskUpdate(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/"), "/")
+    if len(parts) != 2 || parts[0] == "" {
+        http.NotFound(w, r)
+        return
+    }
+    taskID, action := parts[0], parts[1]
+
+    var req workerUpdateRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+        return
+    }
+    if req.WorkerID == "" {
+        http.Error(w, "workerId is required", http.StatusBadRequest)
+        return
+    }
+
+    var err error
+    switch action {
+    case "heartbeat":
+        var expiry time.Time
+        expiry, err = s.queue.Heartbeat(taskID, req.WorkerID)
+        if err == nil {
+            writeJSON(w, http.StatusOK, map[string]interface{}{"leaseExpiresAt": metav1.NewTime(expiry)})
+            return
+        }
+    case "complete":
+        err = s.queue.Complete(taskID, req.WorkerID, req.Output)
+    case "fail":
+        err = s.queue.Fail(taskID, req.WorkerID, req.Reason)
+    default:
+        http.NotFound(w, r)
+        return
+    }
+
+    switch err {
+    case nil:
+        w.WriteHeader(http.StatusNoContent)
+    case errTaskNotFound:
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errLeaseNotHeld:
+        http.Error(w, err.Error(), http.StatusConflict)
+    default:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    if err := json.NewEncoder(w).Encode(body); err != nil {
+        log.Printf("Error writing response: %v", err)
+    }
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/labels"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// workflowRunGVR identifies the WorkflowRun CRD served by 05-3-netflix-workflowrun-crd.yaml
+var workflowRunGVR = schema.GroupVersionResource{
+    Group:    "conductor.netflix.com",
+    Version:  "v1",
+    Resource: "workflowruns",
+}
+
+// WorkflowRun is one execution of a Workflow definition. A definition can be
+// run any number of times, concurrently; each run carries its own input and
+// status.
+type WorkflowRun struct {
+    metav1.TypeMeta   `json:",inline"`
+    metav1.ObjectMeta `json:"metadata,omitempty"`
+    Spec             WorkflowRunSpec `json:"spec"`
+    Status           WorkflowStatus  `json:"status,omitempty"`
+
+    // Workflow is the definition being run, resolved by the controller
+    Workflow *Workflow `json:"-"`
+    // Input is spec.input checked against the definition's inputParameters,
+    // with defaults filled in
+    Input map[string]interface{} `json:"-"`
+}
+
+type WorkflowRunSpec struct {
+    WorkflowRef WorkflowRef `json:"workflowRef"`
+    // Input is available to tasks as ${workflow.input.<field>}
+    Input       map[string]interface{} `json:"input,omitempty"`
+}
+
+// WorkflowRef selects a Workflow definition by spec.name and spec.version.
+// A zero version runs the latest version at the time the run starts.
+type WorkflowRef struct {
+    Name    string `json:"name"`
+    Version int    `json:"version,omitempty"`
+}
+
+// runFromObject converts a lister object into a typed WorkflowRun. The lister
+// hands out shared cache objects, so the result is a deep copy.
+func runFromObject(obj runtime.Object) (*WorkflowRun, error) {
+    u, ok := obj.(*unstructured.Unstructured)
+    if !ok {
+        return nil, fmt.Errorf("unexpected object type %T", obj)
+    }
+
+    run := &WorkflowRun{}
+    if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.DeepCopy().UnstructuredContent(), run); err != nil {
+        return nil, err
+    }
+    return run, nil
+}
+
+// resolveWorkflow finds the definition a run executes. Once a run has
+// started it stays on the version recorded in its status.
+func (c *Controller) resolveWorkflow(run *WorkflowRun) (*Workflow, error) {
+    ref := run.Spec.WorkflowRef
+    version := ref.Version
+    if run.Status.WorkflowVersion != 0 {
+        version = run.Status.WorkflowVersion
+    }
+
+    objs, err := c.workflowLister.ByNamespace(run.Namespace).List(labels.Everything())
+    if err != nil {
+        return nil, err
+    }
+
+    var found *Workflow
+    for _, obj := range objs {
+        workflow, err := workflowFromObject(obj)
+        if err != nil || workflow.Spec.Name != ref.Name {
+            continue
+        }
+        if version != 0 && workflow.Spec.Version != version {
+            continue
+        }
+        if found == nil || workflow.Spec.Version > found.Spec.Version {
+            found = workflow
+        }
+    }
+
+    if found == nil {
+        if version != 0 {
+            return nil, fmt.Errorf("workflow %s version %d not found", ref.Name, version)
+        }
+        return nil, fmt.Errorf("workflow %s not found", ref.Name)
+    }
+    return found, nil
+}
+
+// validateRunInput checks a run's input against the definition's declared
+// parameters and returns it with defaults applied. Every problem is
+// reported, not just the first.
+func validateRunInput(parameters []WorkflowParameter, input map[string]interface{}) (map[string]interface{}, error) {
+    declared := make(map[string]bool, len(parameters))
+    resolved := make(map[string]interface{}, len(parameters))
+    var problems []string
+
+    for _, param := range parameters {
+        declared[param.Name] = true
+
+        value, provided := input[param.Name]
+        if !provided || value == nil {
+            if param.Default == nil {
+                if param.Required {
+                    problems = append(problems, fmt.Sprintf("%s is required", param.Name))
+                }
+                continue
+            }
+            value = param.Default
+        }
+
+        if param.Type != "" && !matchesFieldType(value, param.Type) {
+            problems = append(problems, fmt.Sprintf("%s must be of type %s", param.Name, param.Type))
+            continue
+        }
+        resolved[param.Name] = value
+    }
+
+    var unknown []string
+    for name := range input {
+        if !declared[name] {
+            unknown = append(unknown, name)
+        }
+    }
+    sort.Strings(unknown)
+    for _, name := range unknown {
+        problems = append(problems, fmt.Sprintf("%s is not a declared input parameter", name))
+    }
+
+    if len(problems) > 0 {
+        return nil, fmt.Errorf("invalid input: %s", strings.Join(problems, "; "))
+    }
+    return resolved, nil
+}